@@ -0,0 +1,293 @@
+// Package agent caches unlocked master keys in locked memory, and serves
+// them to clients run by the same user over a unix socket, so that a vault
+// can be used several times without unlocking it each time.
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotCached is returned when the vault is not unlocked in the agent.
+var ErrNotCached = errors.New("vault is not unlocked in the agent")
+
+// ErrPeerUID is returned for connections from processes run by another user.
+var ErrPeerUID = errors.New("connection from another user refused")
+
+// ErrUnknownOp is returned for requests which the agent does not understand.
+var ErrUnknownOp = errors.New("unknown agent request")
+
+// ErrInvalidEntry is returned when adding an empty master key, or one without a vault ID.
+var ErrInvalidEntry = errors.New("master key and vault id are required")
+
+// maxRequestSize limits the size of a request, which holds at most one master key.
+const maxRequestSize = 64 * 1024
+
+// Agent holds master keys, keyed by the ID of their vault, until they are
+// locked or expire. Each key expires once it has not been used for its idle
+// timeout, or once its lifetime has passed, whichever comes first.
+type Agent struct {
+	// Idle is the longest that a key is kept without being used.
+	Idle time.Duration
+	// Lifetime is the longest that a key is kept after it is added.
+	Lifetime time.Duration
+
+	entries map[string]*entry
+	mu      sync.Mutex
+}
+
+// entry is a master key held by the agent.
+type entry struct {
+	name    string
+	key     *lockedBuffer
+	idle    time.Duration
+	used    time.Time
+	expires time.Time
+	timer   *time.Timer
+}
+
+// deadline returns when the entry expires unless it is used again.
+func (e *entry) deadline() time.Time {
+	idle := e.used.Add(e.idle)
+	if idle.Before(e.expires) {
+		return idle
+	}
+	return e.expires
+}
+
+// Status describes a master key held by the agent.
+type Status struct {
+	// Vault is the ID of the vault.
+	Vault string `json:"vault"`
+	// Name is the name of the vault.
+	Name string `json:"name"`
+	// Expires is when the key expires unless it is used again.
+	Expires time.Time `json:"expires"`
+}
+
+// New creates an Agent which keeps each key for at most the durations.
+func New(idle, lifetime time.Duration) *Agent {
+	return &Agent{
+		Idle:     idle,
+		Lifetime: lifetime,
+		entries:  map[string]*entry{},
+	}
+}
+
+// Add stores a copy of the master key of the vault in locked memory, replacing any
+// key already held for it. The idle timeout and lifetime are limited to those of the
+// agent, which are used when they are zero.
+func (a *Agent) Add(vault, name string, masterKey []byte, idle, lifetime time.Duration) error {
+	if vault == "" || len(masterKey) == 0 {
+		return ErrInvalidEntry
+	}
+	key, err := newLockedBuffer(masterKey)
+	if err != nil {
+		return fmt.Errorf("lock memory: %w", err)
+	}
+
+	now := time.Now()
+	e := &entry{
+		name:    name,
+		key:     key,
+		idle:    limit(idle, a.Idle),
+		used:    now,
+		expires: now.Add(limit(lifetime, a.Lifetime)),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.remove(vault)
+	e.timer = time.AfterFunc(e.deadline().Sub(now), func() { a.expire(vault, e) })
+	a.entries[vault] = e
+	return nil
+}
+
+// limit returns d, or most if d is zero or greater than most.
+func limit(d, most time.Duration) time.Duration {
+	if d <= 0 || d > most {
+		return most
+	}
+	return d
+}
+
+// Get returns a copy of the master key of the vault, restarting its idle timeout.
+func (a *Agent) Get(vault string) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e := a.entries[vault]
+	if e == nil {
+		return nil, ErrNotCached
+	}
+	e.used = time.Now()
+	e.timer.Reset(e.deadline().Sub(e.used))
+	return slices.Clone(e.key.bytes()), nil
+}
+
+// Lock removes the master key of the vault, returning whether it was held.
+func (a *Agent) Lock(vault string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.remove(vault)
+}
+
+// LockAll removes every master key, returning the number which were held.
+func (a *Agent) LockAll() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := len(a.entries)
+	for vault := range a.entries {
+		a.remove(vault)
+	}
+	return n
+}
+
+// List describes the master keys held by the agent, ordered by vault name.
+func (a *Agent) List() []Status {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	list := make([]Status, 0, len(a.entries))
+	for vault, e := range a.entries {
+		list = append(list, Status{Vault: vault, Name: e.name, Expires: e.deadline()})
+	}
+	slices.SortFunc(list, func(a, b Status) int {
+		return strings.Compare(a.Name+a.Vault, b.Name+b.Vault)
+	})
+	return list
+}
+
+// remove wipes and removes the master key of the vault. a.mu must be held.
+func (a *Agent) remove(vault string) bool {
+	e := a.entries[vault]
+	if e == nil {
+		return false
+	}
+	e.timer.Stop()
+	e.key.destroy()
+	delete(a.entries, vault)
+	return true
+}
+
+// expire removes the entry once its deadline has passed. The timer may fire
+// just after the entry was used or replaced, in which case it is kept.
+func (a *Agent) expire(vault string, e *entry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.entries[vault] != e {
+		return
+	}
+	if wait := time.Until(e.deadline()); wait > 0 {
+		e.timer.Reset(wait)
+		return
+	}
+	a.remove(vault)
+}
+
+// Serve accepts connections on the listener until it is closed, then locks every
+// key. Connections from processes run by other users are refused.
+func (a *Agent) Serve(ln net.Listener) error {
+	defer a.LockAll()
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("accept: %w", err)
+		}
+		go a.handle(conn)
+	}
+}
+
+// handle answers the single request sent on the connection.
+func (a *Agent) handle(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	err := checkPeer(conn)
+	if err != nil {
+		_ = json.NewEncoder(conn).Encode(response{Error: err.Error()})
+		return
+	}
+
+	var req request
+	err = json.NewDecoder(io.LimitReader(conn, maxRequestSize)).Decode(&req)
+	if err != nil {
+		_ = json.NewEncoder(conn).Encode(response{Error: fmt.Sprintf("invalid request: %s", err)})
+		return
+	}
+	defer clear(req.Key)
+
+	resp := a.respond(req)
+	defer clear(resp.Key)
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+func (a *Agent) respond(req request) response {
+	var resp response
+	switch req.Op {
+	case opGet:
+		key, err := a.Get(req.Vault)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.Key = key
+	case opAdd:
+		err := a.Add(req.Vault, req.Name, req.Key, req.Idle, req.Lifetime)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	case opLock:
+		if !a.Lock(req.Vault) {
+			resp.Error = ErrNotCached.Error()
+		}
+	case opLockAll:
+		resp.Count = a.LockAll()
+	case opList:
+		resp.Vaults = a.List()
+	default:
+		resp.Error = fmt.Sprintf("%s: %s", ErrUnknownOp, req.Op)
+	}
+	return resp
+}
+
+// checkPeer checks that the process on the other end of the connection is run by the same user.
+func checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ErrPeerUID
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var uid int
+	var uidErr error
+	err = raw.Control(func(fd uintptr) {
+		uid, uidErr = peerUID(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	if uidErr != nil {
+		return fmt.Errorf("peer credentials: %w", uidErr)
+	}
+	if uid != os.Getuid() {
+		return ErrPeerUID
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// SocketEnv is the environment variable which holds the path of the agent socket.
+const SocketEnv = "FIDOKIT_AGENT_SOCK"
+
+// ErrNotRunning is returned when no agent is listening on the socket.
+var ErrNotRunning = errors.New("the fidokit agent is not running")
+
+const (
+	opGet     = "get"
+	opAdd     = "add"
+	opLock    = "lock"
+	opLockAll = "lock-all"
+	opList    = "list"
+)
+
+// request is sent by a client as a single line of JSON, and is answered by a response.
+type request struct {
+	Op       string        `json:"op"`
+	Vault    string        `json:"vault,omitempty"`
+	Name     string        `json:"name,omitempty"`
+	Key      []byte        `json:"key,omitempty"`
+	Idle     time.Duration `json:"idle,omitempty"`
+	Lifetime time.Duration `json:"lifetime,omitempty"`
+}
+
+type response struct {
+	Error  string   `json:"error,omitempty"`
+	Key    []byte   `json:"key,omitempty"`
+	Count  int      `json:"count,omitempty"`
+	Vaults []Status `json:"vaults,omitempty"`
+}
+
+// errorsByText maps the text of errors sent by the agent back to the errors.
+var errorsByText = map[string]error{
+	ErrNotCached.Error():    ErrNotCached,
+	ErrPeerUID.Error():      ErrPeerUID,
+	ErrInvalidEntry.Error(): ErrInvalidEntry,
+}
+
+// DefaultSocket returns the path of the agent socket: the value of SocketEnv
+// if it is set, or else a path in the user's runtime or temporary directory.
+func DefaultSocket() string {
+	if path := os.Getenv(SocketEnv); path != "" {
+		return path
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "fidokit-agent.sock")
+	}
+	return filepath.Join(os.TempDir(), "fidokit-"+strconv.Itoa(os.Getuid()), "agent.sock")
+}
+
+// ErrSocketDir is returned when the directory of the socket could be used by another user.
+var ErrSocketDir = errors.New("the socket directory must be owned by the current user with mode 0700")
+
+// PrepareSocketDir creates the directory of the socket if it does not exist, then
+// checks that no other user could replace the socket: the directory must not be a
+// symbolic link, and must be owned by the current user with mode 0700.
+func PrepareSocketDir(socket string) error {
+	dir := filepath.Dir(socket)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("create socket directory: %w", err)
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0700 {
+		return fmt.Errorf("%w: %s", ErrSocketDir, dir)
+	}
+	uid, err := fileOwner(info)
+	if err != nil {
+		return fmt.Errorf("socket directory owner: %w", err)
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("%w: %s", ErrSocketDir, dir)
+	}
+	return nil
+}
+
+// Client sends requests to the agent listening on Socket.
+type Client struct {
+	Socket string
+}
+
+// call sends the request on a new connection, once the agent is known to be run by
+// the same user, and returns the response.
+func (c *Client) call(req request) (response, error) {
+	conn, err := net.DialTimeout("unix", c.Socket, 5*time.Second)
+	if err != nil {
+		return response{}, fmt.Errorf("%w: %w", ErrNotRunning, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// the socket could have been replaced by another user's process, which must not be sent keys
+	err = checkPeer(conn)
+	if err != nil {
+		return response{}, fmt.Errorf("check agent: %w", err)
+	}
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return response{}, fmt.Errorf("send request: %w", err)
+	}
+	var resp response
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return response{}, fmt.Errorf("read response: %w", err)
+	}
+	if resp.Error != "" {
+		if err, ok := errorsByText[resp.Error]; ok {
+			return response{}, err
+		}
+		return response{}, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Get returns the master key of the vault with the ID, or ErrNotCached.
+func (c *Client) Get(vault string) ([]byte, error) {
+	resp, err := c.call(request{Op: opGet, Vault: vault})
+	return resp.Key, err
+}
+
+// Add sends the master key of the vault with the ID and name to the agent to hold.
+// The idle timeout and lifetime may be zero to use those of the agent.
+func (c *Client) Add(vault, name string, masterKey []byte, idle, lifetime time.Duration) error {
+	_, err := c.call(request{Op: opAdd, Vault: vault, Name: name, Key: masterKey, Idle: idle, Lifetime: lifetime})
+	return err
+}
+
+// Lock asks the agent to forget the master key of the vault with the ID, or returns ErrNotCached.
+func (c *Client) Lock(vault string) error {
+	_, err := c.call(request{Op: opLock, Vault: vault})
+	return err
+}
+
+// LockAll asks the agent to forget every master key, returning the number it held.
+func (c *Client) LockAll() (int, error) {
+	resp, err := c.call(request{Op: opLockAll})
+	return resp.Count, err
+}
+
+// List describes the master keys held by the agent.
+func (c *Client) List() ([]Status, error) {
+	resp, err := c.call(request{Op: opList})
+	return resp.Vaults, err
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package agent
+
+// lockedBuffer holds a secret, which is wiped when it is destroyed. Memory
+// cannot be locked on this platform, so it may be written to swap.
+type lockedBuffer struct {
+	mem []byte
+}
+
+// newLockedBuffer copies the secret into a new buffer.
+func newLockedBuffer(secret []byte) (*lockedBuffer, error) {
+	return &lockedBuffer{mem: append([]byte(nil), secret...)}, nil
+}
+
+func (b *lockedBuffer) bytes() []byte {
+	return b.mem
+}
+
+// destroy wipes the buffer.
+func (b *lockedBuffer) destroy() {
+	clear(b.mem)
+	b.mem = nil
+}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// lockedBuffer holds a secret outside the Go heap, in memory which is locked
+// so that it is never written to swap, and is wiped when it is destroyed.
+type lockedBuffer struct {
+	mem []byte
+	n   int
+}
+
+// newLockedBuffer copies the secret into a new locked buffer.
+func newLockedBuffer(secret []byte) (*lockedBuffer, error) {
+	mem, err := unix.Mmap(-1, 0, max(len(secret), 1), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Mlock(mem)
+	if err != nil {
+		_ = unix.Munmap(mem)
+		return nil, err
+	}
+	return &lockedBuffer{mem: mem, n: copy(mem, secret)}, nil
+}
+
+func (b *lockedBuffer) bytes() []byte {
+	return b.mem[:b.n]
+}
+
+// destroy wipes and releases the buffer.
+func (b *lockedBuffer) destroy() {
+	clear(b.mem)
+	_ = unix.Munlock(b.mem)
+	_ = unix.Munmap(b.mem)
+	b.mem = nil
+}
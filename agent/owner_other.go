@@ -0,0 +1,13 @@
+//go:build !unix
+
+package agent
+
+import (
+	"errors"
+	"os"
+)
+
+// fileOwner is not supported on this platform, so no socket directory is trusted.
+func fileOwner(info os.FileInfo) (int, error) {
+	return 0, errors.ErrUnsupported
+}
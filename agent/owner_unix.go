@@ -0,0 +1,18 @@
+//go:build unix
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the user ID of the owner of the file.
+func fileOwner(info os.FileInfo) (int, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	return int(stat.Uid), nil
+}
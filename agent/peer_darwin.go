@@ -0,0 +1,12 @@
+package agent
+
+import "golang.org/x/sys/unix"
+
+// peerUID returns the user ID of the process connected to the unix socket.
+func peerUID(fd int) (int, error) {
+	cred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return 0, err
+	}
+	return int(cred.Uid), nil
+}
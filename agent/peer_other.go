@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package agent
+
+import "errors"
+
+// peerUID is not supported on this platform, so every connection is refused.
+func peerUID(fd int) (int, error) {
+	return 0, errors.ErrUnsupported
+}
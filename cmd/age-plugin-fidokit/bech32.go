@@ -0,0 +1,68 @@
+package main
+
+import "strings"
+
+// The age library does not export its Bech32 encoder, which is needed to turn
+// the derived scalar into an identity that age.ParseX25519Identity accepts.
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range 5 {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+// bech32Encode encodes the data with the human-readable part, in uppercase if hrp is.
+func bech32Encode(hrp string, data []byte) string {
+	lower := strings.ToLower(hrp)
+
+	// regroup the data from 8-bit bytes into 5-bit values
+	var values []byte
+	acc, bits := 0, 0
+	for _, b := range data {
+		acc = acc<<8 | int(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc>>bits)&31)
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(acc<<(5-bits))&31)
+	}
+
+	expanded := make([]byte, 0, len(lower)*2+1+len(values)+6)
+	for _, c := range []byte(lower) {
+		expanded = append(expanded, c>>5)
+	}
+	expanded = append(expanded, 0)
+	for _, c := range []byte(lower) {
+		expanded = append(expanded, c&31)
+	}
+	expanded = append(expanded, values...)
+	polymod := bech32Polymod(append(expanded, 0, 0, 0, 0, 0, 0)) ^ 1
+	for i := range 6 {
+		values = append(values, byte(polymod>>(5*(5-i)))&31)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(lower)
+	sb.WriteByte('1')
+	for _, v := range values {
+		sb.WriteByte(bech32Charset[v])
+	}
+	if hrp != lower {
+		return strings.ToUpper(sb.String())
+	}
+	return sb.String()
+}
@@ -0,0 +1,229 @@
+// Command age-plugin-fidokit is an age plugin which uses a fidokit vault as an
+// age identity. The vault's recipient is a native X25519 recipient derived from
+// its master key, so files can be encrypted to it without the plugin. Decrypting
+// with the identity unlocks the vault using its FIDO2 keys.
+//
+// Generate an identity for a vault, which prints its recipient:
+//
+//	age-plugin-fidokit -generate -vault vault.json > identity.txt
+//	age -r age1... -o secret.age secret.txt
+//	age -d -i identity.txt secret.age
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+
+	"fidokit/crypto"
+	"fidokit/fidoutils"
+	"fidokit/fkvault"
+	"fidokit/prompt"
+)
+
+// identityVersion is the version of the identity stub format:
+// version || X25519 public key || vault ID || vault path.
+const identityVersion = 1
+
+const vaultIDSize = 16 // the length of utils.RandomID
+
+// stub identifies the vault referenced by an identity.
+type stub struct {
+	publicKey []byte
+	vaultID   string
+	vaultPath string
+}
+
+func (s stub) encode() []byte {
+	data := append([]byte{identityVersion}, s.publicKey...)
+	data = append(data, s.vaultID...)
+	return append(data, s.vaultPath...)
+}
+
+func parseStub(data []byte) (stub, error) {
+	if len(data) < 1+32+vaultIDSize || data[0] != identityVersion {
+		return stub{}, errors.New("unsupported fidokit identity")
+	}
+	return stub{
+		publicKey: data[1:33],
+		vaultID:   string(data[33 : 33+vaultIDSize]),
+		vaultPath: string(data[33+vaultIDSize:]),
+	}, nil
+}
+
+// deriveIdentity derives the vault's X25519 identity from its master key,
+// returning it with its public key.
+func deriveIdentity(masterKey []byte) (*age.X25519Identity, []byte, error) {
+	scalar := crypto.DeriveKey(masterKey, "age-x25519")
+	key, err := ecdh.X25519().NewPrivateKey(scalar)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := age.ParseX25519Identity(bech32Encode("AGE-SECRET-KEY-", scalar))
+	if err != nil {
+		return nil, nil, err
+	}
+	return id, key.PublicKey().Bytes(), nil
+}
+
+// recipient returns the native recipient for the public key in the stub.
+func (s stub) recipient() (age.Recipient, error) {
+	return age.ParseX25519Recipient(bech32Encode("age", s.publicKey))
+}
+
+// identity unlocks the vault referenced by a stub when it is first used.
+type identity struct {
+	stub
+	p *plugin.Plugin
+}
+
+func (i *identity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	// avoid asking for the keys when the file was not encrypted to an X25519 recipient
+	hasX25519 := false
+	for _, s := range stanzas {
+		hasX25519 = hasX25519 || s.Type == "X25519"
+	}
+	if !hasX25519 {
+		return nil, age.ErrIncorrectIdentity
+	}
+
+	pp := pluginPrompter{p: i.p}
+	fidoutils.Prompter = pp
+	fkvault.Prompter = pp
+
+	anyVault, _, err := loadVault(i.vaultPath, i.vaultID)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := unlock(anyVault)
+	if err != nil {
+		return nil, fmt.Errorf("unlock vault: %w", err)
+	}
+
+	id, publicKey, err := deriveIdentity(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(publicKey, i.publicKey) {
+		return nil, errors.New("vault master key does not match the identity")
+	}
+	return id.Unwrap(stanzas)
+}
+
+// loadVault loads the vault at the path, returning it with its ID,
+// which must match the id unless it is empty.
+func loadVault(path, id string) (any, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("read vault: %w", err)
+	}
+	anyVault, err := fkvault.ParseJSON(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var vaultID string
+	switch v := anyVault.(type) {
+	case *fkvault.SimpleVault:
+		vaultID = v.ID
+	case *fkvault.ShamirVault:
+		vaultID = v.ID
+	case *fkvault.PolicyVault:
+		vaultID = v.ID
+	}
+	if id != "" && vaultID != id {
+		return nil, "", fmt.Errorf("vault %s is not the vault %s referenced by the identity", path, id)
+	}
+	return anyVault, vaultID, nil
+}
+
+func unlock(anyVault any) ([]byte, error) {
+	switch v := anyVault.(type) {
+	case *fkvault.SimpleVault:
+		return v.InteractiveUnlock()
+	case *fkvault.ShamirVault:
+		return v.InteractiveCombine()
+	case *fkvault.PolicyVault:
+		return v.InteractiveUnlock()
+	}
+	return nil, fmt.Errorf("unknown vault type: %T", anyVault)
+}
+
+// generate unlocks the vault, then prints an identity which references it.
+func generate(vaultPath string) error {
+	p := prompt.NewTerminal(os.Stdin, os.Stderr)
+	fidoutils.Prompter = p
+	fkvault.Prompter = p
+
+	path, err := filepath.Abs(vaultPath)
+	if err != nil {
+		return err
+	}
+	anyVault, vaultID, err := loadVault(path, "")
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlock(anyVault)
+	if err != nil {
+		return fmt.Errorf("unlock vault: %w", err)
+	}
+	id, publicKey, err := deriveIdentity(masterKey)
+	if err != nil {
+		return err
+	}
+
+	s := stub{publicKey: publicKey, vaultID: vaultID, vaultPath: path}
+
+	fmt.Printf("# created: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Printf("# vault: %s (%s)\n", path, vaultID)
+	fmt.Printf("# recipient: %s\n", id.Recipient())
+	fmt.Println(plugin.EncodeIdentity("fidokit", s.encode()))
+	fmt.Fprintf(os.Stderr, "Recipient: %s\n", id.Recipient())
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+
+	p, err := plugin.New("fidokit")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	p.RegisterFlags(nil)
+	gen := flag.Bool("generate", false, "Unlock the vault and print an identity for it, followed by its recipient")
+	vaultPath := flag.String("vault", "vault.json", "The path to the vault, with -generate")
+	flag.Parse()
+
+	if *gen {
+		err = generate(*vaultPath)
+		if err != nil {
+			log.Fatalln("generate:", err)
+		}
+		return
+	}
+
+	p.HandleIdentity(func(data []byte) (age.Identity, error) {
+		s, err := parseStub(data)
+		if err != nil {
+			return nil, err
+		}
+		return &identity{stub: s, p: p}, nil
+	})
+	p.HandleIdentityAsRecipient(func(data []byte) (age.Recipient, error) {
+		s, err := parseStub(data)
+		if err != nil {
+			return nil, err
+		}
+		return s.recipient()
+	})
+	os.Exit(p.Main())
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"filippo.io/age/plugin"
+)
+
+// pluginPrompter is a prompt.Prompter which asks the user through the age
+// client, since stdin and stdout are used by the plugin protocol.
+type pluginPrompter struct {
+	p *plugin.Plugin
+}
+
+func (pp pluginPrompter) AskText(prompt string) (string, error) {
+	return pp.p.RequestValue(prompt, false)
+}
+
+func (pp pluginPrompter) AskSecret(prompt string) (string, error) {
+	return pp.p.RequestValue(prompt, true)
+}
+
+func (pp pluginPrompter) Confirm(prompt string, def bool) (bool, error) {
+	return pp.p.Confirm(prompt, "yes", "no")
+}
+
+func (pp pluginPrompter) Choose(prompt string, options []string) (int, error) {
+	for {
+		answer, err := pp.p.RequestValue(prompt+" ("+strings.Join(options, ", ")+")", false)
+		if err != nil {
+			return 0, err
+		}
+		i := slices.Index(options, answer)
+		if i >= 0 {
+			return i, nil
+		}
+	}
+}
+
+func (pp pluginPrompter) Notify(message string) {
+	if message != "" {
+		pp.p.DisplayMessage(message)
+	}
+}
@@ -0,0 +1,114 @@
+// Package codec encodes and decodes master keys in the formats
+// accepted by fidokit when importing and exporting them.
+package codec
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+// Format is the encoding of a master key.
+type Format string
+
+const (
+	Hex       Format = "hex"
+	Base64    Format = "base64"
+	Base64URL Format = "base64url"
+	// Raw is the key's bytes without any encoding.
+	Raw Format = "raw"
+	// Mnemonic is a BIP39 English word list, including its checksum.
+	Mnemonic Format = "bip39"
+	// QR is a QR code of the hex encoding, drawn for a terminal. It can only be used for output.
+	QR Format = "qr"
+)
+
+// Formats lists every supported format.
+var Formats = []Format{Hex, Base64, Base64URL, Raw, Mnemonic, QR}
+
+// ErrUnknownFormat is returned for a format which is not supported.
+var ErrUnknownFormat = errors.New("unknown format")
+
+// ErrOutputOnly is returned when decoding a format which can only be used for output.
+var ErrOutputOnly = errors.New("format can only be used for output")
+
+// ParseFormat returns the format with the name.
+func ParseFormat(name string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == strings.ToLower(name) {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownFormat, name)
+}
+
+// Names returns the names of the formats, for use in help text.
+func Names(formats []Format) string {
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = string(f)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Text reports whether the format is printable text.
+func (f Format) Text() bool {
+	return f != Raw
+}
+
+// Encode encodes the key in the format. Text formats do not include a trailing newline.
+// BIP39 mnemonics can only encode keys of 16, 20, 24, 28 or 32 bytes.
+func Encode(f Format, key []byte) ([]byte, error) {
+	switch f {
+	case Hex:
+		return []byte(hex.EncodeToString(key)), nil
+	case Base64:
+		return []byte(base64.StdEncoding.EncodeToString(key)), nil
+	case Base64URL:
+		return []byte(base64.RawURLEncoding.EncodeToString(key)), nil
+	case Raw:
+		return key, nil
+	case Mnemonic:
+		mnemonic, err := bip39.NewMnemonic(key)
+		if err != nil {
+			return nil, fmt.Errorf("encode bip39 mnemonic of %d bytes: %w", len(key), err)
+		}
+		return []byte(mnemonic), nil
+	case QR:
+		code, err := renderQR(hex.EncodeToString(key))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(code), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, f)
+}
+
+// Decode decodes a key encoded in the format. Whitespace around text formats is ignored,
+// and base64 is accepted with or without padding.
+func Decode(f Format, data []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(data))
+	switch f {
+	case Hex:
+		return hex.DecodeString(text)
+	case Base64:
+		return base64.StdEncoding.WithPadding(base64.NoPadding).DecodeString(strings.TrimRight(text, "="))
+	case Base64URL:
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(text, "="))
+	case Raw:
+		return data, nil
+	case Mnemonic:
+		key, err := bip39.EntropyFromMnemonic(strings.Join(strings.Fields(strings.ToLower(text)), " "))
+		if err != nil {
+			return nil, fmt.Errorf("decode bip39 mnemonic: %w", err)
+		}
+		return key, nil
+	case QR:
+		return nil, fmt.Errorf("%w: %s", ErrOutputOnly, f)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, f)
+}
@@ -0,0 +1,122 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Auto detects the format of a key when decoding it. See Detect.
+const Auto Format = "auto"
+
+// MinKeySize and MaxKeySize are the lengths of master keys which can be imported, in bytes.
+// The maximum allows common keyfiles, such as the 4 KiB keyfiles used with LUKS.
+const (
+	MinKeySize = 16
+	MaxKeySize = 4096
+)
+
+// ErrKeyLength is returned when importing a key which is too short or too long.
+var ErrKeyLength = fmt.Errorf("master key must be between %d and %d bytes", MinKeySize, MaxKeySize)
+
+// ErrWeakKey is returned when importing a key which is obviously not random.
+var ErrWeakKey = errors.New("master key is not random")
+
+var (
+	hexPattern       = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+	base64Pattern    = regexp.MustCompile(`^[A-Za-z0-9+/]+=*$`)
+	base64URLPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+=*$`)
+)
+
+// Detect guesses the format of an encoded key. Text made of several words is
+// a BIP39 mnemonic, and other text is hex if it can be, then base64, then
+// base64url. Anything else is raw.
+func Detect(data []byte) Format {
+	text := strings.TrimSpace(string(data))
+	if text == "" || !utf8.ValidString(text) {
+		return Raw
+	}
+	switch {
+	case len(strings.Fields(text)) >= 12:
+		return Mnemonic
+	case hexPattern.MatchString(text) && len(text)%2 == 0:
+		return Hex
+	case base64Pattern.MatchString(text):
+		return Base64
+	case base64URLPattern.MatchString(text):
+		return Base64URL
+	}
+	return Raw
+}
+
+// DecodeKey decodes a master key in the format, which may be Auto,
+// then checks it using CheckKey.
+func DecodeKey(f Format, data []byte) ([]byte, error) {
+	if f == Auto {
+		f = Detect(data)
+	}
+	key, err := Decode(f, data)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s master key: %w", f, err)
+	}
+	err = CheckKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// CheckKey checks that a master key to be imported has a supported length, and
+// rejects keys which are obviously weak: keys of fewer than a quarter distinct
+// bytes (up to 16), keys made of a repeating pattern of up to 4 bytes, such as
+// all zeros, and keys whose bytes count up or down by a constant step.
+func CheckKey(key []byte) error {
+	if len(key) < MinKeySize || len(key) > MaxKeySize {
+		return fmt.Errorf("%w: got %d bytes", ErrKeyLength, len(key))
+	}
+
+	var seen [256]bool
+	distinct := 0
+	for _, b := range key {
+		if !seen[b] {
+			seen[b] = true
+			distinct++
+		}
+	}
+	if distinct < min(len(key)/4, 16) {
+		return fmt.Errorf("%w: it has only %d distinct bytes", ErrWeakKey, distinct)
+	}
+
+	for period := 1; period <= 4; period++ {
+		if bytes.Equal(key[period:], key[:len(key)-period]) {
+			return fmt.Errorf("%w: it repeats every %d bytes", ErrWeakKey, period)
+		}
+	}
+
+	step := key[1] - key[0]
+	for i := 2; i < len(key); i++ {
+		if key[i]-key[i-1] != step {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: its bytes count by a constant step", ErrWeakKey)
+}
+
+// InputFormats lists the formats which keys can be imported from.
+var InputFormats = []Format{Auto, Hex, Base64, Base64URL, Raw, Mnemonic}
+
+// ParseInputFormat returns the format with the name for importing keys.
+func ParseInputFormat(name string) (Format, error) {
+	if slices.Contains(InputFormats, Format(strings.ToLower(name))) {
+		return Format(strings.ToLower(name)), nil
+	}
+	f, err := ParseFormat(name)
+	if err == nil {
+		return "", fmt.Errorf("%w: %s", ErrOutputOnly, f)
+	}
+	return "", err
+}
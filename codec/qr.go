@@ -0,0 +1,42 @@
+package codec
+
+import (
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the number of light modules around the code, which scanners need to find it.
+const qrQuietZone = 4
+
+// renderQR draws a QR code of the text using half block characters, so that
+// each line of text holds two rows of modules. Dark modules are drawn filled
+// and light modules are left blank.
+func renderQR(text string) (string, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	start, end := -qrQuietZone, code.Size+qrQuietZone
+	for y := start; y < end; y += 2 {
+		for x := start; x < end; x++ {
+			top, bottom := code.Black(x, y), code.Black(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		if y+2 < end {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,1833 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"fidokit/agent"
+	"fidokit/codec"
+	"fidokit/crypto"
+	"fidokit/fidoutils"
+	"fidokit/fkvault"
+	"fidokit/prompt"
+	"fidokit/slip39"
+	"fidokit/sshagent"
+	"fidokit/utils"
+)
+
+// command is a subcommand of the program, such as `fidokit init`.
+type command struct {
+	// name is the name used to run the command.
+	name string
+	// usage describes the arguments of the command.
+	usage string
+	// summary is a one-line description of the command.
+	summary string
+	// usesKeys indicates whether the command interacts with security keys.
+	usesKeys bool
+	// stdout indicates whether prompts should be written to stdout instead of stderr.
+	stdout bool
+	// flags registers the command's own flags, if it has any.
+	flags func(fs *pflag.FlagSet)
+	// run runs the command with the remaining positional arguments.
+	run func(args []string) error
+}
+
+var commands []*command
+
+func init() {
+	// assigned in init to allow `help` to refer to the list of commands
+	commands = []*command{
+		{name: "init", usage: "init [flags]", summary: "create a new vault and enroll its keys", usesKeys: true, flags: initFlags, run: runInit},
+		{name: "add", usage: "add [flags]", summary: "enroll a new key into the vault", usesKeys: true, flags: addFlags, run: runAdd},
+		{name: "remove", usage: "remove <name>", summary: "remove a key from a simple vault", usesKeys: true, run: runRemove},
+		{name: "reshare", usage: "reshare [flags]", summary: "replace every share of a shamir vault, optionally changing k and n", usesKeys: true, flags: reshareFlags, run: runReshare},
+		{name: "upgrade-kdf", usage: "upgrade-kdf [flags]", summary: "re-encrypt the password layer using new kdf parameters", usesKeys: true, flags: upgradeKDFFlags, run: runUpgradeKDF},
+		{name: "migrate", usage: "migrate [flags]", summary: "upgrade the vault to the latest format version", usesKeys: true, flags: migrateFlags, run: runMigrate},
+		{name: "recover-from-key", usage: "recover-from-key [flags]", summary: "rebuild a simple vault from the resident credentials on a key", usesKeys: true, flags: recoverFlags, run: runRecoverFromKey},
+		{name: "unlock", usage: "unlock [flags]", summary: "unlock the vault and output the master key", usesKeys: true, flags: unlockFlags, run: runUnlock},
+		{name: "secret", usage: "secret set|get|list|rm [name] [flags]", summary: "manage the secrets stored in the vault", usesKeys: true, flags: secretFlags, run: runSecret},
+		{name: "encrypt", usage: "encrypt <in> <out> [flags]", summary: "encrypt a file using a key derived from the master key", usesKeys: true, flags: fileFlags, run: runEncrypt},
+		{name: "decrypt", usage: "decrypt <in> <out> [flags]", summary: "decrypt a file encrypted with encrypt", usesKeys: true, flags: fileFlags, run: runDecrypt},
+		{name: "ssh-agent", usage: "ssh-agent [flags]", summary: "serve ssh keys derived from the master key until interrupted", usesKeys: true, flags: sshAgentFlags, run: runSSHAgent},
+		{name: "agent", usage: "agent [flags]", summary: "cache master keys unlocked by get until interrupted", flags: agentFlags, run: runAgent},
+		{name: "get", usage: "get [flags]", summary: "output the master key from the agent, unlocking the vault if it is not cached", usesKeys: true, flags: getFlags, run: runGet},
+		{name: "lock", usage: "lock [flags]", summary: "make the agent forget the master key of the vault", flags: agentSocketFlag, run: runLock},
+		{name: "lock-all", usage: "lock-all [flags]", summary: "make the agent forget every master key", flags: agentSocketFlag, run: runLockAll},
+		{name: "ssh-pubkey", usage: "ssh-pubkey <label>", summary: "print the public ssh key derived for a label", usesKeys: true, run: runSSHPubkey},
+		{name: "derive", usage: "derive --context <label> [flags]", summary: "derive an independent secret for an application from the master key", usesKeys: true, flags: deriveFlags, run: runDerive},
+		{name: "slip39", usage: "slip39 [flags]", summary: "export the master key as SLIP-39 mnemonic shares for paper backups", usesKeys: true, flags: slip39Flags, run: runSLIP39},
+		{name: "info", usage: "info", summary: "print information about the vault", run: runInfo},
+		{name: "verify", usage: "verify", summary: "check the integrity of the vault", run: runVerify},
+		{name: "list", usage: "list [flags]", summary: "list the keys enrolled in the vault", flags: listFlags, run: runList},
+		{name: "plan", usage: "plan", summary: "list the ways to unlock a policy vault using the connected keys", usesKeys: true, run: runPlan},
+		{name: "shell", usage: "shell [flags]", summary: "manage the vault using the interactive menu", usesKeys: true, stdout: true, flags: shellFlags, run: runShell},
+		{name: "help", usage: "help [command]", summary: "print help for a command", run: runHelp},
+	}
+}
+
+// usageError is returned by commands which were used incorrectly.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usageErrorf(format string, args ...any) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// invalidError is returned by commands which found that the vault failed integrity verification.
+type invalidError struct {
+	err error
+}
+
+func (e *invalidError) Error() string {
+	return "vault is invalid: " + e.err.Error()
+}
+
+func (e *invalidError) Unwrap() error {
+	return e.err
+}
+
+// run runs the command named by the first argument, returning the exit code.
+// When no command is named, the interactive shell is run for compatibility.
+func run(args []string) int {
+	cmd := findCommand("shell")
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd = findCommand(args[0])
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", args[0])
+			printUsage()
+			return exitUsage
+		}
+		args = args[1:]
+	}
+
+	fs := newFlagSet(cmd)
+	err := fs.Parse(args)
+	if errors.Is(err, pflag.ErrHelp) {
+		return exitOK
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	out := os.Stderr
+	if cmd.stdout {
+		out = os.Stdout
+	}
+	setup(out, cmd.usesKeys)
+
+	err = cmd.run(fs.Args())
+	var usageErr *usageError
+	if errors.As(err, &usageErr) {
+		fmt.Fprintf(os.Stderr, "%s\n\nusage: fidokit %s\n", err, cmd.usage)
+		return exitUsage
+	}
+	var invalidErr *invalidError
+	if errors.As(err, &invalidErr) {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmd.name, err)
+		return exitInvalid
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmd.name, err)
+		if errors.Is(err, fkvault.ErrUnverified) {
+			fmt.Fprintln(os.Stderr, "Run `fidokit migrate` to check the vault and upgrade it.")
+		}
+		return exitError
+	}
+	return exitOK
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func newFlagSet(cmd *command) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(cmd.name, pflag.ContinueOnError)
+	fs.SortFlags = false
+	globalFlags(fs)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n\nusage: fidokit %s\n\nflags:\n%s", cmd.summary, cmd.usage, fs.FlagUsages())
+	}
+	return fs
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: fidokit <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	var width int
+	for _, cmd := range commands {
+		width = max(width, len(cmd.name))
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-*s %s\n", width, cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run `fidokit help <command>` for more information on a command.")
+	fmt.Fprintln(os.Stderr, "If no command is given, the interactive shell is started.")
+}
+
+func runHelp(args []string) error {
+	if len(args) == 0 {
+		printUsage()
+		return nil
+	}
+	if len(args) > 1 {
+		return usageErrorf("too many arguments")
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		return usageErrorf("unknown command: %s", args[0])
+	}
+	newFlagSet(cmd).Usage()
+	return nil
+}
+
+var initType, initName, initDescription, initPolicy string
+var initK, initN uint8
+var initEncrypt bool
+var initKeyNames, initKinds []string
+var initRPID, initRPName, initUser string
+var initResident bool
+
+func initFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&initType, "type", "t", "simple", "The vault type (simple, shamir, policy)")
+	fs.StringVar(&initName, "name", "", "A descriptive name for the vault")
+	fs.StringVar(&initDescription, "description", "", "Additional information about the vault")
+	fs.Uint8VarP(&initK, "k", "k", 0, "The number of keys required to unlock a shamir vault")
+	fs.Uint8VarP(&initN, "n", "n", 0, "The total number of keys enrolled in a shamir vault")
+	fs.BoolVar(&initEncrypt, "encrypt", false, "Encrypt the master key with a password in addition to the keys")
+	fs.StringVar(&initPolicy, "policy", "", "The policy of a policy vault, such as \"and(key:admin, 2of(key:op1, key:op2, key:op3))\"")
+	fs.StringArrayVar(&initKeyNames, "key-name", nil, "The name of a key to enroll, in the order they are enrolled (repeatable)")
+	fs.StringArrayVar(&initKinds, "kind", nil, "The kind of each share of a shamir vault, in the order they are enrolled: fido2, passphrase or paper (repeatable; default fido2)")
+	fs.StringVar(&initRPID, "rp-id", fidoutils.RelyingParty.ID, "The relying party ID of the credentials, a domain name")
+	fs.StringVar(&initRPName, "rp-name", "", fmt.Sprintf("The relying party name shown by credential management tools (default %q)", fidoutils.RelyingParty.Name))
+	fs.StringVar(&initUser, "user", "", fmt.Sprintf("The user name given to the credentials (default %q)", fidoutils.User.Name))
+	inputFlags(fs)
+	fs.BoolVar(&initResident, "resident", false, "Create resident credentials, from which each key can recover the vault without the vault file (simple vaults only)")
+	kdfFlags(fs)
+}
+
+var kdfTime, kdfMemory uint32
+var kdfThreads uint8
+var kdfTarget time.Duration
+
+// kdfFlagSet is the flag set which the kdf flags were registered on, to tell whether they were used.
+var kdfFlagSet *pflag.FlagSet
+
+// kdfFlags registers the flags for choosing the password kdf parameters.
+func kdfFlags(fs *pflag.FlagSet) {
+	kdfFlagSet = fs
+	fs.Uint32Var(&kdfTime, "kdf-time", 0, fmt.Sprintf("The number of argon2id passes used to derive the key from the password (default %d)", crypto.DefaultKDFParams.Time))
+	fs.Uint32Var(&kdfMemory, "kdf-memory", crypto.DefaultKDFParams.Memory/1024, "The memory used by argon2id to derive the key from the password, in MiB")
+	fs.Uint8Var(&kdfThreads, "kdf-threads", crypto.DefaultKDFParams.Threads, "The number of threads used by argon2id to derive the key from the password")
+	fs.DurationVar(&kdfTarget, "kdf-target", 0, "Choose the number of argon2id passes such that deriving the key takes this long on this machine, such as 2s")
+}
+
+// kdfFlagsUsed returns whether any of the kdf flags were given.
+func kdfFlagsUsed() bool {
+	for _, name := range []string{"kdf-time", "kdf-memory", "kdf-threads", "kdf-target"} {
+		if kdfFlagSet != nil && kdfFlagSet.Changed(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// kdfParams returns the password kdf parameters chosen using the kdf flags.
+func kdfParams() (crypto.KDFParams, error) {
+	if kdfTime != 0 && kdfTarget != 0 {
+		return crypto.KDFParams{}, usageErrorf("--kdf-time and --kdf-target cannot be used together")
+	}
+	if kdfTarget < 0 {
+		return crypto.KDFParams{}, usageErrorf("--kdf-target must not be negative")
+	}
+	if kdfMemory > crypto.MaxKDFMemory/1024 {
+		return crypto.KDFParams{}, usageErrorf("--kdf-memory must be at most %d MiB", crypto.MaxKDFMemory/1024)
+	}
+
+	var params crypto.KDFParams
+	var err error
+	if kdfTarget != 0 {
+		prompter.Notify(fmt.Sprintf("Calibrating the password kdf to take %s...", kdfTarget))
+		params, err = crypto.CalibrateKDF(kdfTarget, kdfMemory*1024, kdfThreads)
+	} else {
+		params = crypto.KDFParams{
+			Algorithm: crypto.KDFArgon2id,
+			Time:      cmp.Or(kdfTime, crypto.DefaultKDFParams.Time),
+			Memory:    kdfMemory * 1024,
+			Threads:   kdfThreads,
+		}
+		err = params.Validate()
+	}
+	if err != nil {
+		return crypto.KDFParams{}, usageErrorf("%s", err)
+	}
+	return params, nil
+}
+
+// runInit creates a new vault with a random master key, then enrolls keys into it.
+func runInit(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	_, err := os.Stat(vaultPath)
+	if err == nil {
+		return fmt.Errorf("vault file already exists: %s", vaultPath)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("stat vault: %w", err)
+	}
+
+	if !initEncrypt && kdfFlagsUsed() {
+		return usageErrorf("the --kdf flags can only be used with --encrypt")
+	}
+
+	var kdf *crypto.KDFParams
+	if initEncrypt {
+		params, err := kdfParams()
+		if err != nil {
+			return err
+		}
+		kdf = &params
+	}
+
+	opts := fkvault.Options{
+		KDF:         kdf,
+		Type:        fkvault.Type(initType),
+		Name:        initName,
+		Description: initDescription,
+		K:           initK,
+		N:           initN,
+		Encrypted:   initEncrypt,
+		RPID:        initRPID,
+		RPName:      initRPName,
+		User:        initUser,
+		Resident:    initResident,
+	}
+	err = fidoutils.ValidateRPID(opts.RPID)
+	if err != nil {
+		return usageErrorf("%s", err)
+	}
+	if opts.Type != fkvault.TypePolicy && initPolicy != "" {
+		return usageErrorf("--policy may only be used with policy vaults")
+	}
+	switch opts.Type {
+	case fkvault.TypeSimple:
+		if initK != 0 || initN != 0 || len(initKinds) > 0 {
+			return usageErrorf("--k, --n and --kind may only be used with shamir vaults")
+		}
+		if initResident && initEncrypt {
+			return usageErrorf("--resident cannot be used with --encrypt")
+		}
+	case fkvault.TypeShamir:
+		if initResident {
+			return usageErrorf("--resident may only be used with simple vaults")
+		}
+		if initK < 2 || initN < initK {
+			return usageErrorf("shamir vaults require 2 <= k <= n: --k %d --n %d", initK, initN)
+		}
+		if len(initKeyNames) > int(initN) {
+			return usageErrorf("more key names given than n")
+		}
+		if len(initKinds) > int(initN) {
+			return usageErrorf("more share kinds given than n")
+		}
+	case fkvault.TypePolicy:
+		if initK != 0 || initN != 0 || len(initKinds) > 0 || len(initKeyNames) > 0 {
+			return usageErrorf("--k, --n, --kind and --key-name cannot be used with policy vaults, whose keys are named by --policy")
+		}
+		if initResident || initEncrypt {
+			return usageErrorf("--resident and --encrypt cannot be used with policy vaults")
+		}
+		if initPolicy == "" {
+			return usageErrorf("policy vaults require --policy")
+		}
+		opts.Policy, err = fkvault.ParsePolicy(initPolicy)
+		if err != nil {
+			return usageErrorf("%s", err)
+		}
+	default:
+		return usageErrorf("unknown vault type: %s", initType)
+	}
+
+	kinds, err := parseShareKinds(initKinds)
+	if err != nil {
+		return err
+	}
+	err = setupInput()
+	if err != nil {
+		return err
+	}
+	masterKey := utils.RandomBytes(32)
+	if fkvault.KeySource != nil {
+		masterKey, err = fkvault.KeySource()
+		if err != nil {
+			return fmt.Errorf("import master key: %w", err)
+		}
+	}
+	if initResident && len(masterKey) != 32 {
+		return fmt.Errorf("--resident requires a 32-byte master key, but the imported key is %d bytes", len(masterKey))
+	}
+
+	anyVault, err := fkvault.Create(opts)
+	if err != nil {
+		return fmt.Errorf("create vault: %w", err)
+	}
+
+	switch vault := anyVault.(type) {
+	case *fkvault.SimpleVault:
+		err = vault.InteractiveEnroll(masterKey, initKeyNames)
+	case *fkvault.ShamirVault:
+		err = vault.InteractiveEnroll(masterKey, initKeyNames, kinds)
+	case *fkvault.PolicyVault:
+		err = vault.InteractiveEnroll(masterKey)
+	}
+	if err != nil {
+		return fmt.Errorf("enroll: %w", err)
+	}
+
+	err = saveVault(vaultPath, anyVault)
+	if err != nil {
+		return fmt.Errorf("save vault: %w", err)
+	}
+	prompter.Notify("Vault created: " + vaultPath)
+	return nil
+}
+
+var addName, addKind string
+
+func addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&addName, "name", "", "The name of the key to enroll (prompted if omitted)")
+	fs.StringVar(&addKind, "kind", "fido2", "The kind of share to add to a shamir vault: fido2, passphrase or paper")
+}
+
+// runAdd unlocks the vault using enrolled keys, then enrolls a new key.
+// Shamir vaults are unlocked using K keys, and N is increased by one.
+func runAdd(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	kind, err := fkvault.ParseShareKind(addKind)
+	if err != nil {
+		return usageErrorf("%s", err)
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	switch vault := anyVault.(type) {
+	case *fkvault.SimpleVault:
+		if kind != fkvault.ShareFIDO2 {
+			return usageErrorf("--kind may only be used with shamir vaults")
+		}
+		err = vault.InteractiveAdd(addName)
+	case *fkvault.ShamirVault:
+		err = vault.InteractiveAddShare(addName, kind)
+	default:
+		return errors.New("keys cannot be added to policy vaults, since every key is named by the policy")
+	}
+	if err != nil {
+		return err
+	}
+
+	err = saveVault(vaultPath, anyVault)
+	if err != nil {
+		return fmt.Errorf("save vault: %w", err)
+	}
+	prompter.Notify("Key added.")
+	return nil
+}
+
+// runRemove removes the named key from a simple vault.
+func runRemove(args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("expected the name of one key")
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	vault, ok := anyVault.(*fkvault.SimpleVault)
+	if !ok {
+		return errors.New("keys can only be removed from simple vaults")
+	}
+
+	err := vault.InteractiveDelete(args[0])
+	if err != nil {
+		return fmt.Errorf("remove '%s': %w", args[0], err)
+	}
+
+	err = saveVault(vaultPath, vault)
+	if err != nil {
+		return fmt.Errorf("save vault: %w", err)
+	}
+	return nil
+}
+
+var reshareK, reshareN uint8
+var reshareKeyNames, reshareKinds []string
+
+func reshareFlags(fs *pflag.FlagSet) {
+	fs.Uint8VarP(&reshareK, "k", "k", 0, "The new number of keys required to unlock the vault (default: unchanged)")
+	fs.Uint8VarP(&reshareN, "n", "n", 0, "The new total number of keys enrolled in the vault (default: unchanged)")
+	fs.StringArrayVar(&reshareKeyNames, "key-name", nil, "The name of a key to enroll, in the order they are enrolled (repeatable)")
+	fs.StringArrayVar(&reshareKinds, "kind", nil, "The kind of each new share, in the order they are enrolled: fido2, passphrase or paper (repeatable; default fido2)")
+}
+
+// runReshare unlocks a shamir vault using K keys, then replaces every share
+// with a new set of shares for keys which are enrolled again.
+func runReshare(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	kinds, err := parseShareKinds(reshareKinds)
+	if err != nil {
+		return err
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	vault, ok := anyVault.(*fkvault.ShamirVault)
+	if !ok {
+		return errors.New("only shamir vaults can be reshared")
+	}
+
+	err = vault.InteractiveReshare(reshareK, reshareN, reshareKeyNames, kinds)
+	if errors.Is(err, fkvault.ErrInvalidThreshold) {
+		return usageErrorf("shamir vaults require 2 <= k <= n: %s", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = saveVault(vaultPath, vault)
+	if err != nil {
+		return fmt.Errorf("save vault: %w", err)
+	}
+	prompter.Notify(fmt.Sprintf("Vault reshared as %d of %d (generation %d).", vault.K, vault.N, vault.Generation))
+	return nil
+}
+
+// parseShareKinds parses the kinds of shares given using --kind.
+func parseShareKinds(names []string) ([]fkvault.ShareKind, error) {
+	kinds := make([]fkvault.ShareKind, len(names))
+	for i, name := range names {
+		var err error
+		kinds[i], err = fkvault.ParseShareKind(name)
+		if err != nil {
+			return nil, usageErrorf("%s", err)
+		}
+	}
+	return kinds, nil
+}
+
+func upgradeKDFFlags(fs *pflag.FlagSet) {
+	kdfFlags(fs)
+}
+
+// runUpgradeKDF unlocks an encrypted vault, then replaces its password layer
+// using the kdf parameters given by the flags.
+func runUpgradeKDF(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	params, err := kdfParams()
+	if err != nil {
+		return err
+	}
+
+	switch vault := anyVault.(type) {
+	case *fkvault.SimpleVault:
+		err = vault.InteractiveUpgradeKDF(params)
+	case *fkvault.ShamirVault:
+		err = vault.InteractiveUpgradeKDF(params)
+	default:
+		err = fkvault.ErrNotEncrypted
+	}
+	if err != nil {
+		return err
+	}
+
+	err = saveVault(vaultPath, anyVault)
+	if err != nil {
+		return fmt.Errorf("save vault: %w", err)
+	}
+	prompter.Notify("Password kdf upgraded to " + params.String() + ".")
+	return nil
+}
+
+var migrateDryRun bool
+
+func migrateFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&migrateDryRun, "dry-run", false, "Print the changes which would be made without unlocking or changing the vault")
+}
+
+// runMigrate upgrades the vault to the current version in place, after
+// unlocking it and keeping a copy of the original vault file.
+func runMigrate(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	data, err := os.ReadFile(vaultPath)
+	if err != nil {
+		return fmt.Errorf("read vault: %w", err)
+	}
+	version, changes, err := fkvault.PlanMigration(data)
+	if err != nil {
+		return fmt.Errorf("plan migration: %w", err)
+	}
+	if len(changes) == 0 {
+		fmt.Printf("Vault is already version %d.\n", version)
+		return nil
+	}
+
+	fmt.Printf("Migrating vault from version %d to %d:\n", version, fkvault.CurrentVaultVersion)
+	for _, change := range changes {
+		fmt.Println("  -", change)
+	}
+	if migrateDryRun {
+		fmt.Println("Dry run: the vault was not changed.")
+		return nil
+	}
+
+	anyVault, err := fkvault.ParseJSON(data)
+	if err != nil {
+		return fmt.Errorf("parse vault: %w", err)
+	}
+	verifyVault(anyVault)
+
+	// version 0 vaults have no MAC, so the user must vouch for their contents
+	upgrade := fkvault.Upgrade
+	if version == 0 {
+		err = confirmUnverified(anyVault)
+		if err != nil {
+			return err
+		}
+		upgrade = fkvault.UpgradeUnverified
+	}
+
+	masterKey, err := interactiveUnlock(anyVault)
+	if errors.Is(err, fkvault.ErrUnverified) && version == 0 {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d.bak", vaultPath, version)
+	err = utils.WriteFileAtomic(backupPath, data, 0)
+	if err != nil {
+		return fmt.Errorf("back up vault: %w", err)
+	}
+
+	_, err = upgrade(anyVault, masterKey)
+	if err != nil {
+		return fmt.Errorf("upgrade vault: %w", err)
+	}
+	err = saveVault(vaultPath, anyVault)
+	if err != nil {
+		return fmt.Errorf("save vault: %w", err)
+	}
+	fmt.Printf("Vault migrated to version %d. The original vault was saved to %s.\n", fkvault.CurrentVaultVersion, backupPath)
+	return nil
+}
+
+// confirmUnverified warns that a version 0 vault cannot be verified, shows its
+// contents, and asks the user to confirm that they are genuine before it is
+// migrated, which authenticates them.
+func confirmUnverified(anyVault any) error {
+	prompter.Notify("WARNING: this vault is version 0, which predates the vault MAC, so fidokit")
+	prompter.Notify("cannot tell whether it was changed outside fidokit, such as its threshold,")
+	prompter.Notify("relying party, key names or description. Migrating adds a MAC over the vault")
+	prompter.Notify("as it is now, so any such changes will be trusted from then on. Check that")
+	prompter.Notify("the information below is what you expect before continuing.")
+	prompter.Notify("")
+	printVaultInfo(anyVault, true)
+	err := printKeys(anyVault, false)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+
+	ok, err := prompter.Confirm("Trust the contents of this vault and migrate it?", false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("migration cancelled; the vault was not changed")
+	}
+	return nil
+}
+
+var recoverRPID, recoverID, recoverName string
+
+func recoverFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&recoverRPID, "rp-id", fidoutils.RelyingParty.ID, "The relying party ID of the vault's credentials")
+	fs.StringVar(&recoverID, "id", "", "The ID of the vault to recover, if the key holds several")
+	fs.StringVar(&recoverName, "name", "recovered", "The name of the key in the recovered vault")
+}
+
+// runRecoverFromKey rebuilds a simple vault created with --resident from the
+// resident credentials on one of its keys, saving it as a new vault file.
+func runRecoverFromKey(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	_, err := os.Stat(vaultPath)
+	if err == nil {
+		return fmt.Errorf("vault file already exists: %s", vaultPath)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("stat vault: %w", err)
+	}
+
+	vault, err := fkvault.InteractiveRecoverFromKey(recoverRPID, recoverID, recoverName)
+	if err != nil {
+		return fmt.Errorf("recover: %w", err)
+	}
+
+	err = saveVault(vaultPath, vault)
+	if err != nil {
+		return fmt.Errorf("save vault: %w", err)
+	}
+	prompter.Notify(fmt.Sprintf("Vault %s recovered: %s", vault.ID, vaultPath))
+	prompter.Notify("Only this key is enrolled in the recovered vault. Add the others again with `fidokit add`.")
+	return nil
+}
+
+func unlockFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&outputPath, "output", "o", "-", "The file path to write the master key to, or - to print it")
+	keyFormatFlag(fs)
+}
+
+// runUnlock unlocks the vault, then writes the master key to the output.
+func runUnlock(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+	if keyFormat != "" {
+		_, err := codec.ParseFormat(keyFormat)
+		if err != nil {
+			return usageErrorf("%s", err)
+		}
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	masterKey, err := interactiveUnlock(anyVault)
+	if err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+
+	err = upgradeVault(anyVault, masterKey, true)
+	if err != nil {
+		return err
+	}
+
+	return outputMasterKey(masterKey)
+}
+
+// outputMasterKey prints the master key, or writes it to the output file.
+func outputMasterKey(masterKey []byte) error {
+	if outputPath == "-" {
+		return printMasterKey(masterKey, false)
+	}
+	err := writeMasterKey(masterKey, outputPath)
+	if err != nil {
+		return fmt.Errorf("write master key to output file: %w", err)
+	}
+	return nil
+}
+
+// keyFormat is the name of the format used to import and export master keys.
+var keyFormat string
+
+func keyFormatFlag(fs *pflag.FlagSet) {
+	fs.StringVarP(&keyFormat, "format", "f", "", fmt.Sprintf("The format of master keys which are imported or exported (%s); by default, hex when printed and raw when written to a file", codec.Names(codec.Formats)))
+}
+
+// inputFormat is the name of the format of master keys imported using --input.
+var inputFormat string
+
+func inputFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&inputPath, "input", "i", "", "Import the master key when creating a vault from a file path, - for stdin, fd:N for an inherited file descriptor, or env:NAME for an environment variable")
+	fs.StringVar(&inputFormat, "input-format", string(codec.Auto), fmt.Sprintf("The format of the imported master key (%s), or slip39 for SLIP-39 shares, which are prompted for if --input is not given", codec.Names(codec.InputFormats)))
+}
+
+// setupInput checks --input-format, then makes new vaults import their
+// master key from --input, if it was given.
+func setupInput() error {
+	if strings.EqualFold(inputFormat, "slip39") {
+		fkvault.KeySource = importSLIP39
+		return nil
+	}
+
+	format, err := codec.ParseInputFormat(inputFormat)
+	if err != nil {
+		return usageErrorf("%s", err)
+	}
+	if inputPath == "" {
+		return nil
+	}
+
+	fkvault.KeySource = func() ([]byte, error) {
+		data, err := utils.ReadInput(inputPath)
+		if err != nil {
+			return nil, err
+		}
+		return codec.DecodeKey(format, data)
+	}
+	return nil
+}
+
+// importSLIP39 recovers a master key from SLIP-39 shares read from --input, one per line,
+// or entered one at a time if it was not given, and the passphrase used to create them.
+func importSLIP39() ([]byte, error) {
+	var mnemonics []string
+	if inputPath != "" {
+		data, err := utils.ReadInput(inputPath)
+		if err != nil {
+			return nil, err
+		}
+		for line := range strings.Lines(string(data)) {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				mnemonics = append(mnemonics, line)
+			}
+		}
+	} else {
+		for {
+			mnemonic, err := prompter.AskSecret(fmt.Sprintf("Enter SLIP-39 share %d, or leave blank once every share is entered: ", len(mnemonics)+1))
+			if err != nil {
+				return nil, err
+			}
+			if mnemonic == "" {
+				break
+			}
+			// check each share as it is entered, so that a typo can be corrected
+			_, err = slip39.ParseShare(mnemonic)
+			if err != nil {
+				prompter.Notify(err.Error() + ". Try again.")
+				continue
+			}
+			mnemonics = append(mnemonics, mnemonic)
+		}
+	}
+
+	shares, err := slip39.ParseShares(mnemonics)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := prompter.AskSecret("Enter the SLIP-39 passphrase, or leave blank if there is none: ")
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := slip39.Combine(shares, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	err = codec.CheckKey(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return masterKey, nil
+}
+
+// encodeMasterKey encodes the master key in the format chosen with --format, or def if none was chosen.
+func encodeMasterKey(masterKey []byte, def codec.Format) ([]byte, codec.Format, error) {
+	format := def
+	if keyFormat != "" {
+		var err error
+		format, err = codec.ParseFormat(keyFormat)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	encoded, err := codec.Encode(format, masterKey)
+	return encoded, format, err
+}
+
+// printMasterKey prints the master key in the chosen format, which is hex by default.
+// If label is set, the format is printed before the key.
+func printMasterKey(masterKey []byte, label bool) error {
+	encoded, format, err := encodeMasterKey(masterKey, codec.Hex)
+	if err != nil {
+		return err
+	}
+	if !format.Text() {
+		_, err = os.Stdout.Write(encoded)
+		return err
+	}
+
+	if label && format == codec.QR {
+		fmt.Printf("Master Key (%s):\n", format)
+	} else if label {
+		fmt.Printf("Master Key (%s): ", format)
+	}
+	fmt.Println(string(encoded))
+	return nil
+}
+
+// writeMasterKey writes the master key to the file in the chosen format, which is raw by default.
+func writeMasterKey(masterKey []byte, path string) error {
+	encoded, format, err := encodeMasterKey(masterKey, codec.Raw)
+	if err != nil {
+		return err
+	}
+	if format.Text() {
+		encoded = append(encoded, '\n')
+	}
+	return os.WriteFile(path, encoded, 0600)
+}
+
+// upgradeVault upgrades a vault created by an older version once it has been
+// unlocked. If save is not set, the user is reminded to save the vault instead.
+func upgradeVault(anyVault any, masterKey []byte, save bool) error {
+	upgraded, err := fkvault.Upgrade(anyVault, masterKey)
+	if err != nil {
+		return fmt.Errorf("upgrade vault: %w", err)
+	}
+	if !upgraded {
+		return nil
+	}
+
+	if !save {
+		prompter.Notify(fmt.Sprintf("Vault upgraded to version %d. Save the vault to keep the upgrade.", fkvault.CurrentVaultVersion))
+		return nil
+	}
+	err = saveVault(vaultPath, anyVault)
+	if err != nil {
+		return fmt.Errorf("save upgraded vault: %w", err)
+	}
+	prompter.Notify(fmt.Sprintf("Vault upgraded to version %d.", fkvault.CurrentVaultVersion))
+	return nil
+}
+
+// interactiveUnlock unlocks any type of vault interactively.
+func interactiveUnlock(anyVault any) ([]byte, error) {
+	switch vault := anyVault.(type) {
+	case *fkvault.SimpleVault:
+		return vault.InteractiveUnlock()
+	case *fkvault.ShamirVault:
+		return vault.InteractiveCombine()
+	case *fkvault.PolicyVault:
+		return vault.InteractiveUnlock()
+	}
+	return nil, fmt.Errorf("unknown vault type: %T", anyVault)
+}
+
+var secretFile string
+
+func secretFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&secretFile, "file", "f", "", "With set, read the value from the file, or - for stdin, instead of prompting for it")
+	fs.StringVarP(&outputPath, "output", "o", "-", "With get, the file path to write the value to, or - to print it")
+}
+
+// runSecret unlocks the vault, then reads or changes the secrets stored in it.
+func runSecret(args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("expected an action: set, get, list or rm")
+	}
+	action, args := args[0], args[1:]
+
+	var name string
+	switch action {
+	case "list":
+		if len(args) > 0 {
+			return usageErrorf("unexpected arguments: %v", args)
+		}
+	case "set", "get", "rm":
+		if len(args) != 1 {
+			return usageErrorf("expected a secret name")
+		}
+		name = args[0]
+	default:
+		return usageErrorf("unknown action: %s", action)
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	masterKey, err := interactiveUnlock(anyVault)
+	if err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+	err = upgradeVault(anyVault, masterKey, true)
+	if err != nil {
+		return err
+	}
+
+	secrets, err := fkvault.ReadSecrets(anyVault, masterKey)
+	if err != nil {
+		return fmt.Errorf("read secrets: %w", err)
+	}
+
+	switch action {
+	case "list":
+		for _, name := range slices.Sorted(maps.Keys(secrets)) {
+			fmt.Println(name)
+		}
+		return nil
+	case "get":
+		value, ok := secrets[name]
+		if !ok {
+			return fmt.Errorf("%w: '%s'", fkvault.ErrNoSecret, name)
+		}
+		if outputPath == "-" {
+			fmt.Println(string(value))
+			return nil
+		}
+		err = os.WriteFile(outputPath, value, 0600)
+		if err != nil {
+			return fmt.Errorf("write secret to output file: %w", err)
+		}
+		return nil
+	case "set":
+		secrets[name], err = readSecretValue()
+		if err != nil {
+			return err
+		}
+	case "rm":
+		if _, ok := secrets[name]; !ok {
+			return fmt.Errorf("%w: '%s'", fkvault.ErrNoSecret, name)
+		}
+		delete(secrets, name)
+	}
+
+	err = fkvault.WriteSecrets(anyVault, masterKey, secrets)
+	if err != nil {
+		return fmt.Errorf("write secrets: %w", err)
+	}
+	err = saveVault(vaultPath, anyVault)
+	if err != nil {
+		return fmt.Errorf("save vault: %w", err)
+	}
+	prompter.Notify("Secrets saved.")
+	return nil
+}
+
+// readSecretValue reads the value for secret set from --file, or prompts for it.
+func readSecretValue() ([]byte, error) {
+	switch secretFile {
+	case "":
+		value, err := prompt.AskNonEmptySecret(prompter, "Enter the secret value: ")
+		return []byte(value), err
+	case "-":
+		value, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("read secret from stdin: %w", err)
+		}
+		return value, nil
+	default:
+		value, err := os.ReadFile(secretFile)
+		if err != nil {
+			return nil, fmt.Errorf("read secret file: %w", err)
+		}
+		return value, nil
+	}
+}
+
+var fileForce bool
+
+func fileFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&fileForce, "force", false, "Replace the output file if it already exists")
+}
+
+// runEncrypt unlocks the vault, then encrypts the input file to the output file.
+func runEncrypt(args []string) error {
+	return transformFile(args, func(key []byte, in io.Reader, out io.Writer) error {
+		w, err := crypto.EncryptStream(key, out)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, in)
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// runDecrypt unlocks the vault, then decrypts the input file to the output file.
+func runDecrypt(args []string) error {
+	return transformFile(args, func(key []byte, in io.Reader, out io.Writer) error {
+		r, err := crypto.DecryptStream(key, in)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
+		return err
+	})
+}
+
+// transformFile unlocks the vault, then streams the input file through the transform
+// using the file encryption key. The output file only appears if the transform succeeds,
+// so that a truncated or modified file never produces partially decrypted output.
+func transformFile(args []string, transform func(key []byte, in io.Reader, out io.Writer) error) error {
+	if len(args) != 2 {
+		return usageErrorf("expected an input and an output file")
+	}
+	inPath, outPath := args[0], args[1]
+
+	_, err := os.Stat(outPath)
+	if err == nil && !fileForce {
+		return fmt.Errorf("output file already exists: %s", outPath)
+	} else if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("stat output file: %w", err)
+	}
+
+	in, err := os.Open(inPath)
+	if err != nil {
+		return fmt.Errorf("open input file: %w", err)
+	}
+	defer in.Close()
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	masterKey, err := interactiveUnlock(anyVault)
+	if err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+	err = upgradeVault(anyVault, masterKey, true)
+	if err != nil {
+		return err
+	}
+
+	out, err := utils.CreateAtomic(outPath)
+	if err != nil {
+		return fmt.Errorf("create output file: %w", err)
+	}
+	defer out.Abort()
+
+	err = transform(crypto.DeriveKey(masterKey, "file-encryption"), bufio.NewReaderSize(in, crypto.StreamChunkSize), out)
+	if err != nil {
+		return err
+	}
+	err = out.Commit()
+	if err != nil {
+		return fmt.Errorf("save output file: %w", err)
+	}
+	return nil
+}
+
+var sshSocket string
+var sshLabels []string
+
+func sshAgentFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&sshSocket, "socket", "s", "", "The path of the agent socket (default: a new temporary directory)")
+	fs.StringArrayVarP(&sshLabels, "key", "k", []string{"default"}, "The label of a key to serve (repeatable)")
+}
+
+// runSSHAgent unlocks the vault once, then serves the ssh keys derived for each
+// label on a unix socket until it is interrupted.
+func runSSHAgent(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+	for _, label := range sshLabels {
+		if label == "" {
+			return usageErrorf("%s", sshagent.ErrInvalidLabel)
+		}
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	masterKey, err := interactiveUnlock(anyVault)
+	if err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+	err = upgradeVault(anyVault, masterKey, true)
+	if err != nil {
+		return err
+	}
+
+	keyring, err := sshagent.New(masterKey, baseVault(anyVault).Name, sshLabels)
+	clear(masterKey)
+	if err != nil {
+		return err
+	}
+
+	socket := sshSocket
+	if socket == "" {
+		dir, err := os.MkdirTemp("", "fidokit-agent-")
+		if err != nil {
+			return fmt.Errorf("create socket directory: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		socket = filepath.Join(dir, "agent.sock")
+	}
+	ln, err := utils.ListenPrivate(socket)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	defer ln.Close()
+
+	// closing the listener removes the socket
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ln.Close()
+	}()
+
+	fmt.Printf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", socket)
+	prompter.Notify(fmt.Sprintf("Serving %d ssh keys (%s). Press Ctrl+C to stop.", len(sshLabels), strings.Join(sshLabels, ", ")))
+	return sshagent.Serve(ln, keyring)
+}
+
+var agentSocket string
+var agentIdle, agentLifetime time.Duration
+
+// agentSocketFlag registers the flag for the path of the agent socket.
+func agentSocketFlag(fs *pflag.FlagSet) {
+	fs.StringVarP(&agentSocket, "socket", "s", "", fmt.Sprintf("The path of the agent socket (default: $%s, or a path in the runtime directory)", agent.SocketEnv))
+}
+
+func agentFlags(fs *pflag.FlagSet) {
+	agentSocketFlag(fs)
+	fs.DurationVar(&agentIdle, "idle", 15*time.Minute, "Forget each master key once it has not been used for this long")
+	fs.DurationVar(&agentLifetime, "lifetime", 8*time.Hour, "Forget each master key this long after it was unlocked, even if it is in use")
+}
+
+// runAgent holds the master keys unlocked by get in locked memory, and serves
+// them to processes run by the same user on a unix socket until it is interrupted.
+func runAgent(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+	if agentIdle <= 0 || agentLifetime <= 0 {
+		return usageErrorf("--idle and --lifetime must be positive")
+	}
+
+	socket := cmp.Or(agentSocket, agent.DefaultSocket())
+	err := agent.PrepareSocketDir(socket)
+	if err != nil {
+		return err
+	}
+	// a socket left behind by an agent which did not exit cleanly is replaced
+	client := &agent.Client{Socket: socket}
+	if _, err := client.List(); err == nil {
+		return fmt.Errorf("an agent is already running on %s", socket)
+	}
+	err = os.Remove(socket)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+
+	ln, err := utils.ListenPrivate(socket)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	defer ln.Close()
+
+	// closing the listener removes the socket, and the agent forgets every key
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ln.Close()
+	}()
+
+	fmt.Printf("%s=%s; export %[1]s;\n", agent.SocketEnv, socket)
+	prompter.Notify(fmt.Sprintf("Caching master keys until they are unused for %s, or for at most %s. Press Ctrl+C to stop.", agentIdle, agentLifetime))
+	return agent.New(agentIdle, agentLifetime).Serve(ln)
+}
+
+var getIdle, getLifetime time.Duration
+
+func getFlags(fs *pflag.FlagSet) {
+	agentSocketFlag(fs)
+	fs.DurationVar(&getIdle, "idle", 0, "Forget the master key once it has not been used for this long, if sooner than the agent would")
+	fs.DurationVar(&getLifetime, "lifetime", 0, "Forget the master key this long after it was unlocked, if sooner than the agent would")
+	fs.StringVarP(&outputPath, "output", "o", "-", "The file path to write the master key to, or - to print it")
+	keyFormatFlag(fs)
+}
+
+// runGet outputs the master key held by the agent for the vault. If the agent
+// does not hold it, the vault is unlocked, and the agent is given the key.
+func runGet(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+	if keyFormat != "" {
+		_, err := codec.ParseFormat(keyFormat)
+		if err != nil {
+			return usageErrorf("%s", err)
+		}
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+	base := baseVault(anyVault)
+
+	// cached keys are bound to the vault by its MAC, so vaults without one could be
+	// given a key planted in the agent by another process
+	err := fkvault.CheckVerifiable(anyVault)
+	if err != nil {
+		return fmt.Errorf("the agent only holds the master keys of vaults which can be verified: %w", err)
+	}
+
+	client := &agent.Client{Socket: cmp.Or(agentSocket, agent.DefaultSocket())}
+	masterKey, err := client.Get(base.ID)
+	if err == nil {
+		// a key which does not match the vault MAC is forgotten, and the vault unlocked again
+		err = fkvault.Verify(anyVault, masterKey)
+		if err != nil {
+			clear(masterKey)
+			masterKey = nil
+			err = client.Lock(base.ID)
+		}
+	}
+
+	if masterKey == nil {
+		cache := err == nil || errors.Is(err, agent.ErrNotCached)
+		if !cache {
+			prompter.Notify(fmt.Sprintf("The master key will not be cached: %s.", err))
+		}
+
+		masterKey, err = interactiveUnlock(anyVault)
+		if err != nil {
+			return fmt.Errorf("unlock: %w", err)
+		}
+		err = upgradeVault(anyVault, masterKey, true)
+		if err != nil {
+			return err
+		}
+
+		if cache {
+			err = client.Add(base.ID, base.Name, masterKey, getIdle, getLifetime)
+			if err != nil {
+				prompter.Notify(fmt.Sprintf("The master key could not be cached: %s.", err))
+			}
+		}
+	}
+	defer clear(masterKey)
+
+	return outputMasterKey(masterKey)
+}
+
+// runLock makes the agent forget the master key of the vault.
+func runLock(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	client := &agent.Client{Socket: cmp.Or(agentSocket, agent.DefaultSocket())}
+	err := client.Lock(baseVault(anyVault).ID)
+	if errors.Is(err, agent.ErrNotCached) {
+		prompter.Notify("The vault was not unlocked.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	prompter.Notify("Vault locked.")
+	return nil
+}
+
+// runLockAll makes the agent forget every master key.
+func runLockAll(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	client := &agent.Client{Socket: cmp.Or(agentSocket, agent.DefaultSocket())}
+	n, err := client.LockAll()
+	if err != nil {
+		return err
+	}
+	prompter.Notify(fmt.Sprintf("Locked %d vaults.", n))
+	return nil
+}
+
+// runSSHPubkey unlocks the vault, then prints the public ssh key for the label.
+func runSSHPubkey(args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("expected a key label")
+	}
+	label := args[0]
+	if label == "" {
+		return usageErrorf("%s", sshagent.ErrInvalidLabel)
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	masterKey, err := interactiveUnlock(anyVault)
+	if err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+	err = upgradeVault(anyVault, masterKey, true)
+	if err != nil {
+		return err
+	}
+
+	pub, err := sshagent.PublicKey(masterKey, label, sshagent.Comment(baseVault(anyVault).Name, label))
+	if err != nil {
+		return err
+	}
+	fmt.Println(pub)
+	return nil
+}
+
+var deriveContext, deriveFormat string
+var deriveLength int
+var deriveRecord bool
+
+// deriveFormats are the codec formats derive can print, besides passphrase.
+var deriveFormats = []codec.Format{codec.Hex, codec.Base64, codec.Raw}
+
+func deriveFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&deriveContext, "context", "c", "", "The label of the application, such as restic or luks-home (required)")
+	fs.IntVarP(&deriveLength, "length", "l", 32, "The number of bytes to derive")
+	fs.StringVarP(&deriveFormat, "format", "f", "hex", "The output format (hex, base64, raw, passphrase)")
+	fs.BoolVar(&deriveRecord, "record", false, "Record the context, but not the output, in the vault")
+}
+
+// runDerive unlocks the vault, then prints the secret derived for the context.
+func runDerive(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+	if deriveContext == "" {
+		return usageErrorf("--context is required")
+	}
+	if deriveLength < 1 || deriveLength > crypto.MaxDeriveLength {
+		return usageErrorf("%s", crypto.ErrDeriveLength)
+	}
+	length := deriveLength
+	var format codec.Format
+	if deriveFormat == "passphrase" {
+		// enough words to hold the requested number of bytes
+		length = crypto.PassphraseBytes(crypto.PassphraseWords(deriveLength))
+		if length > crypto.MaxDeriveLength {
+			return usageErrorf("%s: a passphrase of %d bytes is rounded up to %d bytes of whole words", crypto.ErrDeriveLength, deriveLength, length)
+		}
+	} else {
+		var err error
+		format, err = codec.ParseFormat(deriveFormat)
+		if err != nil || !slices.Contains(deriveFormats, format) {
+			return usageErrorf("unknown format: %s", deriveFormat)
+		}
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	masterKey, err := interactiveUnlock(anyVault)
+	if err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+	err = upgradeVault(anyVault, masterKey, true)
+	if err != nil {
+		return err
+	}
+
+	if deriveRecord {
+		recorded, err := fkvault.RecordContext(anyVault, masterKey, deriveContext)
+		if err != nil {
+			return fmt.Errorf("record context: %w", err)
+		}
+		if recorded {
+			err = saveVault(vaultPath, anyVault)
+			if err != nil {
+				return fmt.Errorf("save vault: %w", err)
+			}
+		}
+	}
+
+	key, err := crypto.DeriveContext(masterKey, deriveContext, length)
+	if err != nil {
+		return err
+	}
+	if deriveFormat == "passphrase" {
+		fmt.Println(crypto.Passphrase(key))
+		return nil
+	}
+	encoded, err := codec.Encode(format, key)
+	if err != nil {
+		return err
+	}
+	if !format.Text() {
+		_, err = os.Stdout.Write(encoded)
+		return err
+	}
+	fmt.Println(string(encoded))
+	return nil
+}
+
+var slip39Groups []string
+var slip39GroupThreshold, slip39Exponent uint8
+var slip39Passphrase bool
+
+func slip39Flags(fs *pflag.FlagSet) {
+	fs.StringArrayVarP(&slip39Groups, "group", "g", []string{"2of3"}, "A group of shares as KofN, where K of its N shares recover the group (repeatable)")
+	fs.Uint8VarP(&slip39GroupThreshold, "group-threshold", "t", 1, "The number of groups needed to recover the master key")
+	fs.BoolVar(&slip39Passphrase, "passphrase", false, "Protect the shares with a passphrase, which is needed to recover the master key")
+	fs.Uint8Var(&slip39Exponent, "iteration-exponent", 1, "Use 10000 << E PBKDF2 iterations to protect the passphrase")
+	fs.StringVarP(&outputPath, "output", "o", "-", "The file path to write the shares to, or - to print them")
+}
+
+// runSLIP39 unlocks the vault, then splits the master key into SLIP-39 shares.
+func runSLIP39(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+	groups := make([]slip39.Group, len(slip39Groups))
+	for i, g := range slip39Groups {
+		_, err := fmt.Sscanf(g, "%dof%d", &groups[i].Threshold, &groups[i].Count)
+		if err != nil || fmt.Sprintf("%dof%d", groups[i].Threshold, groups[i].Count) != g {
+			return usageErrorf("invalid group '%s': expected KofN, such as 2of3", g)
+		}
+	}
+
+	var passphrase string
+	if slip39Passphrase {
+		var err error
+		passphrase, err = askNewPassphrase()
+		if err != nil {
+			return err
+		}
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+
+	masterKey, err := interactiveUnlock(anyVault)
+	if err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+	err = upgradeVault(anyVault, masterKey, true)
+	if err != nil {
+		return err
+	}
+
+	shares, err := slip39.Split(masterKey, passphrase, slip39Exponent, slip39GroupThreshold, groups)
+	if errors.Is(err, slip39.ErrInvalidParameters) {
+		return usageErrorf("%s", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	base := baseVault(anyVault)
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "# SLIP-39 shares of the master key of vault %s (%s)\n", base.Name, base.ID)
+	fmt.Fprintf(&buf, "# %d of %d groups are needed to recover it\n", slip39GroupThreshold, len(groups))
+	for i, group := range shares {
+		fmt.Fprintf(&buf, "\n# group %d: %d of %d shares\n", i+1, groups[i].Threshold, groups[i].Count)
+		for _, s := range group {
+			fmt.Fprintln(&buf, s.Mnemonic())
+		}
+	}
+
+	if outputPath == "-" {
+		fmt.Print(buf.String())
+		return nil
+	}
+	err = os.WriteFile(outputPath, []byte(buf.String()), 0600)
+	if err != nil {
+		return fmt.Errorf("write shares to output file: %w", err)
+	}
+	prompter.Notify("Shares written to " + outputPath + ". Copy them to paper, then delete the file.")
+	return nil
+}
+
+// askNewPassphrase asks twice for a new SLIP-39 passphrase, which must be printable ASCII.
+func askNewPassphrase() (string, error) {
+	for {
+		passphrase, err := prompt.AskNonEmptySecret(prompter, "Enter a passphrase for the shares: ")
+		if err != nil {
+			return "", err
+		}
+		if slip39.CheckPassphrase(passphrase) != nil {
+			prompter.Notify("The passphrase must only contain printable ASCII characters. Try again.")
+			continue
+		}
+		confirm, err := prompter.AskSecret("Confirm the passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if passphrase == confirm {
+			return passphrase, nil
+		}
+		prompter.Notify("The passphrases do not match. Try again.")
+	}
+}
+
+func runInfo(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+	printVaultInfo(anyVault, true)
+	return nil
+}
+
+// runVerify checks the integrity of the vault, returning an *invalidError if it is invalid.
+func runVerify(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	anyVault, err := loadVault(vaultPath)
+	if err != nil {
+		return err
+	}
+	err = checkVault(anyVault)
+	if err != nil {
+		return &invalidError{err: err}
+	}
+	fmt.Println("Vault is valid.")
+	return nil
+}
+
+var listVerbose bool
+
+func listFlags(fs *pflag.FlagSet) {
+	fs.BoolVarP(&listVerbose, "long", "l", false, "Include credential IDs and encrypted keys")
+}
+
+func runList(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	anyVault, err := loadVault(vaultPath)
+	if err != nil {
+		return err
+	}
+	verifyVault(anyVault)
+	return printKeys(anyVault, listVerbose)
+}
+
+// printKeys prints the headers of a simple vault, the shares of a shamir
+// vault, or the policy of a policy vault.
+func printKeys(anyVault any, verbose bool) error {
+	switch vault := anyVault.(type) {
+	case *fkvault.SimpleVault:
+		for _, name := range slices.Sorted(maps.Keys(vault.Headers)) {
+			printHeader(name, vault.Headers[name], verbose)
+		}
+	case *fkvault.ShamirVault:
+		for _, index := range slices.Sorted(maps.Keys(vault.Shares)) {
+			printHeader(fmt.Sprint(index), vault.Shares[index], verbose)
+		}
+	case *fkvault.PolicyVault:
+		if vault.Policy == nil {
+			return &invalidError{err: errors.New("policy is missing")}
+		}
+		printPolicy(vault.Policy, "", verbose)
+	default:
+		return &invalidError{err: fmt.Errorf("unknown vault type: %T", anyVault)}
+	}
+	return nil
+}
+
+// printHeader prints a header identified by its key in the vault,
+// along with its kind if it is not a FIDO2 share.
+func printHeader(key string, h *fkvault.VaultHeader, verbose bool) {
+	var kind string
+	if h.Kind != fkvault.ShareFIDO2 {
+		kind = fmt.Sprintf(" (%s)", h.Kind)
+	}
+	if key == h.Name {
+		fmt.Println(key + kind)
+	} else {
+		fmt.Printf("%s: %s%s\n", key, h.Name, kind)
+	}
+	if verbose {
+		printHeaderFields("\t", h)
+	}
+}
+
+// printHeaderFields prints the fields of a header which protect its key, each after the indent.
+func printHeaderFields(indent string, h *fkvault.VaultHeader) {
+	switch h.Kind {
+	case fkvault.SharePassphrase:
+		fmt.Printf("%sencrypted_key=%x\n", indent, h.EncryptedKey)
+		fmt.Printf("%ssalt=%x\n", indent, h.Salt)
+		fmt.Printf("%skdf=%s\n", indent, h.KDF)
+	case fkvault.SharePaper:
+		fmt.Printf("%sdigest=%x\n", indent, h.Digest)
+	default:
+		fmt.Printf("%scredential_id=%x\n", indent, h.CredentialID)
+		fmt.Printf("%sencrypted_key=%x\n", indent, h.EncryptedKey)
+	}
+}
+
+// printPolicy prints a policy as a tree, indenting each child beneath its parent.
+func printPolicy(node *fkvault.PolicyNode, indent string, verbose bool) {
+	if node.Leaf() {
+		fmt.Printf("%s%s: %s\n", indent, node.Type, node.Name)
+		if verbose && node.Header != nil {
+			printHeaderFields(indent+"    ", node.Header)
+		}
+		return
+	}
+
+	switch node.Type {
+	case fkvault.NodeThreshold:
+		fmt.Printf("%s%d of %d:\n", indent, node.K, len(node.Children))
+	default:
+		fmt.Printf("%s%s:\n", indent, node.Type)
+	}
+	for _, child := range node.Children {
+		printPolicy(child, indent+"  ", verbose)
+	}
+}
+
+// runPlan lists the ways to unlock a policy vault, given the keys which are connected.
+func runPlan(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+
+	anyVault := mustLoadVault(vaultPath)
+	verifyVault(anyVault)
+	vault, ok := anyVault.(*fkvault.PolicyVault)
+	if !ok {
+		return errors.New("only policy vaults have plans")
+	}
+	return printPlans(vault)
+}
+
+// printPlans prints the ways to unlock a policy vault, and the keys each needs.
+func printPlans(vault *fkvault.PolicyVault) error {
+	if !vault.Initialized() {
+		return fkvault.ErrNotInitialized
+	}
+
+	devs, err := fidoutils.ConnectedDevices()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Policy:", vault.Policy)
+	fmt.Println()
+	for _, plan := range vault.Plans(devs) {
+		if plan.Ready() {
+			fmt.Printf("ready: %s\n", plan)
+		} else {
+			fmt.Printf("needs %s: %s\n", strings.Join(plan.Missing, ", "), plan)
+		}
+	}
+	return nil
+}
+
+// baseVault returns the fields shared by every type of vault.
+func baseVault(anyVault any) *fkvault.BaseVault {
+	switch vault := anyVault.(type) {
+	case *fkvault.SimpleVault:
+		return vault.BaseVault
+	case *fkvault.ShamirVault:
+		return vault.BaseVault
+	case *fkvault.PolicyVault:
+		return vault.BaseVault
+	}
+	return nil
+}
+
+// printVaultInfo prints information about any type of vault.
+func printVaultInfo(anyVault any, advanced bool) {
+	base := baseVault(anyVault)
+
+	fmt.Println("Vault Info:")
+	fmt.Println("  Type:   ", base.Type)
+	fmt.Println("  Name:   ", base.Name)
+	fmt.Println("  Desc:   ", base.Description)
+	switch vault := anyVault.(type) {
+	case *fkvault.SimpleVault:
+		fmt.Println("  Keys:   ", len(vault.Headers))
+	case *fkvault.ShamirVault:
+		ready := "NO"
+		if len(vault.Shares) == int(vault.N) {
+			ready = "YES"
+		}
+		fmt.Println("  K/N:    ", vault.K, "/", vault.N)
+		fmt.Println("  Gen:    ", vault.Generation)
+		fmt.Println("  Ready:  ", ready)
+	case *fkvault.PolicyVault:
+		ready := "NO"
+		if vault.Initialized() {
+			ready = "YES"
+		}
+		if vault.Policy != nil {
+			fmt.Println("  Policy: ", vault.Policy)
+		}
+		fmt.Println("  Ready:  ", ready)
+	}
+	fmt.Println("  Created:", base.Metadata.Created)
+	fmt.Println("  Updated:", base.Metadata.Modified)
+	fmt.Println()
+
+	if advanced {
+		fmt.Println("Advanced Vault Info:")
+		fmt.Println("  ID:  ", base.ID)
+		fmt.Println("  Type:", base.Type)
+		fmt.Println("  Ver: ", base.Version)
+		fmt.Println("  RPID:", base.RPID)
+		if base.RPName != "" {
+			fmt.Println("  RP:  ", base.RPName)
+		}
+		if base.User != "" {
+			fmt.Println("  User:", base.User)
+		}
+		if base.Resident {
+			fmt.Println("  Resident: yes")
+		}
+		fmt.Println("  CDH: ", base.ClientDataHashText)
+		fmt.Println("  Salt:", base.AssertionSaltText)
+		if base.Encrypted && base.KDF == nil {
+			fmt.Println("  KDF: ", crypto.DefaultKDFParams, "(default)")
+		} else if base.Encrypted {
+			fmt.Println("  KDF: ", base.KDF)
+		}
+		if len(base.Contexts) > 0 {
+			fmt.Println("  Contexts:", strings.Join(base.Contexts, ", "))
+		}
+		fmt.Println()
+	}
+}
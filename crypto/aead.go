@@ -6,18 +6,21 @@ import (
 	"fmt"
 )
 
-func EncryptChaCha20(aead cipher.AEAD, data []byte) ([]byte, error) {
+// EncryptChaCha20 seals the data with a random nonce, which is prepended to the
+// ciphertext. The associated data is authenticated but not included, and may be nil.
+func EncryptChaCha20(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
 	nonce := make([]byte, aead.NonceSize())
 	_, err := rand.Read(nonce)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
-	ciphertext := aead.Seal(nil, nonce, data, nil)
+	ciphertext := aead.Seal(nil, nonce, data, ad)
 	return append(nonce, ciphertext...), nil
 }
 
-func DecryptChaCha20(aead cipher.AEAD, data []byte) ([]byte, error) {
+// DecryptChaCha20 opens data sealed by EncryptChaCha20 with the same associated data.
+func DecryptChaCha20(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
 	nonceSize := aead.NonceSize()
 	if len(data) < nonceSize {
 		return nil, fmt.Errorf("invalid data: too short for nonce and ciphertext")
@@ -25,7 +28,7 @@ func DecryptChaCha20(aead cipher.AEAD, data []byte) ([]byte, error) {
 
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
 
-	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
 	if err != nil {
 		return nil, fmt.Errorf("decryption failed: %w", err)
 	}
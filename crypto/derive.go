@@ -0,0 +1,69 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39/wordlists"
+	"golang.org/x/crypto/hkdf"
+)
+
+// MaxDeriveLength is the most output HKDF-SHA256 can produce.
+const MaxDeriveLength = 255 * sha256.Size
+
+// ErrDeriveLength is returned when the requested length cannot be derived.
+var ErrDeriveLength = fmt.Errorf("length must be between 1 and %d bytes", MaxDeriveLength)
+
+// ErrEmptyContext is returned when deriving a subkey without a context.
+var ErrEmptyContext = errors.New("context must not be empty")
+
+// DeriveContext derives length bytes from a secret for the user-chosen context
+// using HKDF-SHA256. Contexts are kept separate from the purposes used by
+// DeriveKey, so that a context can never reproduce an internal key.
+func DeriveContext(secret []byte, context string, length int) ([]byte, error) {
+	if context == "" {
+		return nil, ErrEmptyContext
+	}
+	if length < 1 || length > MaxDeriveLength {
+		return nil, ErrDeriveLength
+	}
+	key := make([]byte, length)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("fidokit:derive:"+context)), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// passphraseBits is the number of bits encoded by each passphrase word.
+const passphraseBits = 11
+
+// PassphraseWords returns the number of words needed to encode length bytes.
+func PassphraseWords(length int) int {
+	return (length*8 + passphraseBits - 1) / passphraseBits
+}
+
+// PassphraseBytes returns the number of bytes consumed by a passphrase of the words.
+func PassphraseBytes(words int) int {
+	return (words*passphraseBits + 7) / 8
+}
+
+// Passphrase encodes data as words from the BIP39 English word list separated by
+// dashes, with each word taking the next 11 bits. Bits left over are ignored, so
+// data should hold PassphraseBytes(words) bytes for a passphrase of the words.
+func Passphrase(data []byte) string {
+	var words []string
+	var acc, bits uint
+	for _, b := range data {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		if bits >= passphraseBits {
+			bits -= passphraseBits
+			words = append(words, wordlists.English[acc>>bits&(1<<passphraseBits-1)])
+		}
+	}
+	return strings.Join(words, "-")
+}
@@ -1,9 +1,115 @@
 package crypto
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"golang.org/x/crypto/argon2"
 )
 
+// KDFArgon2id is the Argon2id password hashing algorithm.
+const KDFArgon2id = "argon2id"
+
+// ErrInvalidKDF is returned when password hashing parameters are unsupported.
+var ErrInvalidKDF = errors.New("invalid kdf parameters")
+
+// KDFParams are the algorithm and parameters used to derive a key from a password.
+type KDFParams struct {
+	// Algorithm is the password hashing algorithm. Only KDFArgon2id is supported.
+	Algorithm string `json:"algorithm"`
+	// Time is the number of passes over the memory.
+	Time uint32 `json:"time"`
+	// Memory is the amount of memory used, in KiB.
+	Memory uint32 `json:"memory"`
+	// Threads is the degree of parallelism.
+	Threads uint8 `json:"threads"`
+}
+
+// The largest parameters accepted. Vaults are read before they can be
+// authenticated, so these limit the memory and time which a crafted vault
+// can make the password kdf use.
+const (
+	MaxKDFTime    = 256
+	MaxKDFMemory  = 4 * 1024 * 1024 // 4 GiB, in KiB
+	MaxKDFThreads = 64
+)
+
+// DefaultKDFParams are the parameters used before they were stored in vaults.
+var DefaultKDFParams = KDFParams{
+	Algorithm: KDFArgon2id,
+	Time:      1,
+	Memory:    64 * 1024,
+	Threads:   4,
+}
+
+// Validate checks that the parameters are supported.
+func (p KDFParams) Validate() error {
+	if p.Algorithm != KDFArgon2id {
+		return fmt.Errorf("%w: unknown algorithm '%s'", ErrInvalidKDF, p.Algorithm)
+	}
+	if p.Time < 1 || p.Threads < 1 {
+		return fmt.Errorf("%w: time and threads must be at least 1", ErrInvalidKDF)
+	}
+	if p.Memory < 8*uint32(p.Threads) {
+		return fmt.Errorf("%w: memory must be at least 8 KiB per thread", ErrInvalidKDF)
+	}
+	if p.Time > MaxKDFTime || p.Memory > MaxKDFMemory || p.Threads > MaxKDFThreads {
+		return fmt.Errorf("%w: time, memory and threads must be at most %d, %d MiB and %d", ErrInvalidKDF, MaxKDFTime, MaxKDFMemory/1024, MaxKDFThreads)
+	}
+	return nil
+}
+
+// Key derives a 32-byte key from the password and salt.
+func (p KDFParams) Key(password, salt []byte) ([]byte, error) {
+	err := p.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return argon2.IDKey(password, salt, p.Time, p.Memory, p.Threads, 32), nil
+}
+
+func (p KDFParams) String() string {
+	return fmt.Sprintf("%s (time=%d, memory=%d MiB, threads=%d)", p.Algorithm, p.Time, p.Memory/1024, p.Threads)
+}
+
+// CalibrateKDF finds the number of passes for which deriving a key with the memory
+// (in KiB) and threads takes at least the target duration on this machine. It fails
+// if more than MaxKDFTime passes would be needed.
+func CalibrateKDF(target time.Duration, memory uint32, threads uint8) (KDFParams, error) {
+	params := KDFParams{
+		Algorithm: KDFArgon2id,
+		Time:      1,
+		Memory:    memory,
+		Threads:   threads,
+	}
+	err := params.Validate()
+	if err != nil {
+		return KDFParams{}, err
+	}
+
+	password, salt := make([]byte, 32), make([]byte, 16)
+	for {
+		start := time.Now()
+		argon2.IDKey(password, salt, params.Time, params.Memory, params.Threads, 32)
+		elapsed := time.Since(start)
+		if elapsed >= target {
+			return params, nil
+		}
+
+		if params.Time == MaxKDFTime {
+			return KDFParams{}, fmt.Errorf("%w: %d passes take only %s; use more memory", ErrInvalidKDF, MaxKDFTime, elapsed.Round(time.Millisecond))
+		}
+
+		// estimate the passes required from the time taken, then measure again
+		perPass := elapsed / time.Duration(params.Time)
+		next := uint32(min(target/max(perPass, time.Microsecond), MaxKDFTime))
+		params.Time = max(next, params.Time+1)
+	}
+}
+
+// HashPassword derives a key from the password using DefaultKDFParams.
 func HashPassword(password, salt []byte) []byte {
-	return argon2.IDKey(password, salt, 1, 64*1024, 4, 32)
+	key, _ := DefaultKDFParams.Key(password, salt)
+	return key
 }
@@ -0,0 +1,50 @@
+package crypto
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestKDFParamsValidate(t *testing.T) {
+	valid := []KDFParams{
+		DefaultKDFParams,
+		{Algorithm: KDFArgon2id, Time: 1, Memory: 8, Threads: 1},
+		{Algorithm: KDFArgon2id, Time: MaxKDFTime, Memory: MaxKDFMemory, Threads: MaxKDFThreads},
+	}
+	for _, p := range valid {
+		err := p.Validate()
+		if err != nil {
+			t.Errorf("%+v: %v", p, err)
+		}
+	}
+
+	invalid := []KDFParams{
+		{Algorithm: "scrypt", Time: 1, Memory: 64 * 1024, Threads: 4},
+		{Algorithm: KDFArgon2id, Time: 0, Memory: 64 * 1024, Threads: 4},
+		{Algorithm: KDFArgon2id, Time: 1, Memory: 64 * 1024, Threads: 0},
+		{Algorithm: KDFArgon2id, Time: 1, Memory: 8, Threads: 4},
+		{Algorithm: KDFArgon2id, Time: MaxKDFTime + 1, Memory: 64 * 1024, Threads: 4},
+		{Algorithm: KDFArgon2id, Time: 1, Memory: MaxKDFMemory + 1, Threads: 4},
+		{Algorithm: KDFArgon2id, Time: 1, Memory: math.MaxUint32, Threads: 4},
+		{Algorithm: KDFArgon2id, Time: 1, Memory: 64 * 1024, Threads: MaxKDFThreads + 1},
+	}
+	for _, p := range invalid {
+		err := p.Validate()
+		if !errors.Is(err, ErrInvalidKDF) {
+			t.Errorf("%+v: got %v, want %v", p, err, ErrInvalidKDF)
+		}
+		_, err = p.Key([]byte("password"), make([]byte, 16))
+		if !errors.Is(err, ErrInvalidKDF) {
+			t.Errorf("%+v: key: got %v, want %v", p, err, ErrInvalidKDF)
+		}
+	}
+}
+
+func TestCalibrateKDFLimit(t *testing.T) {
+	_, err := CalibrateKDF(time.Hour, 8, 1)
+	if !errors.Is(err, ErrInvalidKDF) {
+		t.Errorf("calibrate beyond %d passes: got %v, want %v", MaxKDFTime, err, ErrInvalidKDF)
+	}
+}
@@ -0,0 +1,31 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// DeriveKey derives an independent 32-byte subkey from a secret for the purpose.
+func DeriveKey(secret []byte, purpose string) []byte {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("fidokit:"+purpose)), key)
+	if err != nil {
+		panic(err) // only possible when reading more than 255 blocks
+	}
+	return key
+}
+
+// MAC computes the HMAC-SHA256 of the data.
+func MAC(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// VerifyMAC checks the HMAC-SHA256 of the data in constant time.
+func VerifyMAC(key, data, mac []byte) bool {
+	return hmac.Equal(MAC(key, data), mac)
+}
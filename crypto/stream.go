@@ -0,0 +1,231 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// StreamChunkSize is the size of each plaintext chunk of an encrypted stream.
+const StreamChunkSize = 64 * 1024
+
+// streamMagic identifies an encrypted stream and the version of its format.
+const streamMagic = "fkstrm1\n"
+
+const streamSaltSize = 32
+
+// ErrStreamKey is returned when an encrypted stream was encrypted using a different key.
+var ErrStreamKey = errors.New("stream was encrypted using a different key")
+
+// ErrStreamCorrupt is returned when an encrypted stream has been modified or truncated.
+var ErrStreamCorrupt = errors.New("encrypted stream is corrupt or truncated")
+
+var errStreamClosed = errors.New("write to closed stream")
+
+// The encrypted stream format follows the STREAM construction:
+//
+//	magic || salt || HMAC-SHA256(header key, magic || salt) || chunks...
+//
+// A random salt is used to derive a unique key for the stream. Each chunk
+// of up to StreamChunkSize bytes is sealed using ChaCha20-Poly1305 with the
+// nonce counter || final, where counter is the 11-byte big-endian index of
+// the chunk, and final is 1 for the last chunk and 0 otherwise. Reordering,
+// dropping or truncating chunks makes decryption fail. Only the stream of an
+// empty plaintext may end with an empty chunk.
+
+// streamKeys derives the keys used for the header MAC and the chunks.
+func streamKeys(key, salt []byte) (headerKey []byte, aead cipher.AEAD, err error) {
+	r := hkdf.New(sha256.New, key, salt, []byte("fidokit:stream"))
+	headerKey, payloadKey := make([]byte, 32), make([]byte, chacha20poly1305.KeySize)
+	_, err = io.ReadFull(r, headerKey)
+	if err == nil {
+		_, err = io.ReadFull(r, payloadKey)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err = chacha20poly1305.New(payloadKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create aead: %w", err)
+	}
+	return headerKey, aead, nil
+}
+
+func streamNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	err     error
+}
+
+// EncryptStream returns a writer which encrypts everything written to it
+// using the key, writing the encrypted stream to w. It must be closed to
+// write the final chunk, but closing it does not close w.
+func EncryptStream(key []byte, w io.Writer) (io.WriteCloser, error) {
+	salt := make([]byte, streamSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	headerKey, aead, err := streamKeys(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(streamMagic), salt...)
+	_, err = w.Write(append(header, MAC(headerKey, header)...))
+	if err != nil {
+		return nil, err
+	}
+	return &streamWriter{w: w, aead: aead, buf: make([]byte, 0, StreamChunkSize)}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 && s.err == nil {
+		// a full chunk is only written once more data follows it, since it may be the final chunk
+		if len(s.buf) == StreamChunkSize {
+			s.err = s.flush(false)
+			continue
+		}
+		c := copy(s.buf[len(s.buf):StreamChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, s.err
+}
+
+// Close writes the final chunk.
+func (s *streamWriter) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	s.err = s.flush(true)
+	if s.err != nil {
+		return s.err
+	}
+	s.err = errStreamClosed
+	return nil
+}
+
+func (s *streamWriter) flush(final bool) error {
+	chunk := s.aead.Seal(nil, streamNonce(s.counter, final), s.buf, nil)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(chunk)
+	return err
+}
+
+type streamReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	chunk   []byte
+	carried int
+	buf     []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// DecryptStream returns a reader which decrypts the encrypted stream read
+// from r using the key. The reader returns ErrStreamCorrupt if the stream
+// has been modified, including if it ends before the final chunk, so data
+// must not be trusted until the reader has returned io.EOF.
+func DecryptStream(key []byte, r io.Reader) (io.Reader, error) {
+	header := make([]byte, len(streamMagic)+streamSaltSize+sha256.Size)
+	_, err := io.ReadFull(r, header)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, ErrStreamCorrupt
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(streamMagic)) {
+		return nil, fmt.Errorf("%w: not an encrypted stream", ErrStreamCorrupt)
+	}
+
+	salt, mac := header[len(streamMagic):len(streamMagic)+streamSaltSize], header[len(streamMagic)+streamSaltSize:]
+	headerKey, aead, err := streamKeys(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(MAC(headerKey, header[:len(streamMagic)+streamSaltSize]), mac) {
+		return nil, ErrStreamKey
+	}
+
+	// one extra byte is read to tell whether a full chunk is the last one
+	chunk := make([]byte, StreamChunkSize+aead.Overhead()+1)
+	return &streamReader{r: r, aead: aead, chunk: chunk}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 && s.err == nil {
+		if s.done {
+			s.err = io.EOF
+			break
+		}
+		s.err = s.next()
+	}
+	if len(s.buf) > 0 {
+		n := copy(p, s.buf)
+		s.buf = s.buf[n:]
+		return n, nil
+	}
+	return 0, s.err
+}
+
+// next reads and decrypts the next chunk into buf.
+func (s *streamReader) next() error {
+	size := StreamChunkSize + s.aead.Overhead()
+
+	// the byte after the previous chunk is carried over to the start of s.chunk
+	n, err := io.ReadFull(s.r, s.chunk[s.carried:])
+	n += s.carried
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	final := n <= size
+	sealed := s.chunk[:min(n, size)]
+	if len(sealed) < s.aead.Overhead() {
+		return ErrStreamCorrupt
+	}
+
+	plaintext, err := s.aead.Open(nil, streamNonce(s.counter, final), sealed, nil)
+	if err != nil {
+		return ErrStreamCorrupt
+	}
+	if final && len(plaintext) == 0 && s.counter > 0 {
+		return ErrStreamCorrupt
+	}
+	s.counter++
+	s.buf = plaintext
+	s.done = final
+
+	if !final {
+		s.chunk[0] = s.chunk[size]
+		s.carried = 1
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+)
+
+const (
+	streamHeaderSize = len(streamMagic) + streamSaltSize + sha256.Size
+	sealedChunkSize  = StreamChunkSize + 16
+)
+
+func encryptStream(t *testing.T, key, plaintext []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := EncryptStream(key, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decryptStream(key, ciphertext []byte) ([]byte, error) {
+	r, err := DecryptStream(key, bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := randomBytes(32)
+	for _, size := range []int{0, 1, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3 * StreamChunkSize} {
+		plaintext := randomBytes(size)
+		ciphertext := encryptStream(t, key, plaintext)
+
+		chunks := max(1, (size+StreamChunkSize-1)/StreamChunkSize)
+		if want := streamHeaderSize + size + chunks*16; len(ciphertext) != want {
+			t.Errorf("size %d: got %d bytes of ciphertext, want %d", size, len(ciphertext), want)
+		}
+
+		got, err := decryptStream(key, ciphertext)
+		if err != nil {
+			t.Errorf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: plaintext does not match", size)
+		}
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	ciphertext := encryptStream(t, randomBytes(32), []byte("hello"))
+	_, err := decryptStream(randomBytes(32), ciphertext)
+	if !errors.Is(err, ErrStreamKey) {
+		t.Errorf("got %v, want %v", err, ErrStreamKey)
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	key := randomBytes(32)
+	ciphertext := encryptStream(t, key, randomBytes(2*StreamChunkSize+100))
+
+	lengths := map[string]int{
+		"header only":           streamHeaderSize,
+		"partial header":        streamHeaderSize - 1,
+		"first chunk only":      streamHeaderSize + sealedChunkSize,
+		"two full chunks":       streamHeaderSize + 2*sealedChunkSize,
+		"within the last chunk": len(ciphertext) - 1,
+		"within a chunk":        streamHeaderSize + sealedChunkSize/2,
+	}
+	for name, n := range lengths {
+		_, err := decryptStream(key, ciphertext[:n])
+		if !errors.Is(err, ErrStreamCorrupt) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrStreamCorrupt)
+		}
+	}
+}
+
+func TestStreamReordered(t *testing.T) {
+	key := randomBytes(32)
+	ciphertext := encryptStream(t, key, randomBytes(3*StreamChunkSize))
+
+	header := ciphertext[:streamHeaderSize]
+	chunk := func(i int) []byte {
+		start := streamHeaderSize + i*sealedChunkSize
+		return ciphertext[start : start+sealedChunkSize]
+	}
+	reordered := bytes.Join([][]byte{header, chunk(1), chunk(0), chunk(2)}, nil)
+
+	_, err := decryptStream(key, reordered)
+	if !errors.Is(err, ErrStreamCorrupt) {
+		t.Errorf("got %v, want %v", err, ErrStreamCorrupt)
+	}
+}
+
+func TestStreamEmptyFinalChunk(t *testing.T) {
+	key := randomBytes(32)
+	ciphertext := encryptStream(t, key, randomBytes(StreamChunkSize))
+
+	// re-encrypt the only chunk as a non-final chunk, followed by an empty final chunk
+	header := ciphertext[:streamHeaderSize]
+	_, aead, err := streamKeys(key, header[len(streamMagic):len(streamMagic)+streamSaltSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := aead.Open(nil, streamNonce(0, true), ciphertext[streamHeaderSize:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := append([]byte{}, header...)
+	forged = aead.Seal(forged, streamNonce(0, false), plaintext, nil)
+	forged = aead.Seal(forged, streamNonce(1, true), nil, nil)
+
+	_, err = decryptStream(key, forged)
+	if !errors.Is(err, ErrStreamCorrupt) {
+		t.Errorf("got %v, want %v", err, ErrStreamCorrupt)
+	}
+}
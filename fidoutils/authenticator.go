@@ -0,0 +1,76 @@
+package fidoutils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/keys-pub/go-libfido2"
+)
+
+// Authenticator is a FIDO2 authenticator supporting the hmac-secret extension.
+//
+// The method set mirrors *libfido2.Device, which satisfies this interface
+// directly, so hardware keys need no wrapper. SoftwareAuthenticator is a
+// pure-Go implementation used for running vault flows without hardware.
+type Authenticator interface {
+	// Info returns the authenticator's capabilities (authenticatorGetInfo).
+	Info() (*libfido2.DeviceInfo, error)
+	// MakeCredential creates a new credential (authenticatorMakeCredential).
+	MakeCredential(clientDataHash []byte, rp libfido2.RelyingParty, user libfido2.User, typ libfido2.CredentialType, pin string, opts *libfido2.MakeCredentialOpts) (*libfido2.Attestation, error)
+	// Assertion gets an assertion for one of the credentials (authenticatorGetAssertion).
+	Assertion(rpID string, clientDataHash []byte, credentialIDs [][]byte, pin string, opts *libfido2.AssertionOpts) (*libfido2.Assertion, error)
+	// Credentials lists the resident credentials for the relying party (authenticatorCredentialManagement).
+	Credentials(rpID string, pin string) ([]*libfido2.Credential, error)
+}
+
+// Provider enumerates the authenticators available to the program.
+type Provider interface {
+	// Locations returns the locations of all connected authenticators.
+	Locations() ([]*libfido2.DeviceLocation, error)
+	// Open returns the authenticator at the location path.
+	Open(path string) (Authenticator, error)
+	// Select waits for the user to touch one of the authenticators.
+	Select(auths []Authenticator, timeout time.Duration) (Authenticator, error)
+}
+
+// Devices is the Provider used to find authenticators. It uses hardware
+// keys through libfido2 by default, and can be replaced (for example with
+// a SoftwareProvider) before any interactive operations are performed.
+var Devices Provider = HardwareProvider{}
+
+// ErrNotHardware is returned by HardwareProvider.Select when it is given
+// authenticators which were not opened through libfido2.
+var ErrNotHardware = errors.New("authenticator is not a libfido2 device")
+
+// HardwareProvider is a Provider for physical keys, backed by libfido2.
+type HardwareProvider struct{}
+
+func (HardwareProvider) Locations() ([]*libfido2.DeviceLocation, error) {
+	return libfido2.DeviceLocations()
+}
+
+func (HardwareProvider) Open(path string) (Authenticator, error) {
+	dev, err := libfido2.NewDevice(path)
+	if err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+func (HardwareProvider) Select(auths []Authenticator, timeout time.Duration) (Authenticator, error) {
+	devs := make([]*libfido2.Device, len(auths))
+	for i, auth := range auths {
+		dev, ok := auth.(*libfido2.Device)
+		if !ok {
+			return nil, ErrNotHardware
+		}
+		devs[i] = dev
+	}
+
+	dev, err := libfido2.SelectDevice(devs, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("select device: %w", err)
+	}
+	return dev, nil
+}
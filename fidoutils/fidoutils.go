@@ -4,15 +4,19 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/keys-pub/go-libfido2"
 
-	"fidokit/utils"
+	"fidokit/prompt"
 )
 
 var Debug bool
 
+// Prompter is used to ask the user for input, such as PINs.
+var Prompter prompt.Prompter = prompt.Stdio
+
 // DisableBiometrics should be set later via a cli flag to allow
 // the user to use PIN fallback on their biometric keys; otherwise
 // the user will never be prompted for a PIN, as it is assumed that
@@ -24,13 +28,52 @@ var DisableBiometrics = false
 // ErrNoDevice indicates that no compatible device is available to the program.
 var ErrNoDevice = errors.New("no device")
 
+// ErrBiometricsOnly indicates that a key only supports biometric
+// user verification, but DisableBiometrics is set.
+var ErrBiometricsOnly = errors.New("this key does not support PIN fallback, but biometric authentication is disabled")
+
+// ErrInvalidRPID is returned when a relying party ID is not a valid domain name.
+var ErrInvalidRPID = errors.New("invalid relying party id")
+
+// ClientDataHashText and AssertionSaltText were used by every vault before
+// each vault was given random values, and are still used by those vaults.
 const ClientDataHashText = "create-credential"
 const AssertionSaltText = "vault-master-key"
 
 var ClientDataHash = sha256.Sum256([]byte(ClientDataHashText))
 var AssertionSalt = sha256.Sum256([]byte(AssertionSaltText))
 
-// User is required for setup. Not stored on the security key.
+// Params are the values used by a vault for its credentials and for deriving
+// the hmac-secret, which make the derived secrets unique to the vault.
+type Params struct {
+	// RPID is the relying party ID of the credentials.
+	RPID string
+	// RPName is the name of the relying party. If it is empty, the name of RelyingParty is used.
+	RPName string
+	// UserName identifies the user entity of new credentials. If it is empty, User is used.
+	UserName string
+	// ClientDataHash is passed into each operation.
+	ClientDataHash []byte
+	// Salt is passed into each assertion to derive the hmac-secret.
+	Salt []byte
+}
+
+// NewParams creates Params from the text values stored in a vault,
+// which are hashed using SHA256.
+func NewParams(rpID, clientDataHashText, saltText string) Params {
+	clientDataHash := sha256.Sum256([]byte(clientDataHashText))
+	salt := sha256.Sum256([]byte(saltText))
+	return Params{
+		RPID:           rpID,
+		ClientDataHash: clientDataHash[:],
+		Salt:           salt[:],
+	}
+}
+
+// DefaultParams are the values used by vaults created before each vault was given random values.
+var DefaultParams = NewParams(RelyingParty.ID, ClientDataHashText, AssertionSaltText)
+
+// User is required for setup. Not stored on the security key for non-resident credentials.
 var User = libfido2.User{
 	ID:   []byte("n/a"),
 	Name: "n/a",
@@ -50,22 +93,72 @@ var MakeCredentialOpts = &libfido2.MakeCredentialOpts{
 	UV:         libfido2.True,  // user verification required
 }
 
-var AssertionOpts = &libfido2.AssertionOpts{
+// ResidentCredentialOpts contains options used to create resident (discoverable)
+// hmac-secret credentials, which store the user entity on the security key.
+var ResidentCredentialOpts = &libfido2.MakeCredentialOpts{
 	Extensions: []libfido2.Extension{libfido2.HMACSecretExtension},
-	HMACSalt:   AssertionSalt[:], // salt for deterministic derivation
-	UV:         libfido2.True,    // user verification required
+	RK:         libfido2.True, // resident key
+	UV:         libfido2.True, // user verification required
 }
 
-// InteractiveGetPIN requests for the PIN of the security key, or
-// returns an empty string if it supports on-device biometric UV.
-func InteractiveGetPIN(dev *libfido2.Device) (string, error) {
-	if Debug {
-		fmt.Println("[DEBUG] InteractiveGetPIN")
+// assertionOpts returns the options used to derive the hmac-secret using the salt.
+func (p Params) assertionOpts() *libfido2.AssertionOpts {
+	return &libfido2.AssertionOpts{
+		Extensions: []libfido2.Extension{libfido2.HMACSecretExtension},
+		HMACSalt:   p.Salt,        // salt for deterministic derivation
+		UV:         libfido2.True, // user verification required
 	}
+}
 
+func (p Params) relyingParty() libfido2.RelyingParty {
+	rp := RelyingParty
+	rp.ID = p.RPID
+	if p.RPName != "" {
+		rp.Name = p.RPName
+	}
+	return rp
+}
+
+func (p Params) user() libfido2.User {
+	if p.UserName == "" {
+		return User
+	}
+	return libfido2.User{
+		ID:          []byte(p.UserName),
+		Name:        p.UserName,
+		DisplayName: p.UserName,
+	}
+}
+
+// ValidateRPID checks that the relying party ID is a domain name, such as
+// example.com: dot-separated labels of lowercase letters, digits and hyphens.
+func ValidateRPID(id string) error {
+	if id == "" || len(id) > 253 {
+		return fmt.Errorf("%w: '%s' must be between 1 and 253 characters", ErrInvalidRPID, id)
+	}
+	for _, label := range strings.Split(id, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("%w: '%s' must consist of labels between 1 and 63 characters", ErrInvalidRPID, id)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("%w: '%s' has a label starting or ending with a hyphen", ErrInvalidRPID, id)
+		}
+		for _, c := range label {
+			if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-') {
+				return fmt.Errorf("%w: '%s' may only contain lowercase letters, digits, hyphens and dots", ErrInvalidRPID, id)
+			}
+		}
+	}
+	return nil
+}
+
+// NeedsPIN reports whether a PIN must be provided to perform user verification
+// with the security key, which is not the case for keys that support on-device
+// biometric UV, unless DisableBiometrics is set.
+func NeedsPIN(dev Authenticator) (bool, error) {
 	info, err := dev.Info()
 	if err != nil {
-		return "", fmt.Errorf("GetHeaderByCredID device info: %w", err)
+		return false, fmt.Errorf("device info: %w", err)
 	}
 
 	getOptionValue := func(opts []libfido2.Option, name string) bool {
@@ -87,20 +180,86 @@ func InteractiveGetPIN(dev *libfido2.Device) (string, error) {
 	// this key only supports biometric authentication.
 	// this is a rare, or potentially impossible case.
 	if hasBio && !hasPIN && DisableBiometrics {
-		return "", fmt.Errorf("this key does not support PIN fallback, but biometric authentication is disabled")
+		return false, ErrBiometricsOnly
 	}
 
 	// security key supports biometric authentication,
 	// user should do this instead of providing a PIN.
-	if hasBio && !DisableBiometrics {
+	return !hasBio || DisableBiometrics, nil
+}
+
+// InteractiveGetPIN requests for the PIN of the security key, or
+// returns an empty string if it supports on-device biometric UV.
+func InteractiveGetPIN(dev Authenticator) (string, error) {
+	if Debug {
+		fmt.Println("[DEBUG] InteractiveGetPIN")
+	}
+
+	needsPIN, err := NeedsPIN(dev)
+	if err != nil {
+		return "", err
+	}
+	if !needsPIN {
 		return "", nil
 	}
 
-	pin := utils.ReadNonEmptyLine("Enter PIN: ")
-	return pin, nil
+	return prompt.AskNonEmptySecret(Prompter, "Enter PIN: ")
+}
+
+// MakeCredential creates a new non-resident hmac-secret credential on the security key.
+func MakeCredential(dev Authenticator, pin string, p Params) (*libfido2.Attestation, error) {
+	cred, err := dev.MakeCredential(p.ClientDataHash, p.relyingParty(), p.user(), libfido2.ES256, pin, MakeCredentialOpts)
+	if err != nil {
+		return nil, fmt.Errorf("make credential: %w", err)
+	}
+	return cred, nil
+}
+
+// MakeResidentCredential creates a new resident hmac-secret credential on the
+// security key, storing the user ID with it. A resident credential replaces
+// any other with the same relying party ID and user ID.
+func MakeResidentCredential(dev Authenticator, pin string, p Params, userID []byte) (*libfido2.Attestation, error) {
+	user := p.user()
+	user.ID = userID
+	cred, err := dev.MakeCredential(p.ClientDataHash, p.relyingParty(), user, libfido2.ES256, pin, ResidentCredentialOpts)
+	if err != nil {
+		return nil, fmt.Errorf("make resident credential: %w", err)
+	}
+	return cred, nil
+}
+
+// ResidentCredentials lists the resident credentials stored on the security key
+// for the relying party, which requires support for credential management.
+func ResidentCredentials(dev Authenticator, pin string, rpID string) ([]*libfido2.Credential, error) {
+	creds, err := dev.Credentials(rpID, pin)
+	if err != nil {
+		return nil, fmt.Errorf("list resident credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// Assertion gets an assertion from the security key for any one of the
+// credentials, including the hmac-secret derived using the salt.
+func Assertion(dev Authenticator, pin string, credIDs [][]byte, p Params) (*libfido2.Assertion, error) {
+	assert, err := dev.Assertion(p.RPID, p.ClientDataHash, credIDs, pin, p.assertionOpts())
+	if err != nil {
+		return nil, fmt.Errorf("assertion: %w", err)
+	}
+	return assert, nil
 }
 
-func InteractiveMakeCredential() (*libfido2.Attestation, error) {
+// probeOpts check for a credential without user presence or verification.
+var probeOpts = &libfido2.AssertionOpts{UP: libfido2.False}
+
+// HasCredential reports whether the security key holds the credential, using
+// an assertion which requires neither a touch nor a PIN. Keys which refuse
+// such assertions are reported as not holding the credential.
+func HasCredential(dev Authenticator, credID []byte, p Params) bool {
+	_, err := dev.Assertion(p.RPID, p.ClientDataHash, [][]byte{credID}, "", probeOpts)
+	return err == nil
+}
+
+func InteractiveMakeCredential(p Params) (*libfido2.Attestation, error) {
 	if Debug {
 		fmt.Println("[DEBUG] InteractiveMakeCredential")
 	}
@@ -112,27 +271,22 @@ func InteractiveMakeCredential() (*libfido2.Attestation, error) {
 
 	pin, err := InteractiveGetPIN(dev)
 	if err != nil {
-		return nil, fmt.Errorf("GetHeaderByCredID pin: %w", err)
+		return nil, fmt.Errorf("get pin: %w", err)
 	}
 
-	return InteractiveMakeCredentialFor(dev, pin)
+	return InteractiveMakeCredentialFor(dev, pin, p)
 }
 
-func InteractiveMakeCredentialFor(dev *libfido2.Device, pin string) (*libfido2.Attestation, error) {
+func InteractiveMakeCredentialFor(dev Authenticator, pin string, p Params) (*libfido2.Attestation, error) {
 	if Debug {
 		fmt.Printf("[DEBUG] InteractiveMakeCredentialFor(%v, %s)\n", dev, pin)
 	}
 
-	fmt.Println("Tap your security key.")
-	cred, err := dev.MakeCredential(ClientDataHash[:], RelyingParty, User, libfido2.ES256, pin, MakeCredentialOpts)
-	if err != nil {
-		return nil, fmt.Errorf("make credential: %w", err)
-	}
-
-	return cred, nil
+	Prompter.Notify("Tap your security key.")
+	return MakeCredential(dev, pin, p)
 }
 
-func InteractiveAssertion(credIDs [][]byte) (*libfido2.Assertion, error) {
+func InteractiveAssertion(credIDs [][]byte, p Params) (*libfido2.Assertion, error) {
 	if Debug {
 		fmt.Printf("[DEBUG] InteractiveAssertion(%v)\n", credIDs)
 	}
@@ -147,21 +301,16 @@ func InteractiveAssertion(credIDs [][]byte) (*libfido2.Assertion, error) {
 		return nil, fmt.Errorf("pin: %w", err)
 	}
 
-	return InteractiveAssertionFor(dev, pin, credIDs)
+	return InteractiveAssertionFor(dev, pin, credIDs, p)
 }
 
-func InteractiveAssertionFor(dev *libfido2.Device, pin string, credIDs [][]byte) (*libfido2.Assertion, error) {
+func InteractiveAssertionFor(dev Authenticator, pin string, credIDs [][]byte, p Params) (*libfido2.Assertion, error) {
 	if Debug {
 		fmt.Printf("[DEBUG] InteractiveAssertionFor(%v, %s, %v)\n", dev, pin, credIDs)
 	}
 
-	fmt.Println("Tap your security key.")
-	assert, err := dev.Assertion(RelyingParty.ID, ClientDataHash[:], credIDs, pin, AssertionOpts)
-	if err != nil {
-		return nil, fmt.Errorf("assertion: %w", err)
-	}
-
-	return assert, nil
+	Prompter.Notify("Tap your security key.")
+	return Assertion(dev, pin, credIDs, p)
 }
 
 // InteractiveGetDevice chooses the FIDO2 device to use.
@@ -171,8 +320,8 @@ func InteractiveAssertionFor(dev *libfido2.Device, pin string, credIDs [][]byte)
 //	0  -> returns ErrNoDevice
 //	1  -> returns devices[0]
 //	2+ -> prompts the user to tap the device they want to use (timeout 30s)
-func InteractiveGetDevice() (*libfido2.Device, error) {
-	devs, err := fido2GetDevices()
+func InteractiveGetDevice() (Authenticator, error) {
+	devs, err := ConnectedDevices()
 	if err != nil {
 		return nil, err
 	}
@@ -182,6 +331,6 @@ func InteractiveGetDevice() (*libfido2.Device, error) {
 	if len(devs) == 1 {
 		return devs[0], nil
 	}
-	fmt.Println("Multiple keys found: tap the key you want to use.")
-	return libfido2.SelectDevice(devs, 30*time.Second)
+	Prompter.Notify("Multiple keys found: tap the key you want to use.")
+	return Devices.Select(devs, 30*time.Second)
 }
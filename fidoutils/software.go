@@ -0,0 +1,377 @@
+package fidoutils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/keys-pub/go-libfido2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	"fidokit/utils"
+)
+
+// softwarePINRetries is the number of consecutive incorrect
+// PINs a SoftwareAuthenticator allows before it is blocked.
+const softwarePINRetries = 8
+
+// softwareNonceSize is the size of the per-credential nonce, which
+// both seeds CredRandom and is used as the wrapping AEAD's nonce.
+const softwareNonceSize = chacha20poly1305.NonceSizeX
+
+// SoftwareAuthenticator is a pure-Go Authenticator implementing the
+// hmac-secret extension, with simulated PIN and biometric verification.
+//
+// Credentials are not stored; instead, each credential ID wraps its own
+// CredRandom using a key derived from the authenticator's seed, and the
+// relying party ID is bound as associated data. CredRandom is derived
+// deterministically from the seed and the credential nonce, so the same
+// seed always produces the same hmac-secret for the same credential ID.
+// Resident credentials are additionally kept in memory until the
+// authenticator is discarded.
+//
+// This is intended for exercising vault flows in environments without
+// hardware keys, such as CI. It provides no protection for its seed.
+type SoftwareAuthenticator struct {
+	// Name is displayed as the product name of the authenticator.
+	Name string
+	// PIN is the authenticator's PIN, or "" if no PIN is set.
+	PIN string
+	// Biometric simulates on-device user verification, such as
+	// a fingerprint reader, which is always performed successfully.
+	Biometric bool
+
+	seed     []byte
+	retries  int
+	resident []*libfido2.Credential
+	rpIDs    map[string]string // relying party ID of each resident credential, by credential ID
+	mu       sync.Mutex
+}
+
+// NewSoftwareAuthenticator creates a SoftwareAuthenticator from a seed,
+// which should be at least 32 bytes and must be kept to reuse credentials.
+func NewSoftwareAuthenticator(name string, seed []byte, pin string) *SoftwareAuthenticator {
+	return &SoftwareAuthenticator{
+		Name:    name,
+		PIN:     pin,
+		seed:    slices.Clone(seed),
+		retries: softwarePINRetries,
+	}
+}
+
+// Path returns the location path of the authenticator.
+func (a *SoftwareAuthenticator) Path() string {
+	return "software:" + a.Name
+}
+
+func (a *SoftwareAuthenticator) Info() (*libfido2.DeviceInfo, error) {
+	options := []libfido2.Option{
+		{Name: "rk", Value: libfido2.True},
+		{Name: "up", Value: libfido2.True},
+		{Name: "clientPin", Value: optionValue(a.PIN != "")},
+	}
+	if a.Biometric {
+		options = append(options, libfido2.Option{Name: "bioEnroll", Value: libfido2.True})
+	}
+
+	aaguid := sha256.Sum256(a.seed)
+	return &libfido2.DeviceInfo{
+		Versions:   []string{"FIDO_2_0", "FIDO_2_1"},
+		Extensions: []string{string(libfido2.HMACSecretExtension)},
+		AAGUID:     aaguid[:16],
+		Options:    options,
+		Protocols:  []byte{1},
+	}, nil
+}
+
+func (a *SoftwareAuthenticator) MakeCredential(clientDataHash []byte, rp libfido2.RelyingParty, user libfido2.User, typ libfido2.CredentialType, pin string, opts *libfido2.MakeCredentialOpts) (*libfido2.Attestation, error) {
+	if opts == nil {
+		opts = &libfido2.MakeCredentialOpts{}
+	}
+	if len(clientDataHash) != sha256.Size || rp.ID == "" || len(user.ID) == 0 || user.Name == "" {
+		return nil, libfido2.ErrInvalidArgument
+	}
+
+	err := a.verifyUser(pin, opts.UV)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := utils.RandomBytes(softwareNonceSize)
+	credRandom := a.deriveCredRandom(nonce)
+	aead, err := chacha20poly1305.NewX(a.deriveKey("credential-wrapping"))
+	if err != nil {
+		return nil, fmt.Errorf("create aead: %w", err)
+	}
+	credID := aead.Seal(nonce, nonce, credRandom, rpIDHash(rp.ID))
+
+	if opts.RK == libfido2.True {
+		a.storeResident(rp.ID, &libfido2.Credential{ID: credID, Type: typ, User: user})
+	}
+
+	return &libfido2.Attestation{
+		ClientDataHash: slices.Clone(clientDataHash),
+		CredentialID:   credID,
+		CredentialType: typ,
+		Format:         "none",
+	}, nil
+}
+
+func (a *SoftwareAuthenticator) Assertion(rpID string, clientDataHash []byte, credentialIDs [][]byte, pin string, opts *libfido2.AssertionOpts) (*libfido2.Assertion, error) {
+	if opts == nil {
+		opts = &libfido2.AssertionOpts{}
+	}
+	if len(clientDataHash) != sha256.Size || rpID == "" {
+		return nil, libfido2.ErrInvalidArgument
+	}
+	hmacSecret := slices.Contains(opts.Extensions, libfido2.HMACSecretExtension)
+	if hmacSecret && len(opts.HMACSalt) != 32 && len(opts.HMACSalt) != 64 {
+		return nil, libfido2.ErrInvalidArgument
+	}
+
+	err := a.verifyUser(pin, opts.UV)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(a.deriveKey("credential-wrapping"))
+	if err != nil {
+		return nil, fmt.Errorf("create aead: %w", err)
+	}
+	if len(credentialIDs) == 0 {
+		// discover the resident credentials for the rp, most recent first
+		for _, cred := range slices.Backward(a.residentFor(rpID)) {
+			credentialIDs = append(credentialIDs, cred.ID)
+		}
+	}
+	for _, credID := range credentialIDs {
+		if len(credID) < softwareNonceSize {
+			continue
+		}
+		nonce, sealed := credID[:softwareNonceSize], credID[softwareNonceSize:]
+		credRandom, err := aead.Open(nil, nonce, sealed, rpIDHash(rpID))
+		if err != nil {
+			continue // not a credential created by this authenticator for this rp
+		}
+
+		assertion := &libfido2.Assertion{
+			CredentialID: slices.Clone(credID),
+		}
+		if cred := a.findResident(credID); cred != nil {
+			assertion.User.ID = slices.Clone(cred.User.ID)
+		}
+		if hmacSecret {
+			assertion.HMACSecret = hmacSecretOutput(credRandom, opts.HMACSalt)
+		}
+		return assertion, nil
+	}
+
+	return nil, libfido2.ErrNoCredentials
+}
+
+// Credentials lists the resident credentials for the relying party.
+func (a *SoftwareAuthenticator) Credentials(rpID string, pin string) ([]*libfido2.Credential, error) {
+	if rpID == "" {
+		return nil, libfido2.ErrInvalidArgument
+	}
+	err := a.verifyUser(pin, libfido2.True)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds []*libfido2.Credential
+	for _, cred := range a.residentFor(rpID) {
+		c := *cred
+		c.ID = slices.Clone(cred.ID)
+		c.User.ID = slices.Clone(cred.User.ID)
+		creds = append(creds, &c)
+	}
+	return creds, nil
+}
+
+// storeResident stores the resident credential, replacing any
+// other for the same relying party ID and user ID.
+func (a *SoftwareAuthenticator) storeResident(rpID string, cred *libfido2.Credential) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rpIDs == nil {
+		a.rpIDs = map[string]string{}
+	}
+	a.resident = slices.DeleteFunc(a.resident, func(c *libfido2.Credential) bool {
+		return a.rpIDs[string(c.ID)] == rpID && slices.Equal(c.User.ID, cred.User.ID)
+	})
+	a.resident = append(a.resident, cred)
+	a.rpIDs[string(cred.ID)] = rpID
+}
+
+// residentFor returns the resident credentials for the relying party, oldest first.
+func (a *SoftwareAuthenticator) residentFor(rpID string) []*libfido2.Credential {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var creds []*libfido2.Credential
+	for _, cred := range a.resident {
+		if a.rpIDs[string(cred.ID)] == rpID {
+			creds = append(creds, cred)
+		}
+	}
+	return creds
+}
+
+func (a *SoftwareAuthenticator) findResident(credID []byte) *libfido2.Credential {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, cred := range a.resident {
+		if slices.Equal(cred.ID, credID) {
+			return cred
+		}
+	}
+	return nil
+}
+
+// verifyUser simulates the authenticator's user verification, requiring
+// a correct PIN unless the authenticator is biometric and none is given.
+func (a *SoftwareAuthenticator) verifyUser(pin string, uv libfido2.OptionValue) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if pin == "" {
+		if uv != libfido2.True || a.Biometric {
+			return nil
+		}
+		if a.PIN == "" {
+			return libfido2.ErrPinNotSet
+		}
+		return libfido2.ErrPinRequired
+	}
+
+	if a.PIN == "" {
+		return libfido2.ErrPinNotSet
+	}
+	if a.retries == 0 {
+		return libfido2.ErrPinAuthBlocked
+	}
+	if !hmac.Equal([]byte(pin), []byte(a.PIN)) {
+		a.retries--
+		return libfido2.ErrPinInvalid
+	}
+	a.retries = softwarePINRetries
+	return nil
+}
+
+// deriveCredRandom derives the CredRandom for a credential nonce.
+func (a *SoftwareAuthenticator) deriveCredRandom(nonce []byte) []byte {
+	mac := hmac.New(sha256.New, a.deriveKey("cred-random"))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// deriveKey derives a 32-byte key for the purpose from the seed.
+func (a *SoftwareAuthenticator) deriveKey(purpose string) []byte {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, a.seed, nil, []byte("fidokit-software-authenticator:"+purpose)), key)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// hmacSecretOutput computes the hmac-secret extension output for one or two salts.
+func hmacSecretOutput(credRandom, salts []byte) []byte {
+	var out []byte
+	for salt := range slices.Chunk(salts, 32) {
+		mac := hmac.New(sha256.New, credRandom)
+		mac.Write(salt)
+		out = mac.Sum(out)
+	}
+	return out
+}
+
+func rpIDHash(rpID string) []byte {
+	hash := sha256.Sum256([]byte(rpID))
+	return hash[:]
+}
+
+func optionValue(b bool) libfido2.OptionValue {
+	if b {
+		return libfido2.True
+	}
+	return libfido2.False
+}
+
+// SoftwareProvider is a Provider for SoftwareAuthenticators which
+// can be connected and disconnected to simulate plugging in keys.
+type SoftwareProvider struct {
+	// Choose is called to simulate the user touching one of several
+	// connected authenticators. When nil, the first one is chosen.
+	Choose func(auths []Authenticator) (Authenticator, error)
+
+	connected []*SoftwareAuthenticator
+	mu        sync.Mutex
+}
+
+// Connect simulates plugging in the authenticators.
+func (p *SoftwareProvider) Connect(auths ...*SoftwareAuthenticator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, auth := range auths {
+		if !slices.Contains(p.connected, auth) {
+			p.connected = append(p.connected, auth)
+		}
+	}
+}
+
+// Disconnect simulates unplugging the authenticators.
+func (p *SoftwareProvider) Disconnect(auths ...*SoftwareAuthenticator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.connected = slices.DeleteFunc(p.connected, func(a *SoftwareAuthenticator) bool {
+		return slices.Contains(auths, a)
+	})
+}
+
+func (p *SoftwareProvider) Locations() ([]*libfido2.DeviceLocation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	locs := make([]*libfido2.DeviceLocation, len(p.connected))
+	for i, auth := range p.connected {
+		locs[i] = &libfido2.DeviceLocation{
+			Path:         auth.Path(),
+			Manufacturer: "fidokit",
+			Product:      auth.Name,
+		}
+	}
+	return locs, nil
+}
+
+func (p *SoftwareProvider) Open(path string) (Authenticator, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, auth := range p.connected {
+		if auth.Path() == path {
+			return auth, nil
+		}
+	}
+	return nil, ErrNoDevice
+}
+
+func (p *SoftwareProvider) Select(auths []Authenticator, timeout time.Duration) (Authenticator, error) {
+	if len(auths) == 0 {
+		return nil, ErrNoDevice
+	}
+	if p.Choose != nil {
+		return p.Choose(auths)
+	}
+	return auths[0], nil
+}
@@ -0,0 +1,83 @@
+package fidoutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/keys-pub/go-libfido2"
+)
+
+func makeTestCredential(t *testing.T, auth *SoftwareAuthenticator, rpID string) []byte {
+	t.Helper()
+	cdh := sha256.Sum256([]byte("client data"))
+	att, err := auth.MakeCredential(cdh[:], libfido2.RelyingParty{ID: rpID}, libfido2.User{ID: []byte{1}, Name: "user"}, libfido2.ES256, auth.PIN, nil)
+	if err != nil {
+		t.Fatalf("make credential: %v", err)
+	}
+	return att.CredentialID
+}
+
+func hmacSecret(auth *SoftwareAuthenticator, rpID string, credID, salt []byte) ([]byte, error) {
+	cdh := sha256.Sum256([]byte("client data"))
+	assertion, err := auth.Assertion(rpID, cdh[:], [][]byte{credID}, auth.PIN, &libfido2.AssertionOpts{
+		Extensions: []libfido2.Extension{libfido2.HMACSecretExtension},
+		HMACSalt:   salt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return assertion.HMACSecret, nil
+}
+
+func TestSoftwareHMACSecret(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, 32)
+	auth := NewSoftwareAuthenticator("a", seed, "1234")
+	credID := makeTestCredential(t, auth, "fidokit")
+	salt := bytes.Repeat([]byte{2}, 32)
+
+	first, err := hmacSecret(auth, "fidokit", credID, salt)
+	if err != nil {
+		t.Fatalf("assertion: %v", err)
+	}
+	again, err := hmacSecret(NewSoftwareAuthenticator("a", seed, "1234"), "fidokit", credID, salt)
+	if err != nil {
+		t.Fatalf("assertion with the same seed: %v", err)
+	}
+	if !bytes.Equal(first, again) {
+		t.Errorf("the same seed, credential and salt gave different secrets")
+	}
+
+	other, err := hmacSecret(auth, "fidokit", credID, bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatalf("assertion with another salt: %v", err)
+	}
+	if bytes.Equal(first, other) {
+		t.Errorf("different salts gave the same secret")
+	}
+
+	_, err = hmacSecret(auth, "example.com", credID, salt)
+	if !errors.Is(err, libfido2.ErrNoCredentials) {
+		t.Errorf("assertion for another rp: got %v, want %v", err, libfido2.ErrNoCredentials)
+	}
+	_, err = hmacSecret(NewSoftwareAuthenticator("b", bytes.Repeat([]byte{4}, 32), "1234"), "fidokit", credID, salt)
+	if !errors.Is(err, libfido2.ErrNoCredentials) {
+		t.Errorf("assertion with another authenticator: got %v, want %v", err, libfido2.ErrNoCredentials)
+	}
+}
+
+func TestSoftwarePINRetries(t *testing.T) {
+	auth := NewSoftwareAuthenticator("a", bytes.Repeat([]byte{1}, 32), "1234")
+	for range softwarePINRetries {
+		err := auth.verifyUser("0000", libfido2.True)
+		if !errors.Is(err, libfido2.ErrPinInvalid) {
+			t.Fatalf("wrong PIN: got %v, want %v", err, libfido2.ErrPinInvalid)
+		}
+	}
+
+	err := auth.verifyUser("1234", libfido2.True)
+	if !errors.Is(err, libfido2.ErrPinAuthBlocked) {
+		t.Errorf("correct PIN after too many retries: got %v, want %v", err, libfido2.ErrPinAuthBlocked)
+	}
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func PrintConnectedDevices() {
-	locs, err := libfido2.DeviceLocations()
+	locs, err := Devices.Locations()
 	if err != nil {
 		fmt.Println("Error getting devices:", err)
 		return
@@ -25,7 +25,7 @@ func PrintConnectedDevices() {
 }
 
 func GetConnectedDeviceCount() int {
-	locs, err := libfido2.DeviceLocations()
+	locs, err := Devices.Locations()
 	if err != nil {
 		log.Fatalln("device locations:", err)
 	}
@@ -36,15 +36,15 @@ func FormatDeviceName(dev *libfido2.DeviceLocation) string {
 	return fmt.Sprintf("[%s:%d] %s (%d)", dev.Manufacturer, dev.VendorID, dev.Product, dev.ProductID)
 }
 
-// Returns a list of devices based on libfido2.DeviceLocations()
-func fido2GetDevices() ([]*libfido2.Device, error) {
-	locs, err := libfido2.DeviceLocations()
+// ConnectedDevices opens every device returned by Devices.Locations().
+func ConnectedDevices() ([]Authenticator, error) {
+	locs, err := Devices.Locations()
 	if err != nil {
 		return nil, fmt.Errorf("getting device locations: %w", err)
 	}
-	devs := make([]*libfido2.Device, len(locs))
+	devs := make([]Authenticator, len(locs))
 	for i, loc := range locs {
-		dev, err := libfido2.NewDevice(loc.Path)
+		dev, err := Devices.Open(loc.Path)
 		if err != nil {
 			return nil, fmt.Errorf("creating new device: %w", err)
 		}
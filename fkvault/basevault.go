@@ -1,11 +1,20 @@
 package fkvault
 
 import (
-	"encoding/json"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/keys-pub/go-libfido2"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"fidokit/codec"
+	"fidokit/crypto"
 	"fidokit/fidoutils"
+	"fidokit/prompt"
 	"fidokit/utils"
 )
 
@@ -14,9 +23,10 @@ type Type string
 const (
 	TypeSimple Type = "simple"
 	TypeShamir Type = "shamir"
+	TypePolicy Type = "policy"
 )
 
-var Types = []Type{TypeSimple, TypeShamir}
+var Types = []Type{TypeSimple, TypeShamir, TypePolicy}
 
 var ErrInvalidVersion = fmt.Errorf("invalid vault version")
 
@@ -35,21 +45,46 @@ type BaseVault struct {
 	// Description is additional text in any format to provide information about the vault.
 	Description string `json:"description,omitempty"`
 
-	// ClientDataHashText is the hash passed into each operation.
+	// ClientDataHashText is the value hashed using SHA256 and passed into each operation.
+	// It is randomly generated for each vault.
 	ClientDataHashText string `json:"client_data_hash"`
 	// AssertionSaltText is the value hashed using SHA256 and passed into the assertion to generate a reproducible result.
+	// It is randomly generated for each vault, so that each vault derives different secrets from the same credential.
+	// It is shared by all headers, since a single assertion is made using the credentials of every header.
 	AssertionSaltText string `json:"salt"`
 
 	// RPID is the relying party ID.
 	RPID string `json:"rp_id"`
+	// RPName is the name of the relying party given to new credentials. If it is empty, the default is used.
+	RPName string `json:"rp_name,omitempty"`
+	// User is the name of the user entity given to new credentials. If it is empty, the default is used.
+	User string `json:"user,omitempty"`
+	// Resident indicates that new credentials are resident, storing the data needed
+	// to recover the vault on each key. Only unencrypted simple vaults support it.
+	Resident bool `json:"resident,omitempty"`
 
 	// Encrypted indicates whether the master key is additionally encrypted using another key.
 	Encrypted bool `json:"encrypted"`
 	// EncryptionSalt is the salt used for encrypting the master key.
 	EncryptionSalt []byte `json:"encryption_salt"`
+	// KDF is the algorithm and parameters used to derive the encryption key from
+	// the password. If it is absent from an encrypted vault, crypto.DefaultKDFParams is used.
+	KDF *crypto.KDFParams `json:"kdf,omitempty"`
+
+	// Secrets contains the vault's named secrets, encrypted using a key derived from the master key.
+	// It is absent when the vault has no secrets.
+	Secrets []byte `json:"secrets,omitempty"`
+
+	// Contexts lists the contexts which subkeys have been derived for, when they were recorded.
+	// Only the contexts are recorded, never the subkeys.
+	Contexts []string `json:"contexts,omitempty"`
 
 	// Metadata contains meta-information about the vault.
 	Metadata Metadata `json:"metadata"`
+
+	// MAC authenticates the vault's contents using a key derived from the master key.
+	// It is absent from vaults without any headers, and from version 0 vaults.
+	MAC []byte `json:"mac,omitempty"`
 }
 
 // VaultHeader holds parameters used with FIDO2 devices to facilitate
@@ -61,6 +96,9 @@ type BaseVault struct {
 //  2. Use the derived key with XChaCha20+Poly1305 to decrypt the key.
 //  3. Use the key (for a regular vault) or the share (for a Shamir vault)
 //     to decrypt the vault itself. For Shamir vaults, K of N is required.
+//
+// The header of a Shamir vault share may instead hold a share protected by a
+// passphrase, or describe a share recorded on paper. See ShareKind.
 type VaultHeader struct {
 	// Name is the user-provided name for the entry, used to identify it later.
 	Name string `json:"name"`
@@ -69,6 +107,41 @@ type VaultHeader struct {
 	// EncryptedKey contains either the master key of the parent vault in the case of typical vaults or the
 	// Shamir share portion for Shamir-based vaults. It is encrypted using the key derived from the assertion.
 	EncryptedKey []byte `json:"encrypted_key"`
+	// Bound indicates that EncryptedKey is bound to the vault and to this header using associated data.
+	// Headers created before version 2 are not bound, since rebinding them requires their security key.
+	Bound bool `json:"bound,omitempty"`
+
+	// Kind is the kind of a Shamir vault share, or SharePassphrase for the password
+	// leaves of a policy vault. It is empty for headers protected by a FIDO2 credential.
+	Kind ShareKind `json:"kind,omitempty"`
+	// Salt and KDF are used to derive the key for a passphrase share from its passphrase.
+	Salt []byte            `json:"salt,omitempty"`
+	KDF  *crypto.KDFParams `json:"kdf,omitempty"`
+	// Digest is a MAC of the header keyed using a paper share, which is not
+	// stored in the vault, so that an incorrect share is detected when it is entered.
+	Digest []byte `json:"digest,omitempty"`
+}
+
+// associatedData returns the data which binds an encrypted key to the vault and
+// to the header holding it, identified by its key in the vault: the name of a
+// simple vault header, or the index of a Shamir vault share. Moving an encrypted
+// key to another header or vault makes it fail to decrypt. Unbound headers have none.
+func (v *BaseVault) associatedData(key string, h *VaultHeader) []byte {
+	if !h.Bound {
+		return nil
+	}
+
+	var w authWriter
+	w.string("fidokit header")
+	w.string(v.ID)
+	w.string(string(v.Type))
+	w.string(key)
+	w.bytes(h.CredentialID)
+	if h.Kind != ShareFIDO2 {
+		// only written for other kinds, so that the binding of FIDO2 shares is unchanged
+		w.string(string(h.Kind))
+	}
+	return w.buf.Bytes()
 }
 
 func newBase(typ Type, created time.Time, name, description string) *BaseVault {
@@ -78,8 +151,8 @@ func newBase(typ Type, created time.Time, name, description string) *BaseVault {
 		Type:               typ,
 		Name:               name,
 		Description:        description,
-		ClientDataHashText: fidoutils.ClientDataHashText,
-		AssertionSaltText:  fidoutils.AssertionSaltText,
+		ClientDataHashText: hex.EncodeToString(utils.RandomBytes(32)),
+		AssertionSaltText:  hex.EncodeToString(utils.RandomBytes(32)),
 		RPID:               fidoutils.RelyingParty.ID,
 		Metadata: Metadata{
 			Created:  created,
@@ -88,36 +161,330 @@ func newBase(typ Type, created time.Time, name, description string) *BaseVault {
 	}
 }
 
-// ParseJSON takes in a Vault in JSON format, then parses it into
-// a SimpleVault or ShamirVault, depending on the type field.
-// The vault's version is also considered during parsing.
-func ParseJSON(data []byte) (any, error) {
-	var container struct {
-		Type    Type `json:"type"`
-		Version int  `json:"version"`
+// passwordKey derives the key used for the password layer from the
+// vault encryption password, or returns nil if it is not encrypted.
+func (v *BaseVault) passwordKey(src Sources) ([]byte, error) {
+	if !v.Encrypted {
+		return nil, nil
+	}
+	if src.Password == nil {
+		return nil, ErrNoPassword
+	}
+
+	pass, err := src.Password()
+	if err != nil {
+		return nil, fmt.Errorf("get password: %w", err)
+	}
+	return v.kdfParams().Key(pass, v.EncryptionSalt)
+}
+
+// kdfParams returns the parameters used to derive the password key.
+func (v *BaseVault) kdfParams() crypto.KDFParams {
+	if v.KDF == nil {
+		return crypto.DefaultKDFParams
+	}
+	return *v.KDF
+}
+
+// rewrap replaces the password layer of each of the headers using a new salt and
+// the parameters, in place. The headers are left unchanged if any cannot be rewrapped.
+func (v *BaseVault) rewrap(headers []*VaultHeader, params crypto.KDFParams, src Sources) error {
+	if !v.Encrypted {
+		return ErrNotEncrypted
+	}
+
+	oldKey, err := v.passwordKey(src)
+	if err != nil {
+		return err
+	}
+	pass, err := src.Password()
+	if err != nil {
+		return fmt.Errorf("get password: %w", err)
+	}
+	salt := utils.RandomBytes(16)
+	newKey, err := params.Key(pass, salt)
+	if err != nil {
+		return err
+	}
+
+	oldAEAD, err := chacha20poly1305.New(oldKey)
+	if err != nil {
+		return fmt.Errorf("create aead: %w", err)
+	}
+	newAEAD, err := chacha20poly1305.New(newKey)
+	if err != nil {
+		return fmt.Errorf("create aead: %w", err)
+	}
+
+	encryptedKeys := make([][]byte, len(headers))
+	for i, h := range headers {
+		inner, err := crypto.DecryptChaCha20(oldAEAD, h.EncryptedKey, nil)
+		if err != nil {
+			return ErrWrongPassword
+		}
+		encryptedKeys[i], err = crypto.EncryptChaCha20(newAEAD, inner, nil)
+		if err != nil {
+			return fmt.Errorf("encrypt key: %w", err)
+		}
+	}
+
+	for i, h := range headers {
+		h.EncryptedKey = encryptedKeys[i]
+	}
+	v.EncryptionSalt = salt
+	v.KDF = &params
+	v.Metadata.Modified = time.Now().UTC()
+	return nil
+}
+
+// sealKey encrypts a key (the master key or a share) for a header using the
+// key derived from the header's credential and the associated data for the
+// header, then adds the password layer on the outside using the password key
+// if the vault is encrypted. The password layer does not bind the associated
+// data, since anyone with the password could simply reseal it.
+func (v *BaseVault) sealKey(derivedKey, passwordKey, key, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(derivedKey)
+	if err != nil {
+		return nil, fmt.Errorf("create aead: %w", err)
+	}
+	encryptedKey, err := crypto.EncryptChaCha20(aead, key, ad)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt key: %w", err)
+	}
+
+	// transparent encrypt master key
+	if v.Encrypted {
+		aead, err = chacha20poly1305.New(passwordKey)
+		if err != nil {
+			return nil, fmt.Errorf("create aead: %w", err)
+		}
+		encryptedKey, err = crypto.EncryptChaCha20(aead, encryptedKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt key: %w", err)
+		}
+	}
+	return encryptedKey, nil
+}
+
+// openKey reverses sealKey, removing the password layer first.
+func (v *BaseVault) openKey(derivedKey, passwordKey, encryptedKey, ad []byte) ([]byte, error) {
+	// transparent decrypt master key
+	if v.Encrypted {
+		aead, err := chacha20poly1305.New(passwordKey)
+		if err != nil {
+			return nil, fmt.Errorf("create aead: %w", err)
+		}
+		encryptedKey, err = crypto.DecryptChaCha20(aead, encryptedKey, nil)
+		if err != nil {
+			return nil, ErrWrongPassword
+		}
+	}
+
+	aead, err := chacha20poly1305.New(derivedKey)
+	if err != nil {
+		return nil, fmt.Errorf("create aead: %w", err)
+	}
+	key, err := crypto.DecryptChaCha20(aead, encryptedKey, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return key, nil
+}
+
+// fidoParams returns the values used by the vault for its credentials and
+// hmac-secret derivation. Vaults created before they were randomly generated
+// store the same values as fidoutils.DefaultParams.
+func (v *BaseVault) fidoParams() fidoutils.Params {
+	p := fidoutils.NewParams(v.RPID, v.ClientDataHashText, v.AssertionSaltText)
+	p.RPName = v.RPName
+	p.UserName = v.User
+	return p
+}
+
+// enroll creates a new credential on the authenticator, then derives
+// the key used to encrypt the header associated with the credential.
+func (v *BaseVault) enroll(ctx context.Context, auth fidoutils.Authenticator, src Sources) (credID, derivedKey []byte, err error) {
+	pin, err := src.pin(auth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = src.touch(ctx, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	cred, err := fidoutils.MakeCredential(auth, pin, v.fidoParams())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = src.touch(ctx, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	assertion, err := fidoutils.Assertion(auth, pin, [][]byte{cred.CredentialID}, v.fidoParams())
+	if err != nil {
+		return nil, nil, err
+	}
+	return cred.CredentialID, assertion.HMACSecret, nil
+}
+
+// derive derives the key used to encrypt the header associated with whichever
+// of the credentials is held by the authenticator, returning its credential ID.
+func (v *BaseVault) derive(ctx context.Context, auth fidoutils.Authenticator, src Sources, credIDs [][]byte) (credID, derivedKey []byte, err error) {
+	pin, err := src.pin(auth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = src.touch(ctx, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	assertion, err := fidoutils.Assertion(auth, pin, credIDs, v.fidoParams())
+	if errors.Is(err, libfido2.ErrNoCredentials) {
+		return nil, nil, ErrNotEnrolled
 	}
-	err := json.Unmarshal(data, &container)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse vault type: %w", err)
+		return nil, nil, err
 	}
+	return assertion.CredentialID, assertion.HMACSecret, nil
+}
 
-	if container.Version < 0 || container.Version > 1 {
-		return nil, ErrInvalidVersion
+func (src Sources) pin(auth fidoutils.Authenticator) (string, error) {
+	if src.PIN == nil {
+		return "", nil
 	}
 
-	var vault any
-	switch container.Type {
-	case TypeSimple:
-		vault = &SimpleVault{}
-	case TypeShamir:
-		vault = &ShamirVault{}
-	default:
-		return nil, fmt.Errorf("unknown vault type: %s", container.Type)
+	pin, err := src.PIN(auth)
+	if err != nil {
+		return "", fmt.Errorf("get pin: %w", err)
 	}
+	return pin, nil
+}
 
-	err = json.Unmarshal(data, &vault)
+func (src Sources) touch(ctx context.Context, auth fidoutils.Authenticator) error {
+	err := ctx.Err()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse vault: %w", err)
+		return err
+	}
+
+	if src.Touch != nil {
+		src.Touch(auth)
 	}
-	return vault, nil
+	return nil
+}
+
+// interactiveSources prompts for secrets on the terminal as they are needed.
+// The password is only requested once. If newPassword is set, the user is
+// asked to set a new password instead, which they must enter twice.
+func interactiveSources(newPassword bool) Sources {
+	return Sources{
+		PIN: fidoutils.InteractiveGetPIN,
+		Password: sync.OnceValues(func() ([]byte, error) {
+			if !newPassword {
+				pass, err := prompt.AskNonEmptySecret(Prompter, "Vault is encrypted. Enter the vault encryption password: ")
+				return []byte(pass), err
+			}
+
+			for {
+				pass, err := prompt.AskNonEmptySecret(Prompter, "Please enter a new vault encryption password: ")
+				if err != nil {
+					return nil, err
+				}
+				confirm, err := Prompter.AskSecret("Confirm the new vault encryption password: ")
+				if err != nil {
+					return nil, err
+				}
+				if pass == confirm {
+					return []byte(pass), nil
+				}
+				Prompter.Notify("The passwords do not match. Try again.")
+			}
+		}),
+		Touch: func(fidoutils.Authenticator) {
+			Prompter.Notify("Tap your security key.")
+		},
+	}
+}
+
+// waitForKeys asks the user to press ENTER once they have inserted a key,
+// unless assumptions are permitted and at least n keys are connected.
+func waitForKeys(message string, n int) error {
+	if MakeAssumptions && fidoutils.GetConnectedDeviceCount() >= n {
+		return nil
+	}
+
+	_, err := Prompter.AskText(message)
+	return err
+}
+
+// interactiveMasterKey imports a master key from KeySource, or prompts for one
+// to import, randomly generating one if the user leaves it blank.
+func interactiveMasterKey() ([]byte, error) {
+	if KeySource != nil {
+		masterKey, err := KeySource()
+		if err != nil {
+			return nil, fmt.Errorf("import master key: %w", err)
+		}
+		Prompter.Notify("Master key imported.")
+		return masterKey, nil
+	}
+
+	format := KeyFormat
+	if !format.Text() || format == codec.QR {
+		format = codec.Hex
+	}
+	encoded, err := Prompter.AskSecret(fmt.Sprintf("Enter a master key (%s), or leave blank to randomly generate one: ", format))
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) > 0 {
+		return codec.DecodeKey(format, []byte(encoded))
+	}
+
+	masterKey := utils.RandomBytes(32)
+	shown, err := codec.Encode(KeyFormat, masterKey)
+	if err != nil || !KeyFormat.Text() {
+		shown = []byte(hex.EncodeToString(masterKey))
+	}
+	if KeyFormat == codec.QR {
+		Prompter.Notify("Master Key (qr):\n" + string(shown))
+	} else {
+		Prompter.Notify("Master Key: " + string(shown))
+	}
+	return masterKey, nil
+}
+
+// interactiveEncryption asks the user whether to encrypt the vault with a password.
+// Vaults with resident credentials cannot be encrypted, so they are not asked.
+func (v *BaseVault) interactiveEncryption() error {
+	if v.Resident {
+		return nil
+	}
+
+	enableEncryption, err := Prompter.Confirm("Do you want to encrypt the master key with a password?", false)
+	if err != nil {
+		return err
+	}
+
+	v.Encrypted = enableEncryption
+	v.EncryptionSalt = nil
+	v.KDF = nil
+	if enableEncryption {
+		params := crypto.DefaultKDFParams
+		v.EncryptionSalt = utils.RandomBytes(16)
+		v.KDF = &params
+	}
+	return nil
+}
+
+// ParseJSON takes in a Vault in JSON format, then parses it into
+// a SimpleVault or ShamirVault, depending on the type field.
+// Vaults in the format of an older version are decoded using the
+// decoders for their version, but they are not upgraded until
+// Upgrade is called with the master key.
+func ParseJSON(data []byte) (any, error) {
+	vault, _, err := decode(data)
+	return vault, err
 }
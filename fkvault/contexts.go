@@ -0,0 +1,30 @@
+package fkvault
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// RecordContext adds the context to the derivation contexts recorded in a
+// *SimpleVault or *ShamirVault, then authenticates the vault using its master
+// key. It returns false without changing the vault if it was already recorded.
+func RecordContext(vault any, masterKey []byte, context string) (bool, error) {
+	base := baseOf(vault)
+	if base == nil {
+		return false, fmt.Errorf("unknown vault type: %T", vault)
+	}
+	err := Verify(vault, masterKey)
+	if err != nil {
+		return false, err
+	}
+	if slices.Contains(base.Contexts, context) {
+		return false, nil
+	}
+
+	base.Contexts = append(base.Contexts, context)
+	slices.Sort(base.Contexts)
+	authenticateAny(vault, masterKey)
+	base.Metadata.Modified = time.Now().UTC()
+	return true, nil
+}
@@ -1,15 +1,34 @@
 package fkvault
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
+
+	"fidokit/codec"
+	"fidokit/crypto"
+	"fidokit/fidoutils"
+	"fidokit/prompt"
+	"fidokit/utils"
 )
 
-const CurrentVaultVersion = 0
+const CurrentVaultVersion = 6
 
 var Debug bool
 
+// Prompter is used by interactive operations to ask the user for input.
+var Prompter prompt.Prompter = prompt.Stdio
+
+// KeyFormat is the format in which master keys are entered when importing
+// them, and shown when they are generated. Only text formats can be entered.
+var KeyFormat = codec.Hex
+
+// KeySource, if set, provides the master key to import when creating a vault,
+// instead of prompting for it.
+var KeySource func() ([]byte, error)
+
 // MakeAssumptions will forego prompting the user to press ENTER after
 // inserting a key for the next step, if and only if there are multiple
 // keys connected (SimpleVault unlock/create = 1; SimpleVault add = 2+;
@@ -26,6 +45,89 @@ var ErrNoHeader = errors.New("no header")
 // been initialized, but an attempt is made to unlock it.
 var ErrNotInitialized = errors.New("vault is not initialized")
 
+// ErrAlreadyInitialized is returned when an operation which may only be
+// performed on a vault without any headers is attempted on one with headers.
+var ErrAlreadyInitialized = errors.New("vault is already initialized")
+
+// ErrHeaderExists is returned when adding a header with a name already in use.
+var ErrHeaderExists = errors.New("header already exists")
+
+// ErrNotEnrolled is returned when an authenticator holds none of the vault's credentials.
+var ErrNotEnrolled = errors.New("key is not enrolled in the vault")
+
+// ErrNotEnoughShares is returned when fewer than K shares could be recovered.
+var ErrNotEnoughShares = errors.New("not enough shares to unlock the vault")
+
+// ErrInvalidThreshold is returned when K and N do not satisfy 2 <= K <= N <= 255.
+var ErrInvalidThreshold = errors.New("invalid k and/or n")
+
+// ErrVaultFull is returned when adding a share to a Shamir vault which already has 255 shares.
+var ErrVaultFull = errors.New("vault already has the maximum number of shares")
+
+// ErrWrongKeyCount is returned when the number of keys provided does not match N.
+var ErrWrongKeyCount = errors.New("number of keys does not match n")
+
+// ErrNoPassword is returned when a vault is encrypted, but no password was provided.
+var ErrNoPassword = errors.New("vault is encrypted, but no password was provided")
+
+// ErrWrongPassword is returned when the vault encryption password is incorrect.
+var ErrWrongPassword = errors.New("incorrect vault encryption password")
+
+// ErrNotEncrypted is returned when changing the password layer of a vault which has none.
+var ErrNotEncrypted = errors.New("vault is not encrypted")
+
+// ErrDecrypt is returned when a key cannot be decrypted using a valid
+// credential, which indicates that the vault has been corrupted.
+var ErrDecrypt = errors.New("failed to decrypt key")
+
+// PINSource returns the PIN to use for user verification with the
+// authenticator, or an empty string if it performs verification itself.
+type PINSource func(auth fidoutils.Authenticator) (string, error)
+
+// PasswordSource returns the vault encryption password.
+type PasswordSource func() ([]byte, error)
+
+// Sources supplies the secrets which vault operations need on demand.
+type Sources struct {
+	// PIN is called before each operation performed with an authenticator.
+	PIN PINSource
+	// Password is called when the vault is encrypted. It may be nil otherwise.
+	Password PasswordSource
+	// Touch is called before each operation which requires the user
+	// to touch the authenticator to confirm presence. It may be nil.
+	Touch func(auth fidoutils.Authenticator)
+}
+
+// Options describes a new vault to be created using Create.
+type Options struct {
+	// Type is the type of vault to create.
+	Type Type
+	// Name is a descriptive name in any format to identify the vault.
+	Name string
+	// Description is additional text in any format to provide information about the vault.
+	Description string
+	// K is the number of shares required to unlock a Shamir vault.
+	K byte
+	// N is the total number of shares in a Shamir vault.
+	N byte
+	// Policy is the policy of a policy vault.
+	Policy *PolicyNode
+	// Encrypted enables an additional password layer around each header.
+	Encrypted bool
+	// KDF is used to derive the key for the password layer from the password.
+	// If it is nil, crypto.DefaultKDFParams is used.
+	KDF *crypto.KDFParams
+	// RPID is the relying party ID of the vault's credentials. If it is empty, the default is used.
+	RPID string
+	// RPName is the name of the relying party. If it is empty, the default is used.
+	RPName string
+	// User is the name of the user entity. If it is empty, the default is used.
+	User string
+	// Resident creates resident credentials, from which each key can recover the
+	// vault without the vault file. Only unencrypted simple vaults support it.
+	Resident bool
+}
+
 type Metadata struct {
 	Created  time.Time `json:"created"`
 	Modified time.Time `json:"modified"`
@@ -38,3 +140,91 @@ func GetVaultInfo(data []byte) (typ string, version int, err error) {
 	}
 	return t.Type, t.Version, json.Unmarshal(data, &t)
 }
+
+// Create creates a new, empty *SimpleVault, *ShamirVault or *PolicyVault.
+func Create(opts Options) (any, error) {
+	var vault any
+	var base *BaseVault
+	switch opts.Type {
+	case TypeSimple:
+		v := NewSimple(opts.Name, opts.Description)
+		vault, base = v, v.BaseVault
+	case TypeShamir:
+		if opts.K < 2 || opts.N < opts.K {
+			return nil, ErrInvalidThreshold
+		}
+		v := NewShamir(opts.Name, opts.Description, opts.K, opts.N)
+		vault, base = v, v.BaseVault
+	case TypePolicy:
+		if opts.Policy == nil {
+			return nil, fmt.Errorf("%w: a policy is required", ErrInvalidPolicy)
+		}
+		err := opts.Policy.Validate()
+		if err != nil {
+			return nil, err
+		}
+		if opts.Encrypted {
+			return nil, ErrPolicyEncrypted
+		}
+		v := NewPolicy(opts.Name, opts.Description, opts.Policy)
+		vault, base = v, v.BaseVault
+	default:
+		return nil, fmt.Errorf("unknown vault type: %s", opts.Type)
+	}
+
+	if opts.RPID != "" {
+		err := fidoutils.ValidateRPID(opts.RPID)
+		if err != nil {
+			return nil, err
+		}
+		base.RPID = opts.RPID
+	}
+	base.RPName = opts.RPName
+	base.User = opts.User
+
+	if opts.Resident && (opts.Type != TypeSimple || opts.Encrypted) {
+		return nil, ErrResidentUnsupported
+	}
+	base.Resident = opts.Resident
+
+	if opts.Encrypted {
+		params := crypto.DefaultKDFParams
+		if opts.KDF != nil {
+			params = *opts.KDF
+		}
+		err := params.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		base.Encrypted = true
+		base.EncryptionSalt = utils.RandomBytes(16)
+		base.KDF = &params
+	}
+	return vault, nil
+}
+
+// Unlock recovers the master key of a *SimpleVault, *ShamirVault or *PolicyVault
+// using the authenticators, which must all be connected. Policy vaults are
+// only unlocked this way by policies which can be satisfied by keys alone.
+// The master key of a version 0 vault is returned along with ErrUnverified,
+// since it cannot be verified; such vaults should be migrated before use.
+func Unlock(ctx context.Context, vault any, auths []fidoutils.Authenticator, src Sources) ([]byte, error) {
+	switch v := vault.(type) {
+	case *SimpleVault:
+		for _, auth := range auths {
+			masterKey, err := v.Unlock(ctx, auth, src)
+			if errors.Is(err, ErrNotEnrolled) {
+				continue
+			}
+			return masterKey, err
+		}
+		return nil, ErrNotEnrolled
+	case *ShamirVault:
+		return v.Unlock(ctx, auths, src)
+	case *PolicyVault:
+		return v.Unlock(ctx, auths, nil, src)
+	default:
+		return nil, fmt.Errorf("unknown vault type: %T", vault)
+	}
+}
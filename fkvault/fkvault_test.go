@@ -0,0 +1,74 @@
+package fkvault
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"fidokit/crypto"
+	"fidokit/fidoutils"
+	"fidokit/utils"
+)
+
+const testPIN = "1234"
+
+// testKDF is the cheapest valid set of kdf parameters, to keep encrypted vaults fast.
+var testKDF = crypto.KDFParams{
+	Algorithm: crypto.KDFArgon2id,
+	Time:      1,
+	Memory:    8,
+	Threads:   1,
+}
+
+// newAuths creates n software authenticators with distinct seeds and the PIN testPIN.
+func newAuths(n int) []fidoutils.Authenticator {
+	auths := make([]fidoutils.Authenticator, n)
+	for i := range auths {
+		seed := bytes.Repeat([]byte{byte(i + 1)}, 32)
+		auths[i] = fidoutils.NewSoftwareAuthenticator(string(rune('a'+i)), seed, testPIN)
+	}
+	return auths
+}
+
+// testSources answers the PIN of every authenticator with testPIN, and the password with password.
+func testSources(password string) Sources {
+	return Sources{
+		PIN: func(fidoutils.Authenticator) (string, error) {
+			return testPIN, nil
+		},
+		Password: func() ([]byte, error) {
+			return []byte(password), nil
+		},
+	}
+}
+
+// createVault creates an empty vault using the options, encrypting it with testKDF if requested.
+func createVault[V any](t *testing.T, opts Options) V {
+	t.Helper()
+	if opts.Encrypted {
+		opts.KDF = &testKDF
+	}
+	vault, err := Create(opts)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	return vault.(V)
+}
+
+// roundTrip saves the vault as JSON and parses it again, as if it were loaded from disk.
+func roundTrip[V any](t *testing.T, vault V) V {
+	t.Helper()
+	data, err := json.Marshal(vault)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	parsed, err := ParseJSON(data)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return parsed.(V)
+}
+
+func newMasterKey() []byte {
+	return utils.RandomBytes(32)
+}
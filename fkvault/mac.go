@@ -0,0 +1,267 @@
+package fkvault
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"fidokit/crypto"
+)
+
+// ErrModified is returned when the vault MAC does not match its contents,
+// meaning the vault file was changed by something other than fidokit.
+var ErrModified = errors.New("vault was modified outside fidokit")
+
+// ErrUnverified is returned when a version 0 vault is unlocked. Such vaults
+// predate the MAC, so changes made to them outside fidokit cannot be detected
+// until they are migrated, which trusts their contents as they are.
+var ErrUnverified = errors.New("vault predates the vault MAC and cannot be verified until it is migrated")
+
+// authWriter encodes fields unambiguously for the vault MAC.
+// Each field is prefixed with its length.
+type authWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *authWriter) bytes(b []byte) {
+	w.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b))))
+	w.buf.Write(b)
+}
+
+func (w *authWriter) string(s string) {
+	w.bytes([]byte(s))
+}
+
+func (w *authWriter) uint(n uint64) {
+	w.bytes(binary.BigEndian.AppendUint64(nil, n))
+}
+
+func (w *authWriter) bool(b bool) {
+	if b {
+		w.uint(1)
+	} else {
+		w.uint(0)
+	}
+}
+
+func (w *authWriter) header(version int, h *VaultHeader) {
+	w.string(h.Name)
+	w.bytes(h.CredentialID)
+	w.bytes(h.EncryptedKey)
+	if version >= 2 {
+		w.bool(h.Bound)
+	}
+	if h.Kind != ShareFIDO2 {
+		w.string("kind")
+		w.string(string(h.Kind))
+		w.bytes(h.Salt)
+		if h.KDF != nil {
+			w.string("kdf")
+			w.string(h.KDF.Algorithm)
+			w.uint(uint64(h.KDF.Time))
+			w.uint(uint64(h.KDF.Memory))
+			w.uint(uint64(h.KDF.Threads))
+		}
+		w.bytes(h.Digest)
+	}
+}
+
+// writeAuthData encodes every field of the base vault except the
+// metadata timestamps, which do not affect security.
+func (v *BaseVault) writeAuthData(w *authWriter) {
+	w.string("fidokit vault")
+	w.uint(uint64(v.Version))
+	w.string(string(v.Type))
+	w.string(v.ID)
+	w.string(v.Name)
+	w.string(v.Description)
+	w.string(v.ClientDataHashText)
+	w.string(v.AssertionSaltText)
+	w.string(v.RPID)
+	w.bool(v.Encrypted)
+	w.bytes(v.EncryptionSalt)
+	if v.KDF != nil {
+		// only written when present, so that the MAC of vaults without it is unchanged
+		w.string("kdf")
+		w.string(v.KDF.Algorithm)
+		w.uint(uint64(v.KDF.Time))
+		w.uint(uint64(v.KDF.Memory))
+		w.uint(uint64(v.KDF.Threads))
+	}
+	// likewise, the relying party name and user are only written when set
+	if v.RPName != "" {
+		w.string("rp_name")
+		w.string(v.RPName)
+	}
+	if v.User != "" {
+		w.string("user")
+		w.string(v.User)
+	}
+	if v.Resident {
+		w.string("resident")
+	}
+	if v.Secrets != nil {
+		w.string("secrets")
+		w.bytes(v.Secrets)
+	}
+	if v.Contexts != nil {
+		w.string("contexts")
+		w.uint(uint64(len(v.Contexts)))
+		for _, c := range v.Contexts {
+			w.string(c)
+		}
+	}
+}
+
+func (v *SimpleVault) authData() []byte {
+	var w authWriter
+	v.writeAuthData(&w)
+	w.uint(uint64(len(v.Headers)))
+	for _, name := range slices.Sorted(maps.Keys(v.Headers)) {
+		w.string(name)
+		w.header(v.Version, v.Headers[name])
+	}
+	return w.buf.Bytes()
+}
+
+func (v *ShamirVault) authData() []byte {
+	var w authWriter
+	v.writeAuthData(&w)
+	w.uint(uint64(v.K))
+	w.uint(uint64(v.N))
+	w.uint(uint64(v.Generation))
+	w.uint(uint64(len(v.Shares)))
+	for _, index := range slices.Sorted(maps.Keys(v.Shares)) {
+		w.uint(uint64(index))
+		w.header(v.Version, v.Shares[index])
+	}
+	return w.buf.Bytes()
+}
+
+func (v *PolicyVault) authData() []byte {
+	var w authWriter
+	v.writeAuthData(&w)
+	v.Policy.walk("", func(path string, n *PolicyNode) {
+		w.string(path)
+		w.string(string(n.Type))
+		w.uint(uint64(n.K))
+		w.uint(uint64(len(n.Children)))
+		w.string(n.Name)
+		w.bool(n.Header != nil)
+		if n.Header != nil {
+			w.header(v.Version, n.Header)
+		}
+	})
+	return w.buf.Bytes()
+}
+
+// macKey derives the key used for the vault MAC from the master key.
+func macKey(masterKey []byte) []byte {
+	return crypto.DeriveKey(masterKey, "vault-mac")
+}
+
+// authenticate upgrades the vault to the current version, then computes
+// its MAC. It must be called after every modification to the vault.
+// Vaults without any headers have nothing to protect and have no MAC.
+func (v *BaseVault) authenticate(masterKey []byte, empty bool, authData func() []byte) {
+	v.Version = CurrentVaultVersion
+	v.MAC = nil
+	if !empty {
+		v.MAC = crypto.MAC(macKey(masterKey), authData())
+	}
+}
+
+// verify checks the vault MAC using the master key. Version 0 vaults predate
+// the MAC, so they cannot be verified, and ErrUnverified is returned instead.
+func (v *BaseVault) verify(masterKey []byte, empty bool, authData func() []byte) error {
+	if empty {
+		return nil
+	}
+	if v.Version == 0 {
+		return ErrUnverified
+	}
+	if !crypto.VerifyMAC(macKey(masterKey), authData(), v.MAC) {
+		return ErrModified
+	}
+	return nil
+}
+
+// Verify checks that the vault has not been modified outside fidokit.
+func (v *SimpleVault) Verify(masterKey []byte) error {
+	return v.verify(masterKey, len(v.Headers) == 0, v.authData)
+}
+
+func (v *SimpleVault) authenticate(masterKey []byte) {
+	v.BaseVault.authenticate(masterKey, len(v.Headers) == 0, v.authData)
+}
+
+// Verify checks that the vault has not been modified outside fidokit.
+func (v *ShamirVault) Verify(masterKey []byte) error {
+	return v.verify(masterKey, len(v.Shares) == 0, v.authData)
+}
+
+func (v *ShamirVault) authenticate(masterKey []byte) {
+	v.BaseVault.authenticate(masterKey, len(v.Shares) == 0, v.authData)
+}
+
+// Verify checks that the vault has not been modified outside fidokit.
+func (v *PolicyVault) Verify(masterKey []byte) error {
+	return v.verify(masterKey, !v.Initialized(), v.authData)
+}
+
+func (v *PolicyVault) authenticate(masterKey []byte) {
+	v.BaseVault.authenticate(masterKey, !v.Initialized(), v.authData)
+}
+
+// Verify checks that a *SimpleVault, *ShamirVault or *PolicyVault has not been
+// modified outside fidokit, using its master key.
+func Verify(vault any, masterKey []byte) error {
+	switch v := vault.(type) {
+	case *SimpleVault:
+		return v.Verify(masterKey)
+	case *ShamirVault:
+		return v.Verify(masterKey)
+	case *PolicyVault:
+		return v.Verify(masterKey)
+	}
+	return fmt.Errorf("unknown vault type: %T", vault)
+}
+
+// CheckVerifiable returns an error unless Verify can check a master key against the
+// vault: ErrNotInitialized for a vault without any keys, which has no MAC, and
+// ErrUnverified for a version 0 vault, which predates the MAC.
+func CheckVerifiable(vault any) error {
+	var empty bool
+	switch v := vault.(type) {
+	case *SimpleVault:
+		empty = len(v.Headers) == 0
+	case *ShamirVault:
+		empty = len(v.Shares) == 0
+	case *PolicyVault:
+		empty = !v.Initialized()
+	default:
+		return fmt.Errorf("unknown vault type: %T", vault)
+	}
+	if empty {
+		return ErrNotInitialized
+	}
+	if baseOf(vault).Version == 0 {
+		return ErrUnverified
+	}
+	return nil
+}
+
+// authenticateAny computes the MAC of a *SimpleVault, *ShamirVault or *PolicyVault.
+func authenticateAny(vault any, masterKey []byte) {
+	switch v := vault.(type) {
+	case *SimpleVault:
+		v.authenticate(masterKey)
+	case *ShamirVault:
+		v.authenticate(masterKey)
+	case *PolicyVault:
+		v.authenticate(masterKey)
+	}
+}
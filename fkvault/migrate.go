@@ -0,0 +1,248 @@
+package fkvault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// migration upgrades vaults from one version to the next. Migrations happen
+// in two parts. When a vault is parsed, decode converts its JSON document to
+// the format of the next version, so that older vaults can be represented by
+// the current structs. When the vault is unlocked, upgrade completes the
+// migration using the master key, after which the vault is re-authenticated.
+type migration struct {
+	// from is the version which the migration upgrades from, to from+1.
+	from int
+	// description summarizes the changes made by the migration.
+	description string
+	// decode converts the document in place, returning a description of
+	// each change it made. It may be nil if the format is unchanged.
+	decode func(doc map[string]json.RawMessage) ([]string, error)
+	// upgrade makes changes which require the master key. It may be nil.
+	upgrade func(vault any, masterKey []byte) error
+}
+
+// migrations is the registry of migrations, indexed by the version they upgrade from.
+// Every version from 0 to CurrentVaultVersion-1 must have exactly one migration.
+var migrations = []migration{
+	{
+		from:        0,
+		description: "add a MAC over the vault contents, keyed from the master key",
+		decode:      decodeV0,
+	},
+	{
+		from:        1,
+		description: "include header binding in the vault MAC; new headers are bound to the vault and header",
+	},
+	{
+		from:        2,
+		description: "allow an encrypted secret store, which older versions of fidokit would discard",
+	},
+	{
+		from:        3,
+		description: "allow a record of the contexts which subkeys were derived for",
+	},
+	{
+		from:        4,
+		description: "allow shamir shares protected by a passphrase or recorded on paper instead of a FIDO2 key",
+	},
+	{
+		from:        5,
+		description: "mark vaults which may have a relying party name, user or resident credentials, which older versions of fidokit would discard",
+	},
+}
+
+func init() {
+	if len(migrations) != CurrentVaultVersion {
+		panic("fkvault: missing vault migrations")
+	}
+	for i, m := range migrations {
+		if m.from != i {
+			panic("fkvault: vault migrations are out of order")
+		}
+	}
+}
+
+// decodeV0 converts the format used by early version 0 vaults, where simple vaults
+// stored their headers as a list and carried unused k and n fields.
+func decodeV0(doc map[string]json.RawMessage) ([]string, error) {
+	var typ Type
+	err := json.Unmarshal(doc["type"], &typ)
+	if err != nil || typ != TypeSimple {
+		return nil, err
+	}
+
+	var changes []string
+	raw, ok := doc["headers"]
+	if ok && bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		var list []*VaultHeader
+		err = json.Unmarshal(raw, &list)
+		if err != nil {
+			return nil, fmt.Errorf("headers: %w", err)
+		}
+
+		headers := map[string]*VaultHeader{}
+		for _, h := range list {
+			if headers[h.Name] != nil {
+				return nil, fmt.Errorf("headers: %w: '%s'", ErrHeaderExists, h.Name)
+			}
+			headers[h.Name] = h
+		}
+		doc["headers"], err = json.Marshal(headers)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, fmt.Sprintf("convert the list of %d headers to a map keyed by name", len(list)))
+	}
+
+	for _, field := range []string{"k", "n"} {
+		if _, ok := doc[field]; ok {
+			delete(doc, field)
+			changes = append(changes, fmt.Sprintf("remove the field '%s', which is unused by simple vaults", field))
+		}
+	}
+	return changes, nil
+}
+
+// decode parses a vault, decoding it from the format of its version,
+// and returns a description of each change made to its format.
+func decode(data []byte) (any, []string, error) {
+	var doc map[string]json.RawMessage
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse vault: %w", err)
+	}
+
+	var container struct {
+		Type    Type `json:"type"`
+		Version int  `json:"version"`
+	}
+	err = json.Unmarshal(data, &container)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse vault type: %w", err)
+	}
+	if container.Version < 0 || container.Version > CurrentVaultVersion {
+		return nil, nil, ErrInvalidVersion
+	}
+
+	var vault any
+	switch container.Type {
+	case TypeSimple:
+		vault = &SimpleVault{}
+	case TypeShamir:
+		vault = &ShamirVault{}
+	case TypePolicy:
+		vault = &PolicyVault{}
+	default:
+		return nil, nil, fmt.Errorf("unknown vault type: %s", container.Type)
+	}
+
+	var changes []string
+	for _, m := range migrations[container.Version:] {
+		if m.decode == nil {
+			continue
+		}
+		c, err := m.decode(doc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decode version %d vault: %w", m.from, err)
+		}
+		changes = append(changes, c...)
+	}
+
+	if len(changes) > 0 {
+		data, err = json.Marshal(doc)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	err = json.Unmarshal(data, vault)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse vault: %w", err)
+	}
+	if v, ok := vault.(*PolicyVault); ok {
+		err = v.validate()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse vault: %w", err)
+		}
+	}
+	return vault, changes, nil
+}
+
+// PlanMigration describes the changes which Upgrade would make to the vault,
+// returning its version and a description of each change, in order.
+// No changes are returned if the vault is already the current version.
+func PlanMigration(data []byte) (int, []string, error) {
+	vault, changes, err := decode(data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	version := baseOf(vault).Version
+	for _, m := range migrations[version:] {
+		changes = append(changes, fmt.Sprintf("version %d to %d: %s", m.from, m.from+1, m.description))
+	}
+	return version, changes, nil
+}
+
+// Upgrade brings a vault created by an older version of fidokit up to
+// the current version using its master key, returning whether it changed.
+// The vault must be saved afterward for the upgrade to persist.
+//
+// Version 0 vaults have no MAC, so they cannot be verified, and ErrUnverified
+// is returned for them instead. They are upgraded using UpgradeUnverified.
+func Upgrade(vault any, masterKey []byte) (bool, error) {
+	return upgrade(vault, masterKey, false)
+}
+
+// UpgradeUnverified is like Upgrade, but also upgrades version 0 vaults, which
+// authenticates their current contents, including any changes made to them
+// outside fidokit. Only use it once the user has confirmed that the vault is
+// genuine.
+func UpgradeUnverified(vault any, masterKey []byte) (bool, error) {
+	return upgrade(vault, masterKey, true)
+}
+
+func upgrade(vault any, masterKey []byte, trust bool) (bool, error) {
+	base := baseOf(vault)
+	if base == nil {
+		return false, fmt.Errorf("unknown vault type: %T", vault)
+	}
+	if base.Version >= CurrentVaultVersion {
+		return false, nil
+	}
+
+	err := Verify(vault, masterKey)
+	if errors.Is(err, ErrUnverified) && trust {
+		err = nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, m := range migrations[base.Version:] {
+		if m.upgrade == nil {
+			continue
+		}
+		err = m.upgrade(vault, masterKey)
+		if err != nil {
+			return false, fmt.Errorf("upgrade version %d vault: %w", m.from, err)
+		}
+	}
+
+	authenticateAny(vault, masterKey)
+	return true, nil
+}
+
+func baseOf(vault any) *BaseVault {
+	switch v := vault.(type) {
+	case *SimpleVault:
+		return v.BaseVault
+	case *ShamirVault:
+		return v.BaseVault
+	case *PolicyVault:
+		return v.BaseVault
+	}
+	return nil
+}
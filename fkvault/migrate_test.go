@@ -0,0 +1,99 @@
+package fkvault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"fidokit/crypto"
+)
+
+func TestUnverifiedVault(t *testing.T) {
+	ctx := context.Background()
+	auths := newAuths(1)
+	src := testSources("")
+	masterKey := newMasterKey()
+
+	vault := createVault[*SimpleVault](t, Options{Type: TypeSimple, Name: "test"})
+	err := vault.AddHeader(ctx, masterKey, auths[0], "first", src)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	err = CheckVerifiable(vault)
+	if err != nil {
+		t.Errorf("check verifiable: %v", err)
+	}
+
+	// a vault whose MAC was removed by downgrading it to version 0
+	vault.Version, vault.MAC = 0, nil
+	err = CheckVerifiable(vault)
+	if !errors.Is(err, ErrUnverified) {
+		t.Errorf("check verifiable: got %v, want %v", err, ErrUnverified)
+	}
+	vault.Name = "renamed"
+
+	got, err := vault.Unlock(ctx, auths[0], src)
+	if !errors.Is(err, ErrUnverified) {
+		t.Fatalf("unlock: got %v, want %v", err, ErrUnverified)
+	}
+	if !bytes.Equal(got, masterKey) {
+		t.Errorf("unlock: wrong master key returned with %v", ErrUnverified)
+	}
+
+	_, err = Upgrade(vault, masterKey)
+	if !errors.Is(err, ErrUnverified) {
+		t.Errorf("upgrade: got %v, want %v", err, ErrUnverified)
+	}
+	err = vault.AddHeader(ctx, masterKey, newAuths(2)[1], "second", src)
+	if !errors.Is(err, ErrUnverified) {
+		t.Errorf("add to unverified vault: got %v, want %v", err, ErrUnverified)
+	}
+
+	upgraded, err := UpgradeUnverified(vault, masterKey)
+	if err != nil || !upgraded {
+		t.Fatalf("upgrade unverified: got %t, %v", upgraded, err)
+	}
+	if vault.Version != CurrentVaultVersion {
+		t.Errorf("upgrade unverified: version %d, want %d", vault.Version, CurrentVaultVersion)
+	}
+	_, err = vault.Unlock(ctx, auths[0], src)
+	if err != nil {
+		t.Errorf("unlock after upgrade: %v", err)
+	}
+}
+
+func TestCheckVerifiableEmpty(t *testing.T) {
+	vault := createVault[*ShamirVault](t, Options{Type: TypeShamir, K: 2, N: 3})
+	err := CheckVerifiable(vault)
+	if !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("check verifiable: got %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	ctx := context.Background()
+	auths := newAuths(3)
+	masterKey := newMasterKey()
+
+	// a vault as it would have been saved by version 1
+	vault := initShamir(t, auths, masterKey, 2, 3, false)
+	vault.Version = 1
+	vault.MAC = crypto.MAC(macKey(masterKey), vault.authData())
+
+	upgraded, err := Upgrade(vault, masterKey)
+	if err != nil || !upgraded {
+		t.Fatalf("upgrade: got %t, %v", upgraded, err)
+	}
+	_, err = vault.Unlock(ctx, auths[:2], testSources(""))
+	if err != nil {
+		t.Errorf("unlock after upgrade: %v", err)
+	}
+
+	vault.Version = 1
+	_, err = Upgrade(vault, masterKey)
+	if !errors.Is(err, ErrModified) {
+		t.Errorf("upgrade with the wrong version: got %v, want %v", err, ErrModified)
+	}
+}
@@ -0,0 +1,478 @@
+package fkvault
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zytekaron/shamir-go"
+)
+
+// NodeType is the type of a node in the policy of a policy vault.
+type NodeType string
+
+const (
+	// NodeAnd requires every one of its children.
+	NodeAnd NodeType = "and"
+	// NodeOr requires any one of its children.
+	NodeOr NodeType = "or"
+	// NodeThreshold requires K of its children.
+	NodeThreshold NodeType = "threshold"
+	// NodeKey is a leaf which requires a FIDO2 key.
+	NodeKey NodeType = "key"
+	// NodePassword is a leaf which requires a password.
+	NodePassword NodeType = "password"
+)
+
+// maxPolicyDepth limits the nesting of policies, which each add a tag to the secrets below them.
+const maxPolicyDepth = 16
+
+// maxPlans limits the number of ways to unlock a vault which are listed, since
+// thresholds over large branches have too many combinations to list.
+const maxPlans = 256
+
+// ErrInvalidPolicy is returned when a policy cannot be parsed or is not well formed.
+var ErrInvalidPolicy = errors.New("invalid policy")
+
+// ErrPolicyNotSatisfied is returned when the available keys and passwords do not satisfy the policy.
+var ErrPolicyNotSatisfied = errors.New("policy is not satisfied by the available keys and passwords")
+
+var leafNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+// PolicyNode is a node in the policy of a policy vault. The secret of each branch is
+// split among its children, down to the leaves, which each encrypt their secret for
+// a FIDO2 key or a password. The secret of the root is the master key.
+type PolicyNode struct {
+	// Type is the type of the node.
+	Type NodeType `json:"type"`
+	// K is the number of children required by a threshold node.
+	K byte `json:"k,omitempty"`
+	// Children are the nodes combined by an and, or or threshold node.
+	Children []*PolicyNode `json:"children,omitempty"`
+	// Name identifies a leaf, and is unique within the policy.
+	Name string `json:"name,omitempty"`
+	// Header holds the encrypted secret of a leaf once it has been enrolled.
+	Header *VaultHeader `json:"header,omitempty"`
+}
+
+// Leaf reports whether the node is a key or password leaf.
+func (n *PolicyNode) Leaf() bool {
+	return n.Type == NodeKey || n.Type == NodePassword
+}
+
+// required returns the number of children needed to recover the secret of a branch.
+func (n *PolicyNode) required() int {
+	switch n.Type {
+	case NodeAnd:
+		return len(n.Children)
+	case NodeThreshold:
+		return int(n.K)
+	}
+	return 1
+}
+
+// ParsePolicy parses a policy expression, in which leaves are written as key:NAME or
+// password:NAME, and branches as and(...), or(...) or Kof(...) for a threshold of K,
+// with their children separated by commas. For example:
+//
+//	and(key:admin, 2of(key:op1, key:op2, key:op3, key:op4))
+//	or(2of(key:alice, key:bob, key:carol), and(key:recovery, password:legal))
+func ParsePolicy(expr string) (*PolicyNode, error) {
+	p := policyParser{text: expr}
+	node, err := p.node(0)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.text) {
+		return nil, p.errorf("unexpected '%s'", p.text[p.pos:])
+	}
+
+	err = node.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+type policyParser struct {
+	text string
+	pos  int
+}
+
+func (p *policyParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: at position %d: %s", ErrInvalidPolicy, p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *policyParser) skipSpace() {
+	for p.pos < len(p.text) && strings.ContainsRune(" \t\r\n", rune(p.text[p.pos])) {
+		p.pos++
+	}
+}
+
+// word reads the next run of characters up to a delimiter.
+func (p *policyParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.text) && !strings.ContainsRune("(),: \t\r\n", rune(p.text[p.pos])) {
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+// consume skips the character c, returning whether it was next.
+func (p *policyParser) consume(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.text) && p.text[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *policyParser) node(depth int) (*PolicyNode, error) {
+	if depth >= maxPolicyDepth {
+		return nil, p.errorf("policies may be nested at most %d deep", maxPolicyDepth)
+	}
+
+	word := strings.ToLower(p.word())
+	switch {
+	case word == string(NodeKey) || word == string(NodePassword):
+		if !p.consume(':') {
+			return nil, p.errorf("expected ':' and a name after '%s'", word)
+		}
+		return &PolicyNode{Type: NodeType(word), Name: p.word()}, nil
+	case word == string(NodeAnd) || word == string(NodeOr):
+		return p.branch(&PolicyNode{Type: NodeType(word)}, depth)
+	case strings.HasSuffix(word, "of"):
+		k, err := strconv.ParseUint(strings.TrimSuffix(word, "of"), 10, 8)
+		if err != nil {
+			return nil, p.errorf("invalid threshold '%s'", word)
+		}
+		return p.branch(&PolicyNode{Type: NodeThreshold, K: byte(k)}, depth)
+	case word == "":
+		return nil, p.errorf("expected a key, password, and, or or Kof")
+	}
+	return nil, p.errorf("unknown node '%s'", word)
+}
+
+func (p *policyParser) branch(node *PolicyNode, depth int) (*PolicyNode, error) {
+	if !p.consume('(') {
+		return nil, p.errorf("expected '(' after '%s'", node.Type)
+	}
+	for {
+		child, err := p.node(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, child)
+		if p.consume(')') {
+			return node, nil
+		}
+		if !p.consume(',') {
+			return nil, p.errorf("expected ',' or ')'")
+		}
+	}
+}
+
+// String formats the policy as an expression which ParsePolicy accepts.
+func (n *PolicyNode) String() string {
+	if n.Leaf() {
+		return string(n.Type) + ":" + n.Name
+	}
+
+	children := make([]string, len(n.Children))
+	for i, child := range n.Children {
+		children[i] = child.String()
+	}
+	name := string(n.Type)
+	if n.Type == NodeThreshold {
+		name = fmt.Sprintf("%dof", n.K)
+	}
+	return name + "(" + strings.Join(children, ", ") + ")"
+}
+
+// Validate checks that the policy is well formed: branches have between 1 and
+// 255 children, thresholds are between 1 and the number of children, and
+// leaves have unique names made of letters, digits and any of "_.@-".
+func (n *PolicyNode) Validate() error {
+	names := map[string]bool{}
+	return n.validate(0, names)
+}
+
+func (n *PolicyNode) validate(depth int, names map[string]bool) error {
+	if depth >= maxPolicyDepth {
+		return fmt.Errorf("%w: policies may be nested at most %d deep", ErrInvalidPolicy, maxPolicyDepth)
+	}
+
+	switch n.Type {
+	case NodeKey, NodePassword:
+		if !leafNamePattern.MatchString(n.Name) {
+			return fmt.Errorf("%w: invalid name '%s'", ErrInvalidPolicy, n.Name)
+		}
+		if names[n.Name] {
+			return fmt.Errorf("%w: the name '%s' is used more than once", ErrInvalidPolicy, n.Name)
+		}
+		names[n.Name] = true
+		if n.K != 0 || len(n.Children) > 0 {
+			return fmt.Errorf("%w: %s '%s' has children", ErrInvalidPolicy, n.Type, n.Name)
+		}
+		return nil
+	case NodeAnd, NodeOr, NodeThreshold:
+	default:
+		return fmt.Errorf("%w: unknown node type '%s'", ErrInvalidPolicy, n.Type)
+	}
+
+	if len(n.Children) < 1 || len(n.Children) > 255 {
+		return fmt.Errorf("%w: %s must have between 1 and 255 children", ErrInvalidPolicy, n.Type)
+	}
+	if n.Type != NodeThreshold && n.K != 0 {
+		return fmt.Errorf("%w: %s has a threshold", ErrInvalidPolicy, n.Type)
+	}
+	if n.Type == NodeThreshold && (n.K < 1 || int(n.K) > len(n.Children)) {
+		return fmt.Errorf("%w: the threshold of %dof must be between 1 and its %d children", ErrInvalidPolicy, n.K, len(n.Children))
+	}
+	if n.Name != "" || n.Header != nil {
+		return fmt.Errorf("%w: %s has a name or header", ErrInvalidPolicy, n.Type)
+	}
+	for _, child := range n.Children {
+		err := child.validate(depth+1, names)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// policyLeaf is a leaf of a policy along with its path. The path of a node is the
+// position of each node leading to it, from 1, separated by dots. The root's path is empty.
+type policyLeaf struct {
+	path string
+	node *PolicyNode
+}
+
+// leaves returns the leaves of the policy in order.
+func (n *PolicyNode) leaves() []policyLeaf {
+	var leaves []policyLeaf
+	n.walk("", func(path string, node *PolicyNode) {
+		if node.Leaf() {
+			leaves = append(leaves, policyLeaf{path, node})
+		}
+	})
+	return leaves
+}
+
+// Leaves returns the key and password leaves of the policy, in order.
+func (n *PolicyNode) Leaves() []*PolicyNode {
+	var nodes []*PolicyNode
+	for _, leaf := range n.leaves() {
+		nodes = append(nodes, leaf.node)
+	}
+	return nodes
+}
+
+// leaf returns the leaf with the name.
+func (n *PolicyNode) leaf(name string) (policyLeaf, bool) {
+	for _, leaf := range n.leaves() {
+		if leaf.node.Name == name {
+			return leaf, true
+		}
+	}
+	return policyLeaf{}, false
+}
+
+// walk calls fn for the node and each of its descendants, in order.
+func (n *PolicyNode) walk(path string, fn func(path string, node *PolicyNode)) {
+	fn(path, n)
+	for i, child := range n.Children {
+		child.walk(childPath(path, i), fn)
+	}
+}
+
+func childPath(path string, i int) string {
+	if path == "" {
+		return strconv.Itoa(i + 1)
+	}
+	return path + "." + strconv.Itoa(i+1)
+}
+
+// split splits the secret of the node among its children, down to the leaves, returning
+// the secret of each leaf keyed by its path. An or node gives each child the whole secret,
+// and other branches use Shamir's secret sharing with their threshold, unless it is 1.
+func (n *PolicyNode) split(path string, secret []byte, leaves map[string][]byte) error {
+	if n.Leaf() {
+		leaves[path] = secret
+		return nil
+	}
+
+	k := n.required()
+	var shares map[byte][]byte
+	if k > 1 {
+		var err error
+		shares, err = shamir.SplitTagged(secret, byte(k), byte(len(n.Children)))
+		if err != nil {
+			return fmt.Errorf("split %s: %w", n.Type, err)
+		}
+	}
+	for i, child := range n.Children {
+		childSecret := secret
+		if k > 1 {
+			childSecret = shares[byte(i+1)]
+		}
+		err := child.split(childPath(path, i), childSecret, leaves)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverSecret recovers the secret of the node from the secrets of the leaves,
+// keyed by their paths, returning nil if there are not enough leaves.
+func (n *PolicyNode) recoverSecret(path string, leaves map[string][]byte) ([]byte, error) {
+	if n.Leaf() {
+		return leaves[path], nil
+	}
+
+	k := n.required()
+	shares := map[byte][]byte{}
+	for i, child := range n.Children {
+		secret, err := child.recoverSecret(childPath(path, i), leaves)
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			continue
+		}
+		if k == 1 {
+			return secret, nil
+		}
+		shares[byte(i+1)] = secret
+		if len(shares) == k {
+			secret, err := shamir.CombineTagged(shares)
+			if err != nil {
+				return nil, fmt.Errorf("combine %s: %w", n, err)
+			}
+			return secret, nil
+		}
+	}
+	return nil, nil
+}
+
+// Plan is a set of leaves which together satisfy a policy.
+type Plan struct {
+	// Leaves are the names of the leaves, in order.
+	Leaves []string
+	// Missing are the names of the key leaves whose keys are not available.
+	Missing []string
+}
+
+// Ready reports whether every leaf of the plan is available.
+func (p Plan) Ready() bool {
+	return len(p.Missing) == 0
+}
+
+func (p Plan) String() string {
+	return strings.Join(p.Leaves, " + ")
+}
+
+// choose returns the names of leaves which satisfy the node using only the available
+// leaves, in the order of the policy, or nil if the node cannot be satisfied. Each branch
+// uses the children which need the fewest leaves, so unlike Plans, every combination is
+// considered without listing them.
+func (n *PolicyNode) choose(available func(leaf *PolicyNode) bool) []string {
+	if n.Leaf() {
+		if available(n) {
+			return []string{n.Name}
+		}
+		return nil
+	}
+
+	var satisfied []int
+	sets := make([][]string, len(n.Children))
+	for i, child := range n.Children {
+		sets[i] = child.choose(available)
+		if sets[i] != nil {
+			satisfied = append(satisfied, i)
+		}
+	}
+	if len(satisfied) < n.required() {
+		return nil
+	}
+
+	slices.SortStableFunc(satisfied, func(a, b int) int {
+		return len(sets[a]) - len(sets[b])
+	})
+	chosen := satisfied[:n.required()]
+	slices.Sort(chosen)
+
+	var leaves []string
+	for _, i := range chosen {
+		leaves = append(leaves, sets[i]...)
+	}
+	return leaves
+}
+
+// Plans lists the smallest sets of leaves which satisfy the policy, given which
+// keys are available, by the names of their leaves. Passwords are always available.
+// Plans which are ready come first, then those missing the fewest keys, then those
+// with the fewest leaves. Policies with too many combinations are not fully listed,
+// so plans are only suitable for display.
+func (n *PolicyNode) Plans(available map[string]bool) []Plan {
+	var plans []Plan
+	for _, set := range n.satisfying() {
+		plan := Plan{Leaves: set}
+		n.walk("", func(_ string, leaf *PolicyNode) {
+			if leaf.Type == NodeKey && slices.Contains(set, leaf.Name) && !available[leaf.Name] {
+				plan.Missing = append(plan.Missing, leaf.Name)
+			}
+		})
+		plans = append(plans, plan)
+	}
+
+	slices.SortStableFunc(plans, func(a, b Plan) int {
+		if len(a.Missing) != len(b.Missing) {
+			return len(a.Missing) - len(b.Missing)
+		}
+		return len(a.Leaves) - len(b.Leaves)
+	})
+	return plans
+}
+
+// satisfying returns the sets of leaf names which satisfy the node, with each
+// set in the order of the policy, stopping once maxPlans sets are found.
+func (n *PolicyNode) satisfying() [][]string {
+	if n.Leaf() {
+		return [][]string{{n.Name}}
+	}
+
+	children := make([][][]string, len(n.Children))
+	for i, child := range n.Children {
+		children[i] = child.satisfying()
+	}
+
+	var sets [][]string
+	var choose func(start int, chosen [][]string)
+	choose = func(start int, chosen [][]string) {
+		if len(sets) >= maxPlans {
+			return
+		}
+		if len(chosen) == n.required() {
+			sets = append(sets, slices.Concat(chosen...))
+			return
+		}
+		for i := start; i < len(n.Children); i++ {
+			for _, set := range children[i] {
+				choose(i+1, append(slices.Clip(chosen), set))
+				if len(sets) >= maxPlans {
+					return
+				}
+			}
+		}
+	}
+	choose(0, nil)
+	return sets
+}
@@ -0,0 +1,278 @@
+package fkvault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"fidokit/fidoutils"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for _, expr := range []string{
+		"key:a",
+		"and(key:admin, 2of(key:op1, key:op2, key:op3, key:op4))",
+		"or(2of(key:alice, key:bob, key:carol), and(key:recovery, password:legal))",
+	} {
+		policy, err := ParsePolicy(expr)
+		if err != nil {
+			t.Fatalf("parse '%s': %v", expr, err)
+		}
+		if policy.String() != expr {
+			t.Errorf("parse '%s': formatted as '%s'", expr, policy)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"key:",
+		"and(key:a, key:a)",
+		"3of(key:a, key:b)",
+		"0of(key:a)",
+		"and()",
+		"and(key:a",
+		"xor(key:a, key:b)",
+		"key:a key:b",
+		strings.Repeat("and(", maxPolicyDepth) + "key:a" + strings.Repeat(")", maxPolicyDepth),
+	} {
+		_, err := ParsePolicy(expr)
+		if !errors.Is(err, ErrInvalidPolicy) {
+			t.Errorf("parse '%s': got %v, want %v", expr, err, ErrInvalidPolicy)
+		}
+	}
+}
+
+// recoverFrom recovers the secret of the policy from the secrets of the named leaves.
+func recoverFrom(t *testing.T, policy *PolicyNode, secrets map[string][]byte, names ...string) []byte {
+	t.Helper()
+	known := map[string][]byte{}
+	for _, leaf := range policy.leaves() {
+		if slices.Contains(names, leaf.node.Name) {
+			known[leaf.path] = secrets[leaf.path]
+		}
+	}
+	secret, err := policy.recoverSecret("", known)
+	if err != nil {
+		t.Fatalf("recover from %v: %v", names, err)
+	}
+	return secret
+}
+
+func TestPolicySplitRecover(t *testing.T) {
+	policy, err := ParsePolicy("or(2of(key:a, key:b, key:c), and(key:d, password:e))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterKey := newMasterKey()
+	secrets := map[string][]byte{}
+	err = policy.split("", masterKey, secrets)
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if len(secrets) != 5 {
+		t.Fatalf("split: got %d leaf secrets, want 5", len(secrets))
+	}
+
+	for _, names := range [][]string{{"a", "b"}, {"a", "c"}, {"b", "c"}, {"d", "e"}, {"a", "d", "e"}} {
+		got := recoverFrom(t, policy, secrets, names...)
+		if !bytes.Equal(got, masterKey) {
+			t.Errorf("recover from %v: wrong secret", names)
+		}
+	}
+	for _, names := range [][]string{{"a"}, {"a", "d"}, {"e"}, {}} {
+		got := recoverFrom(t, policy, secrets, names...)
+		if got != nil {
+			t.Errorf("recover from %v: got a secret from too few leaves", names)
+		}
+	}
+}
+
+func TestPolicyChoose(t *testing.T) {
+	policy, err := ParsePolicy("and(key:a, 2of(key:b, password:c, and(key:d, key:e)), or(key:f, key:g))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		available string
+		want      []string
+	}{
+		{"a b c d e f g", []string{"a", "b", "c", "f"}},
+		{"a b d e g", []string{"a", "b", "d", "e", "g"}},
+		{"a c d e f", []string{"a", "c", "d", "e", "f"}},
+		{"a b c", nil},
+		{"b c d e f g", nil},
+	}
+	for _, test := range tests {
+		available := strings.Fields(test.available)
+		got := policy.choose(func(leaf *PolicyNode) bool {
+			return slices.Contains(available, leaf.Name)
+		})
+		if !slices.Equal(got, test.want) {
+			t.Errorf("choose from %v: got %v, want %v", available, got, test.want)
+		}
+	}
+}
+
+// largeThreshold returns a policy of k of n keys, named a, b, c and so on, like the authenticators of newAuths.
+func largeThreshold(t *testing.T, k, n int) *PolicyNode {
+	t.Helper()
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key:" + string(rune('a'+i))
+	}
+	policy, err := ParsePolicy(fmt.Sprintf("%dof(%s)", k, strings.Join(keys, ", ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestPolicyChooseBeyondPlans(t *testing.T) {
+	policy := largeThreshold(t, 3, 25)
+	available := map[string]bool{}
+	for _, leaf := range policy.Leaves()[1:] {
+		available[leaf.Name] = true
+	}
+
+	// every listed plan uses the first key, as there are too many to list them all
+	for _, plan := range policy.Plans(available) {
+		if plan.Ready() {
+			t.Fatalf("plan %s is ready, so this policy does not test choose beyond the listed plans", plan)
+		}
+	}
+	got := policy.choose(func(leaf *PolicyNode) bool {
+		return available[leaf.Name]
+	})
+	if len(got) != 3 || slices.Contains(got, "a") {
+		t.Errorf("choose without the first key: got %v", got)
+	}
+}
+
+// initPolicy creates a policy vault, enrolling the key leaves named a, b, c and so on
+// using the authenticators in order, and each password leaf using the password "password".
+func initPolicy(t *testing.T, auths []fidoutils.Authenticator, policy *PolicyNode, masterKey []byte) *PolicyVault {
+	t.Helper()
+	vault := createVault[*PolicyVault](t, Options{Type: TypePolicy, Policy: policy})
+	vault.KDF = &testKDF
+
+	enrollments := map[string]Enrollment{}
+	for _, leaf := range policy.Leaves() {
+		enrollments[leaf.Name] = Enrollment{Name: leaf.Name, Passphrase: []byte("password")}
+	}
+	for i, auth := range auths {
+		name := string(rune('a' + i))
+		enrollments[name] = Enrollment{Name: name, Authenticator: auth}
+	}
+	err := vault.Initialize(context.Background(), masterKey, enrollments, testSources(""))
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	return vault
+}
+
+func TestPolicyVault(t *testing.T) {
+	ctx := context.Background()
+	auths := newAuths(4)
+	src := testSources("")
+	masterKey := newMasterKey()
+
+	policy, err := ParsePolicy("and(key:a, 2of(key:b, key:c, password:p))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault := initPolicy(t, auths[:3], policy, masterKey)
+	vault = roundTrip(t, vault)
+
+	password := map[string][]byte{"p": []byte("password")}
+	tests := []struct {
+		auths     []fidoutils.Authenticator
+		passwords map[string][]byte
+		err       error
+	}{
+		{auths[:3], nil, nil},
+		{auths[:2], password, nil},
+		{[]fidoutils.Authenticator{auths[0], auths[2], auths[3]}, password, nil},
+		{auths[:2], nil, ErrPolicyNotSatisfied},
+		{auths[1:], password, ErrPolicyNotSatisfied},
+		{auths[:2], map[string][]byte{"p": []byte("wrong")}, ErrWrongPassphrase},
+	}
+	for i, test := range tests {
+		got, err := vault.Unlock(ctx, test.auths, test.passwords, src)
+		if !errors.Is(err, test.err) {
+			t.Errorf("unlock %d: got %v, want %v", i, err, test.err)
+		} else if err == nil && !bytes.Equal(got, masterKey) {
+			t.Errorf("unlock %d: wrong master key", i)
+		}
+	}
+}
+
+func TestPolicyVaultLargeThreshold(t *testing.T) {
+	auths := newAuths(25)
+	masterKey := newMasterKey()
+	vault := initPolicy(t, auths, largeThreshold(t, 3, len(auths)), masterKey)
+
+	got, err := vault.Unlock(context.Background(), auths[1:], nil, testSources(""))
+	if err != nil {
+		t.Fatalf("unlock without the first key: %v", err)
+	}
+	if !bytes.Equal(got, masterKey) {
+		t.Errorf("unlock without the first key: wrong master key")
+	}
+}
+
+func TestParsePolicyVaultInvalid(t *testing.T) {
+	policy, err := ParsePolicy("and(key:a, password:p)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault := initPolicy(t, newAuths(1), policy, newMasterKey())
+	data, err := json.Marshal(vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]any
+	for name, edit := range map[string]func(){
+		"null policy":    func() { doc["policy"] = nil },
+		"invalid policy": func() { doc["policy"].(map[string]any)["type"] = "xor" },
+		"partly enrolled": func() {
+			leaf := doc["policy"].(map[string]any)["children"].([]any)[1]
+			delete(leaf.(map[string]any), "header")
+		},
+	} {
+		err := json.Unmarshal(data, &doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edit()
+		edited, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ParseJSON(edited)
+		if !errors.Is(err, ErrInvalidPolicy) {
+			t.Errorf("parse vault with %s: got %v, want %v", name, err, ErrInvalidPolicy)
+		}
+	}
+}
+
+func TestUnlockPlanMissingHeader(t *testing.T) {
+	policy, err := ParsePolicy("or(key:a, password:p)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault := initPolicy(t, newAuths(1), policy, newMasterKey())
+	policy.Children[1].Header = nil
+
+	_, err = vault.unlockPlan(context.Background(), Plan{Leaves: []string{"p"}}, nil, func(*PolicyNode) ([]byte, error) {
+		return []byte("password"), nil
+	}, false, testSources(""))
+	if !errors.Is(err, ErrNoHeader) {
+		t.Errorf("unlock a leaf without a header: got %v, want %v", err, ErrNoHeader)
+	}
+}
@@ -0,0 +1,429 @@
+package fkvault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"fidokit/fidoutils"
+	"fidokit/prompt"
+)
+
+// ErrPolicyEncrypted is returned when creating an encrypted policy vault.
+var ErrPolicyEncrypted = errors.New("policy vaults cannot be encrypted; use password leaves instead")
+
+// PolicyVault is a vault unlocked by any combination of FIDO2 keys and
+// passwords which satisfies its policy, such as "the admin key and any 2
+// of 4 operator keys". See PolicyNode.
+type PolicyVault struct {
+	*BaseVault `json:",inline"`
+
+	// Policy is the tree of keys and passwords which can unlock the vault.
+	Policy *PolicyNode `json:"policy"`
+}
+
+// NewPolicy creates a new PolicyVault with the policy, which must be valid.
+func NewPolicy(name, description string, policy *PolicyNode) *PolicyVault {
+	now := time.Now().UTC()
+	return &PolicyVault{
+		BaseVault: newBase(TypePolicy, now, name, description),
+		Policy:    policy,
+	}
+}
+
+// Initialized reports whether every leaf of the policy has been enrolled.
+func (v *PolicyVault) Initialized() bool {
+	if v.Policy == nil {
+		return false
+	}
+	for _, leaf := range v.Policy.leaves() {
+		if leaf.node.Header == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks that the vault has a valid policy, and that either every
+// leaf or none of them has been enrolled.
+func (v *PolicyVault) validate() error {
+	if v.Policy == nil {
+		return fmt.Errorf("%w: the policy is missing", ErrInvalidPolicy)
+	}
+	err := v.Policy.Validate()
+	if err != nil {
+		return err
+	}
+
+	var enrolled int
+	leaves := v.Policy.leaves()
+	for _, leaf := range leaves {
+		if leaf.node.Header != nil {
+			enrolled++
+		}
+	}
+	if enrolled != 0 && enrolled != len(leaves) {
+		return fmt.Errorf("%w: only %d of its %d leaves are enrolled", ErrInvalidPolicy, enrolled, len(leaves))
+	}
+	return nil
+}
+
+// Initialize splits the master key down the policy, then enrolls every leaf using the
+// enrollment with its name: key leaves using the authenticator, which must be connected,
+// and password leaves using the passphrase. The vault is unchanged if any enrollment fails.
+func (v *PolicyVault) Initialize(ctx context.Context, masterKey []byte, enrollments map[string]Enrollment, src Sources) error {
+	return v.initialize(ctx, masterKey, func(leaf *PolicyNode) (Enrollment, error) {
+		enrollment, ok := enrollments[leaf.Name]
+		if !ok {
+			return Enrollment{}, fmt.Errorf("%w: %s '%s' is missing", ErrInvalidEnrollment, leaf.Type, leaf.Name)
+		}
+		return enrollment, nil
+	}, src)
+}
+
+// initialize enrolls each leaf in order, using the enrollment returned for it.
+func (v *PolicyVault) initialize(ctx context.Context, masterKey []byte, enrollment func(leaf *PolicyNode) (Enrollment, error), src Sources) error {
+	if v.Initialized() {
+		return ErrAlreadyInitialized
+	}
+
+	secrets := map[string][]byte{}
+	err := v.Policy.split("", masterKey, secrets)
+	if err != nil {
+		return err
+	}
+
+	leaves := v.Policy.leaves()
+	headers := make([]*VaultHeader, len(leaves))
+	for i, leaf := range leaves {
+		e, err := enrollment(leaf.node)
+		if err != nil {
+			return err
+		}
+		headers[i], err = v.enrollLeaf(ctx, leaf, secrets[leaf.path], e, src)
+		if err != nil {
+			return fmt.Errorf("enroll '%s': %w", leaf.node.Name, err)
+		}
+	}
+
+	for i, leaf := range leaves {
+		leaf.node.Header = headers[i]
+	}
+	v.Metadata.Modified = time.Now().UTC()
+	v.authenticate(masterKey)
+	return nil
+}
+
+// enrollLeaf encrypts the secret of a leaf for a new credential on the enrollment's
+// authenticator, or using a key derived from its passphrase, returning its header.
+func (v *PolicyVault) enrollLeaf(ctx context.Context, leaf policyLeaf, secret []byte, enrollment Enrollment, src Sources) (*VaultHeader, error) {
+	header := &VaultHeader{
+		Name:  leaf.node.Name,
+		Bound: true,
+	}
+
+	switch leaf.node.Type {
+	case NodeKey:
+		if enrollment.Authenticator == nil {
+			return nil, fmt.Errorf("%w: a key is required", ErrInvalidEnrollment)
+		}
+		credID, derivedKey, err := v.enroll(ctx, enrollment.Authenticator, src)
+		if err != nil {
+			return nil, err
+		}
+		header.CredentialID = credID
+		header.EncryptedKey, err = v.sealKey(derivedKey, nil, secret, v.associatedData(leaf.path, header))
+		if err != nil {
+			return nil, fmt.Errorf("encrypt key: %w", err)
+		}
+	case NodePassword:
+		header.Kind = SharePassphrase
+		err := v.sealPassphrase(leaf.path, header, secret, enrollment.Passphrase, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+// locate finds the key leaves which the authenticators hold credentials for, by
+// their names, without requiring a touch or PIN.
+func (v *PolicyVault) locate(auths []fidoutils.Authenticator) map[string]fidoutils.Authenticator {
+	params := v.fidoParams()
+	found := map[string]fidoutils.Authenticator{}
+	for _, leaf := range v.Policy.leaves() {
+		if leaf.node.Type != NodeKey || leaf.node.Header == nil {
+			continue
+		}
+		for _, auth := range auths {
+			if fidoutils.HasCredential(auth, leaf.node.Header.CredentialID, params) {
+				found[leaf.node.Name] = auth
+				break
+			}
+		}
+	}
+	return found
+}
+
+// Plans lists the ways to unlock the vault, given the authenticators which
+// are connected. See PolicyNode.Plans.
+func (v *PolicyVault) Plans(auths []fidoutils.Authenticator) []Plan {
+	available := map[string]bool{}
+	for name := range v.locate(auths) {
+		available[name] = true
+	}
+	return v.Policy.Plans(available)
+}
+
+// Unlock recovers the master key using leaves which satisfy the policy, given the
+// authenticators and the passwords, which are keyed by the names of their leaves.
+func (v *PolicyVault) Unlock(ctx context.Context, auths []fidoutils.Authenticator, passwords map[string][]byte, src Sources) ([]byte, error) {
+	if !v.Initialized() {
+		return nil, ErrNotInitialized
+	}
+
+	devices := v.locate(auths)
+	leaves := v.Policy.choose(func(leaf *PolicyNode) bool {
+		if leaf.Type == NodePassword {
+			return passwords[leaf.Name] != nil
+		}
+		return devices[leaf.Name] != nil
+	})
+	if leaves == nil {
+		return nil, ErrPolicyNotSatisfied
+	}
+
+	return v.unlockPlan(ctx, Plan{Leaves: leaves}, devices, func(leaf *PolicyNode) ([]byte, error) {
+		return passwords[leaf.Name], nil
+	}, false, src)
+}
+
+// unlockPlan recovers the master key using the leaves of the plan, with the devices
+// found for its keys, and the passwords returned by password. If retry is set, the
+// user is told about incorrect passwords, which are asked for again.
+func (v *PolicyVault) unlockPlan(ctx context.Context, plan Plan, devices map[string]fidoutils.Authenticator, password func(leaf *PolicyNode) ([]byte, error), retry bool, src Sources) ([]byte, error) {
+	secrets := map[string][]byte{}
+	for _, name := range plan.Leaves {
+		leaf, ok := v.Policy.leaf(name)
+		if !ok {
+			return nil, ErrNoHeader
+		}
+		h := leaf.node.Header
+		if h == nil {
+			return nil, fmt.Errorf("%w: %s '%s'", ErrNoHeader, leaf.node.Type, name)
+		}
+
+		var secret []byte
+		switch leaf.node.Type {
+		case NodeKey:
+			dev := devices[name]
+			if dev == nil {
+				return nil, fmt.Errorf("%w: key '%s' is not connected", ErrPolicyNotSatisfied, name)
+			}
+			_, derivedKey, err := v.derive(ctx, dev, src, [][]byte{h.CredentialID})
+			if err != nil {
+				return nil, fmt.Errorf("key '%s': %w", name, err)
+			}
+			secret, err = v.openKey(derivedKey, nil, h.EncryptedKey, v.associatedData(leaf.path, h))
+			if err != nil {
+				return nil, fmt.Errorf("key '%s': %w", name, err)
+			}
+		case NodePassword:
+			for {
+				pass, err := password(leaf.node)
+				if err != nil {
+					return nil, err
+				}
+				secret, err = v.openPassphrase(leaf.path, h, pass, nil)
+				if retry && errors.Is(err, ErrWrongPassphrase) {
+					Prompter.Notify("Incorrect password. Try again.")
+					continue
+				}
+				if err != nil {
+					return nil, fmt.Errorf("password '%s': %w", name, err)
+				}
+				break
+			}
+		}
+		secrets[leaf.path] = secret
+	}
+
+	masterKey, err := v.Policy.recoverSecret("", secrets)
+	if err != nil {
+		return nil, err
+	}
+	if masterKey == nil {
+		return nil, ErrPolicyNotSatisfied
+	}
+
+	// also detects leaves which were swapped or corrupted, which combine to the wrong key
+	err = v.Verify(masterKey)
+	if errors.Is(err, ErrUnverified) {
+		return masterKey, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return masterKey, nil
+}
+
+// InteractiveInitialize walks the user through choosing a master key,
+// then enrolling every key and password of the policy.
+func (v *PolicyVault) InteractiveInitialize() error {
+	if Debug {
+		fmt.Println("[DEBUG] InteractiveInitialize")
+	}
+	if v.Initialized() {
+		return ErrAlreadyInitialized
+	}
+
+	masterKey, err := interactiveMasterKey()
+	if err != nil {
+		return err
+	}
+	return v.InteractiveEnroll(masterKey)
+}
+
+// InteractiveEnroll walks the user through enrolling every key and password
+// of the policy, in order, to protect the master key.
+func (v *PolicyVault) InteractiveEnroll(masterKey []byte) error {
+	var keys int
+	for _, leaf := range v.Policy.leaves() {
+		if leaf.node.Type == NodeKey {
+			keys++
+		}
+	}
+
+	Prompter.Notify("")
+	Prompter.Notify("You will now be walked through the process of enrolling each key and password of the policy:")
+	Prompter.Notify("  " + v.Policy.String())
+	Prompter.Notify("")
+	if keys > 0 {
+		Prompter.Notify("Note that all keys must be present while creating a policy vault.")
+		Prompter.Notify("")
+	}
+
+	return v.initialize(context.Background(), masterKey, func(leaf *PolicyNode) (Enrollment, error) {
+		if leaf.Type == NodePassword {
+			pass, err := askNewSecret("password", leaf.Name)
+			return Enrollment{Name: leaf.Name, Passphrase: pass}, err
+		}
+
+		err := waitForKeys(fmt.Sprintf("Insert the key for '%s', then press ENTER.", leaf.Name), keys)
+		if err != nil {
+			return Enrollment{}, err
+		}
+		dev, err := fidoutils.InteractiveGetDevice()
+		if err != nil {
+			return Enrollment{}, fmt.Errorf("get device: %w", err)
+		}
+		return Enrollment{Name: leaf.Name, Authenticator: dev}, nil
+	}, interactiveSources(false))
+}
+
+// InteractiveUnlock walks the user through unlocking the vault. The connected keys
+// are found without a touch or PIN, then the user chooses one of the ways to unlock
+// the vault which they complete, or is told which keys are missing.
+func (v *PolicyVault) InteractiveUnlock() ([]byte, error) {
+	if Debug {
+		fmt.Println("[DEBUG] InteractiveUnlock")
+	}
+	if !v.Initialized() {
+		return nil, ErrNotInitialized
+	}
+
+	Prompter.Notify("This vault is unlocked using the policy:")
+	Prompter.Notify("  " + v.Policy.String())
+	Prompter.Notify("")
+
+	for {
+		devs, err := fidoutils.ConnectedDevices()
+		if err != nil {
+			return nil, err
+		}
+		devices := v.locate(devs)
+		available := map[string]bool{}
+		for name := range devices {
+			available[name] = true
+		}
+
+		// passwords are always available, as they are asked for
+		leaves := v.Policy.choose(func(leaf *PolicyNode) bool {
+			return leaf.Type == NodePassword || available[leaf.Name]
+		})
+		plans := v.Policy.Plans(available)
+		if leaves == nil {
+			Prompter.Notify("The connected keys cannot unlock the vault. Any of these would:")
+			for _, plan := range plans[:min(len(plans), 5)] {
+				Prompter.Notify(fmt.Sprintf("  %s (connect %s)", plan, joinNames(plan.Missing)))
+			}
+			_, err := Prompter.AskText("Connect more keys, then press ENTER.")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// the listed plans are offered if any are ready, otherwise those chosen for each branch are used
+		plan := Plan{Leaves: leaves}
+		var ready []Plan
+		var names []string
+		for _, p := range plans {
+			if p.Ready() && len(ready) < 9 {
+				ready = append(ready, p)
+				names = append(names, p.String())
+			}
+		}
+		if len(ready) > 0 {
+			plan = ready[0]
+		}
+		if len(ready) > 1 {
+			choice, err := Prompter.Choose("Choose how to unlock the vault:", names)
+			if err != nil {
+				return nil, err
+			}
+			plan = ready[choice]
+		}
+		return v.unlockPlan(context.Background(), plan, devices, func(leaf *PolicyNode) ([]byte, error) {
+			pass, err := prompt.AskNonEmptySecret(Prompter, fmt.Sprintf("Enter the password for '%s': ", leaf.Name))
+			return []byte(pass), err
+		}, true, interactiveSources(false))
+	}
+}
+
+// joinNames joins names as a list in prose.
+func joinNames(names []string) string {
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// DeleteAllHeaders removes the header of every leaf, and removes the
+// secrets, which cannot be decrypted without the master key.
+func (v *PolicyVault) DeleteAllHeaders() {
+	for _, leaf := range v.Policy.leaves() {
+		leaf.node.Header = nil
+	}
+	v.MAC = nil
+	v.Secrets = nil
+	v.Contexts = nil
+	v.Metadata.Modified = time.Now().UTC()
+}
+
+func (v *PolicyVault) MarshalJSON() ([]byte, error) {
+	type Alias PolicyVault // avoid recursion
+	return json.Marshal(struct {
+		Alias
+		Type string `json:"type"`
+	}{
+		Alias: Alias(*v),
+		Type:  "policy",
+	})
+}
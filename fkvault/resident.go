@@ -0,0 +1,262 @@
+package fkvault
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/keys-pub/go-libfido2"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"fidokit/crypto"
+	"fidokit/fidoutils"
+	"fidokit/prompt"
+	"fidokit/utils"
+)
+
+// Resident credentials let each key of a simple vault recover the vault without
+// the vault file. libfido2 does not expose largeBlob or credBlob, so the data is
+// stored in the user handles (at most 64 bytes each) of two resident credentials:
+//
+//   - the key credential, from which the header key is derived:
+//     "fk" 'k' || slot || vault ID || hmac-secret salt
+//   - the data credential, which holds the master key sealed using a key derived
+//     from the key credential's hmac-secret: "fk" 'd' || slot || sealed master key
+//
+// The random slot pairs the two credentials, since a key may hold several.
+
+// ErrResidentUnsupported is returned when creating resident credentials for a vault which cannot use them.
+var ErrResidentUnsupported = errors.New("resident credentials are only supported by unencrypted simple vaults")
+
+// ErrNoRecoveryData is returned when a key holds no resident credentials from which a vault can be recovered.
+var ErrNoRecoveryData = errors.New("key holds no vault recovery data")
+
+// ErrMultipleVaults is returned when a key holds recovery data for several vaults, but none was chosen.
+var ErrMultipleVaults = errors.New("key holds recovery data for multiple vaults")
+
+const (
+	residentMagic    = "fk"
+	residentKindKey  = 'k'
+	residentKindData = 'd'
+	residentSlotSize = 8
+	residentIDSize   = 16 // the length of utils.RandomID
+	residentSaltSize = 32
+)
+
+// recovery is the data recovered from a pair of resident credentials on a key.
+type recovery struct {
+	vaultID string
+	salt    []byte
+	credID  []byte
+	sealed  []byte
+}
+
+// residentSalt returns the raw value of the vault's salt text, which must
+// be randomly generated hex, as it is for all but the oldest vaults.
+func (v *BaseVault) residentSalt() ([]byte, error) {
+	salt, err := hex.DecodeString(v.AssertionSaltText)
+	if err != nil || len(salt) != residentSaltSize {
+		return nil, fmt.Errorf("%w: the vault salt is not random", ErrResidentUnsupported)
+	}
+	return salt, nil
+}
+
+// recoveryAEAD returns the AEAD used to seal the master key in the data credential.
+// Its key is unique to the key credential and only used once, so the nonce is zero.
+func recoveryAEAD(derivedKey []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(crypto.DeriveKey(derivedKey, "resident-recovery"))
+}
+
+func recoveryAD(vaultID string, credID []byte) []byte {
+	var w authWriter
+	w.string("fidokit recovery")
+	w.string(vaultID)
+	w.bytes(credID)
+	return w.buf.Bytes()
+}
+
+// enrollResident creates the key and data credentials on the authenticator,
+// returning the key credential's ID and the key derived from it.
+func (v *BaseVault) enrollResident(ctx context.Context, auth fidoutils.Authenticator, src Sources, masterKey []byte) (credID, derivedKey []byte, err error) {
+	if v.Type != TypeSimple || v.Encrypted {
+		return nil, nil, ErrResidentUnsupported
+	}
+	if len(masterKey) != 32 || len(v.ID) != residentIDSize {
+		return nil, nil, fmt.Errorf("%w: the master key must be 32 bytes", ErrResidentUnsupported)
+	}
+	salt, err := v.residentSalt()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pin, err := src.pin(auth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slot := utils.RandomBytes(residentSlotSize)
+	keyHandle := slices.Concat([]byte(residentMagic), []byte{residentKindKey}, slot, []byte(v.ID), salt)
+	err = src.touch(ctx, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	cred, err := fidoutils.MakeResidentCredential(auth, pin, v.fidoParams(), keyHandle)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = src.touch(ctx, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	assertion, err := fidoutils.Assertion(auth, pin, [][]byte{cred.CredentialID}, v.fidoParams())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := recoveryAEAD(assertion.HMACSecret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create aead: %w", err)
+	}
+	sealed := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), masterKey, recoveryAD(v.ID, cred.CredentialID))
+	dataHandle := slices.Concat([]byte(residentMagic), []byte{residentKindData}, slot, sealed)
+
+	err = src.touch(ctx, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = fidoutils.MakeResidentCredential(auth, pin, v.fidoParams(), dataHandle)
+	if err != nil {
+		return nil, nil, fmt.Errorf("store recovery data: %w", err)
+	}
+	return cred.CredentialID, assertion.HMACSecret, nil
+}
+
+// findRecoveries pairs the key and data credentials among the resident credentials.
+func findRecoveries(creds []*libfido2.Credential) []recovery {
+	keys := map[string]recovery{}
+	data := map[string][]byte{}
+	for _, cred := range creds {
+		handle := cred.User.ID
+		header := len(residentMagic) + 1 + residentSlotSize
+		if len(handle) < header || !bytes.HasPrefix(handle, []byte(residentMagic)) {
+			continue
+		}
+		slot, rest := string(handle[len(residentMagic)+1:header]), handle[header:]
+
+		switch handle[len(residentMagic)] {
+		case residentKindKey:
+			if len(rest) != residentIDSize+residentSaltSize {
+				continue
+			}
+			keys[slot] = recovery{
+				vaultID: string(rest[:residentIDSize]),
+				salt:    rest[residentIDSize:],
+				credID:  cred.ID,
+			}
+		case residentKindData:
+			data[slot] = rest
+		}
+	}
+
+	var recoveries []recovery
+	for slot, r := range keys {
+		if data[slot] != nil {
+			r.sealed = data[slot]
+			recoveries = append(recoveries, r)
+		}
+	}
+	return recoveries
+}
+
+// RecoverFromKey rebuilds a simple vault from the resident credentials stored on
+// the authenticator for the relying party, returning it with its master key. The
+// vault has a single header with the name for the authenticator. If the key holds
+// recovery data for several vaults, vaultID chooses one. The PIN is required,
+// since listing resident credentials uses credential management.
+func RecoverFromKey(ctx context.Context, auth fidoutils.Authenticator, rpID, vaultID, name string, src Sources) (*SimpleVault, []byte, error) {
+	pin, err := src.pin(auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	creds, err := fidoutils.ResidentCredentials(auth, pin, rpID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recoveries := slices.DeleteFunc(findRecoveries(creds), func(r recovery) bool {
+		return vaultID != "" && r.vaultID != vaultID
+	})
+	if len(recoveries) == 0 {
+		return nil, nil, ErrNoRecoveryData
+	}
+	r := recoveries[0]
+	for _, other := range recoveries[1:] {
+		if other.vaultID != r.vaultID {
+			return nil, nil, ErrMultipleVaults
+		}
+	}
+
+	v := NewSimple("recovered", fmt.Sprintf("Recovered from key '%s'", name))
+	v.ID = r.vaultID
+	v.RPID = rpID
+	v.AssertionSaltText = hex.EncodeToString(r.salt)
+	v.Resident = true
+
+	err = src.touch(ctx, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	assertion, err := fidoutils.Assertion(auth, pin, [][]byte{r.credID}, v.fidoParams())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := recoveryAEAD(assertion.HMACSecret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create aead: %w", err)
+	}
+	masterKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), r.sealed, recoveryAD(r.vaultID, r.credID))
+	if err != nil {
+		return nil, nil, ErrDecrypt
+	}
+
+	header := &VaultHeader{
+		Name:         name,
+		CredentialID: r.credID,
+		Bound:        true,
+	}
+	header.EncryptedKey, err = v.sealKey(assertion.HMACSecret, nil, masterKey, v.associatedData(name, header))
+	if err != nil {
+		return nil, nil, fmt.Errorf("encrypt vault master key: %w", err)
+	}
+	v.Headers[name] = header
+	v.authenticate(masterKey)
+	return v, masterKey, nil
+}
+
+// InteractiveRecoverFromKey walks the user through recovering a simple vault
+// from the resident credentials on a key, which is given the header name.
+func InteractiveRecoverFromKey(rpID, vaultID, name string) (*SimpleVault, error) {
+	err := waitForKeys("Insert the FIDO2 key to recover the vault from, then press ENTER.", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := fidoutils.InteractiveGetDevice()
+	if err != nil {
+		return nil, fmt.Errorf("get device: %w", err)
+	}
+
+	src := interactiveSources(false)
+	src.PIN = func(fidoutils.Authenticator) (string, error) {
+		// credential management always requires the PIN, even with biometrics
+		return prompt.AskNonEmptySecret(Prompter, "Enter PIN: ")
+	}
+	v, _, err := RecoverFromKey(context.Background(), dev, rpID, vaultID, name, src)
+	return v, err
+}
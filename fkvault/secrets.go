@@ -0,0 +1,90 @@
+package fkvault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"fidokit/crypto"
+)
+
+// ErrNoSecret is returned when a secret cannot be found.
+var ErrNoSecret = errors.New("no secret")
+
+// secretsAD binds the secrets to the vault, so that they cannot be moved to another vault with the same master key.
+func (v *BaseVault) secretsAD() []byte {
+	var w authWriter
+	w.string("fidokit secrets")
+	w.string(v.ID)
+	w.string(string(v.Type))
+	return w.buf.Bytes()
+}
+
+// ReadSecrets decrypts the named secrets stored in a *SimpleVault or
+// *ShamirVault using its master key. The names are encrypted too.
+func ReadSecrets(vault any, masterKey []byte) (map[string][]byte, error) {
+	base := baseOf(vault)
+	if base == nil {
+		return nil, fmt.Errorf("unknown vault type: %T", vault)
+	}
+	err := Verify(vault, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := map[string][]byte{}
+	if base.Secrets == nil {
+		return secrets, nil
+	}
+
+	aead, err := chacha20poly1305.NewX(crypto.DeriveKey(masterKey, "vault-secrets"))
+	if err != nil {
+		return nil, fmt.Errorf("create aead: %w", err)
+	}
+	data, err := crypto.DecryptChaCha20(aead, base.Secrets, base.secretsAD())
+	if err != nil {
+		return nil, fmt.Errorf("decrypt secrets: %w", err)
+	}
+	err = json.Unmarshal(data, &secrets)
+	if err != nil {
+		return nil, fmt.Errorf("parse secrets: %w", err)
+	}
+	return secrets, nil
+}
+
+// WriteSecrets replaces the secrets stored in a *SimpleVault or *ShamirVault,
+// encrypting them using its master key, then authenticates the vault.
+// If there are no secrets, the section is removed from the vault.
+func WriteSecrets(vault any, masterKey []byte, secrets map[string][]byte) error {
+	base := baseOf(vault)
+	if base == nil {
+		return fmt.Errorf("unknown vault type: %T", vault)
+	}
+	err := Verify(vault, masterKey)
+	if err != nil {
+		return err
+	}
+
+	base.Secrets = nil
+	if len(secrets) > 0 {
+		data, err := json.Marshal(secrets)
+		if err != nil {
+			return err
+		}
+		aead, err := chacha20poly1305.NewX(crypto.DeriveKey(masterKey, "vault-secrets"))
+		if err != nil {
+			return fmt.Errorf("create aead: %w", err)
+		}
+		base.Secrets, err = crypto.EncryptChaCha20(aead, data, base.secretsAD())
+		if err != nil {
+			return fmt.Errorf("encrypt secrets: %w", err)
+		}
+	}
+
+	authenticateAny(vault, masterKey)
+	base.Metadata.Modified = time.Now().UTC()
+	return nil
+}
@@ -1,19 +1,20 @@
 package fkvault
 
 import (
-	"encoding/hex"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"slices"
-	"strings"
+	"strconv"
 	"time"
 
+	"github.com/zytekaron/galois-go"
 	"github.com/zytekaron/shamir-go"
-	"golang.org/x/crypto/chacha20poly1305"
 
 	"fidokit/crypto"
 	"fidokit/fidoutils"
-	"fidokit/utils"
 )
 
 type ShamirVault struct {
@@ -25,6 +26,8 @@ type ShamirVault struct {
 	N byte `json:"n"`
 	// Shares is a list of shamir-based vault shares, N of which must be combined to decrypt the vault.
 	Shares map[byte]*VaultHeader `json:"shares"`
+	// Generation is the number of times the shares have been replaced using Reshare.
+	Generation int `json:"generation,omitempty"`
 }
 
 // NewShamir creates a new ShamirVault.
@@ -47,188 +50,610 @@ func NewShamir(name, description string, k, n byte) *ShamirVault {
 	}
 }
 
-func (v *ShamirVault) InteractiveInitialize() error {
-	if Debug {
-		fmt.Println("[DEBUG] InteractiveInitialize")
+// Enrollment is a key to be enrolled into a vault under a name.
+type Enrollment struct {
+	// Name is the name of the header for the key.
+	Name string
+	// Authenticator is the key to be enrolled.
+	Authenticator fidoutils.Authenticator
+	// Kind is the kind of share to enroll into a Shamir vault. Only
+	// FIDO2 shares, the default, use the Authenticator.
+	Kind ShareKind
+	// Passphrase protects a passphrase share.
+	Passphrase []byte
+	// Export is called with the encoded share of a paper share, which
+	// must be recorded, since it is not stored in the vault.
+	Export func(paper string) error
+}
+
+// Initialize splits the master key into N shares, then enrolls each of the
+// N authenticators by creating a new credential on it and encrypting one
+// share using the key derived from it. All keys must be connected. Enrollments
+// of other kinds protect their share using a passphrase, or export it.
+func (v *ShamirVault) Initialize(ctx context.Context, masterKey []byte, enrollments []Enrollment, src Sources) error {
+	if len(enrollments) != int(v.N) {
+		return ErrWrongKeyCount
 	}
 
-	// fixme prompt inputPath for this key
-	masterKeyHex := utils.ReadNonEmptyLine("Enter a master key (hex), or leave blank to randomly generate one: ")
-	var masterKey []byte
-	if len(masterKeyHex) > 0 {
-		var err error
-		masterKey, err = hex.DecodeString(masterKeyHex)
+	shares, passwordKey, err := v.prepareShares(masterKey, src)
+	if err != nil {
+		return err
+	}
+
+	for i, enrollment := range enrollments {
+		index := byte(i + 1)
+		err := v.enrollShare(ctx, index, shares[index], enrollment, passwordKey, src)
 		if err != nil {
-			return fmt.Errorf("decode master key: %w", err)
+			return fmt.Errorf("enroll '%s': %w", enrollment.Name, err)
 		}
-	} else {
-		masterKey = utils.RandomBytes(32)
-		fmt.Println("Master Key:", hex.EncodeToString(masterKey))
+	}
+	v.authenticate(masterKey)
+	return nil
+}
+
+// prepareShares splits the master key into N shares, indexed 1 to N,
+// and derives the password key if the vault is encrypted.
+func (v *ShamirVault) prepareShares(masterKey []byte, src Sources) (map[byte][]byte, []byte, error) {
+	if len(v.Shares) > 0 {
+		return nil, nil, ErrAlreadyInitialized
+	}
+	if v.K < 2 || v.N < v.K {
+		return nil, nil, ErrInvalidThreshold
 	}
 
 	shares, err := shamir.SplitTagged(masterKey, v.K, v.N)
 	if err != nil {
-		return fmt.Errorf("split: %w", err)
-	}
-
-	enableEncryption := utils.ReadNonEmptyLine("Do you want to encrypt the master key with a password? (y/N):")
-	switch strings.ToLower(enableEncryption) {
-	case "y", "yes", "1", "true":
-		v.Encrypted = true
-		v.EncryptionSalt = utils.RandomBytes(16)
-	}
-
-	fmt.Println()
-	fmt.Println("You will now be walked through the process of adding keys to your vault.")
-	fmt.Println("You will be asked to plug in each key you wish to add.")
-	fmt.Println("You may plug in multiple keys at once; you will be prompted to select one.")
-	fmt.Println()
-	fmt.Println("Note that all keys must be present while creating a Shamir vault.")
-	fmt.Println("See README.md for more information on this technical requirement.")
-	fmt.Println()
-
-	for i, share := range shares {
-		// in the normal case, or when assumptions are permitted but cannot
-		// be made, wait for user input before attempting an assertion.
-		if !MakeAssumptions || fidoutils.GetConnectedDeviceCount() < int(v.N) {
-			utils.ReadLine("Insert in the next key you want to use, then press ENTER.")
-		}
+		return nil, nil, fmt.Errorf("split: %w", err)
+	}
+
+	passwordKey, err := v.passwordKey(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	return shares, passwordKey, nil
+}
+
+// enrollShare encrypts a share for a new credential on the enrollment's
+// authenticator, or protects it as another kind of share.
+func (v *ShamirVault) enrollShare(ctx context.Context, index byte, share []byte, enrollment Enrollment, passwordKey []byte, src Sources) error {
+	header := &VaultHeader{
+		Name:  enrollment.Name,
+		Bound: true,
+		Kind:  enrollment.Kind,
+	}
 
-		dev, err := fidoutils.InteractiveGetDevice()
+	var err error
+	switch enrollment.Kind {
+	case ShareFIDO2:
+		var derivedKey []byte
+		header.CredentialID, derivedKey, err = v.enroll(ctx, enrollment.Authenticator, src)
 		if err != nil {
-			return fmt.Errorf("get device: %w", err)
+			return err
 		}
-
-		pin, err := fidoutils.InteractiveGetPIN(dev)
+		header.EncryptedKey, err = v.sealKey(derivedKey, passwordKey, share, v.associatedData(strconv.Itoa(int(index)), header))
 		if err != nil {
-			return fmt.Errorf("get pin: %w", err)
+			return fmt.Errorf("encrypt share: %w", err)
 		}
+	case SharePassphrase:
+		err = v.sealPassphrase(strconv.Itoa(int(index)), header, share, enrollment.Passphrase, passwordKey)
+	case SharePaper:
+		err = v.exportPaperShare(index, header, share, enrollment.Export)
+	default:
+		err = fmt.Errorf("%w: %s", ErrUnknownShareKind, enrollment.Kind)
+	}
+	if err != nil {
+		return err
+	}
+	v.Shares[index] = header
+	v.Metadata.Modified = time.Now().UTC()
+	return nil
+}
 
-		cred, err := fidoutils.InteractiveMakeCredentialFor(dev, pin)
-		if err != nil {
-			return fmt.Errorf("create credential: %w", err)
+// DecryptShare recovers the share encrypted for the credential held by the
+// authenticator, returning the share along with its index.
+func (v *ShamirVault) DecryptShare(ctx context.Context, auth fidoutils.Authenticator, src Sources) (byte, []byte, error) {
+	if len(v.Shares) == 0 {
+		return 0, nil, ErrNotInitialized
+	}
+
+	credID, derivedKey, err := v.derive(ctx, auth, src, v.GetCredIDs())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	index, header, err := v.GetHeaderByCredID(credID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("get header by credID: %w", err)
+	}
+
+	passwordKey, err := v.passwordKey(src)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	share, err := v.openKey(derivedKey, passwordKey, header.EncryptedKey, v.associatedData(strconv.Itoa(int(index)), header))
+	if err != nil {
+		return 0, nil, fmt.Errorf("decrypt share: %w", err)
+	}
+	return index, share, nil
+}
+
+// Combine recovers the master key from at least K decrypted shares. The
+// master key of a version 0 vault is returned along with ErrUnverified.
+func (v *ShamirVault) Combine(shares map[byte][]byte) ([]byte, error) {
+	if len(shares) < int(v.K) {
+		return nil, ErrNotEnoughShares
+	}
+
+	masterKey, err := shamir.CombineTagged(shares)
+	if err != nil {
+		return nil, fmt.Errorf("combine: %w", err)
+	}
+
+	// also detects shares which were swapped or corrupted, which combine to the wrong key
+	err = v.Verify(masterKey)
+	if errors.Is(err, ErrUnverified) {
+		return masterKey, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return masterKey, nil
+}
+
+// AddShare enrolls a new key into an initialized vault using at least K
+// decrypted shares, without changing the existing shares. The polynomial
+// behind the shares is reconstructed and evaluated at an unused index to
+// produce a new share, which is encrypted for the enrollment. N is increased
+// by one, and K is unchanged. The index of the new share is returned.
+func (v *ShamirVault) AddShare(ctx context.Context, shares map[byte][]byte, enrollment Enrollment, src Sources) (byte, error) {
+	if len(v.Shares) == 0 {
+		return 0, ErrNotInitialized
+	}
+	if len(v.Shares) >= 255 {
+		return 0, ErrVaultFull
+	}
+
+	// combining also verifies the shares and the vault
+	masterKey, err := v.Combine(shares)
+	if err != nil {
+		return 0, err
+	}
+
+	index := byte(1)
+	for v.Shares[index] != nil {
+		index++
+	}
+
+	passwordKey, err := v.passwordKey(src)
+	if err != nil {
+		return 0, err
+	}
+
+	err = v.enrollShare(ctx, index, evaluateShare(shares, index), enrollment, passwordKey, src)
+	if err != nil {
+		return 0, fmt.Errorf("enroll '%s': %w", enrollment.Name, err)
+	}
+	v.N++
+	v.authenticate(masterKey)
+	return index, nil
+}
+
+// Reshare replaces every share with a new set of shares of the same master key,
+// using at least K decrypted shares of the current set. Shares are created for
+// each of the enrollments, which must all be present, with a new threshold of k.
+// Shares from earlier generations cannot be combined with the new shares. The
+// vault is left unchanged if any enrollment fails.
+func (v *ShamirVault) Reshare(ctx context.Context, shares map[byte][]byte, k byte, enrollments []Enrollment, src Sources) error {
+	if len(enrollments) > 255 {
+		return ErrInvalidThreshold
+	}
+
+	masterKey, err := v.Combine(shares)
+	if err != nil {
+		return err
+	}
+
+	next := v.successor(k, byte(len(enrollments)))
+	err = next.Initialize(ctx, masterKey, enrollments, src)
+	if err != nil {
+		return err
+	}
+	*v = *next
+	return nil
+}
+
+// successor returns an empty copy of the vault for the next generation of shares.
+func (v *ShamirVault) successor(k, n byte) *ShamirVault {
+	base := *v.BaseVault
+	base.MAC = nil
+	return &ShamirVault{
+		BaseVault:  &base,
+		K:          k,
+		N:          n,
+		Shares:     map[byte]*VaultHeader{},
+		Generation: v.Generation + 1,
+	}
+}
+
+// UpgradeKDF replaces the password layer of every stored share using a new salt
+// and the parameters, such as to strengthen them. The FIDO2 keys are not needed,
+// but the master key is required to authenticate the vault afterward. Passphrase
+// shares keep their own KDF parameters, and paper shares have no password layer.
+func (v *ShamirVault) UpgradeKDF(masterKey []byte, params crypto.KDFParams, src Sources) error {
+	err := v.Verify(masterKey)
+	if err != nil {
+		return err
+	}
+
+	var headers []*VaultHeader
+	for _, h := range v.Shares {
+		if h.Kind != SharePaper {
+			headers = append(headers, h)
 		}
-		if Debug {
-			fmt.Printf("[DEBUG] credID: %x\n", cred.CredentialID)
+	}
+	err = v.rewrap(headers, params, src)
+	if err != nil {
+		return err
+	}
+	v.authenticate(masterKey)
+	return nil
+}
+
+// evaluateShare computes the share at index x on the polynomials which pass
+// through the shares, including the tag bytes added by shamir.SplitTagged.
+func evaluateShare(shares map[byte][]byte, x byte) []byte {
+	var length int
+	for _, share := range shares {
+		length = len(share)
+		break
+	}
+
+	samples := make([]galois.Point, 0, len(shares))
+	share := make([]byte, length)
+	for i := range share {
+		samples = samples[:0]
+		for index, s := range shares {
+			samples = append(samples, galois.Point{X: index, Y: s[i]})
 		}
+		share[i] = shamir.GaloisField.Interpolate(samples, x)
+	}
+	return share
+}
 
-		assertion, err := fidoutils.InteractiveAssertionFor(dev, pin, [][]byte{cred.CredentialID})
-		if err != nil {
-			return fmt.Errorf("assertion: %w", err)
+// Unlock recovers the master key using the authenticators, at
+// least K of which must hold credentials for different shares.
+// Shares of other kinds are not used. The master key of a version 0
+// vault is returned along with ErrUnverified.
+func (v *ShamirVault) Unlock(ctx context.Context, auths []fidoutils.Authenticator, src Sources) ([]byte, error) {
+	shares := map[byte][]byte{}
+	for _, auth := range auths {
+		if len(shares) == int(v.K) {
+			break
 		}
 
-		aead, err := chacha20poly1305.New(assertion.HMACSecret)
-		if err != nil {
-			return fmt.Errorf("create aead: %w", err)
+		index, share, err := v.DecryptShare(ctx, auth, src)
+		if errors.Is(err, ErrNotEnrolled) {
+			continue
 		}
-		encryptedKey, err := crypto.EncryptChaCha20(aead, share)
 		if err != nil {
-			return fmt.Errorf("encrypt vault master key: %w", err)
+			return nil, err
 		}
+		shares[index] = share
+	}
+
+	return v.Combine(shares)
+}
+
+// InteractiveInitialize walks the user through choosing a master key,
+// then enrolling all N keys.
+func (v *ShamirVault) InteractiveInitialize() error {
+	if Debug {
+		fmt.Println("[DEBUG] InteractiveInitialize")
+	}
+	if len(v.Shares) > 0 {
+		return ErrAlreadyInitialized
+	}
+
+	masterKey, err := interactiveMasterKey()
+	if err != nil {
+		return err
+	}
 
-		// transparent encrypt master key
-		if v.Encrypted {
-			pass := utils.ReadNonEmptyLine("Please enter a new vault encryption password: ")
-			key := crypto.HashPassword([]byte(pass), v.EncryptionSalt)
-			aead, err = chacha20poly1305.New(key)
+	err = v.interactiveEncryption()
+	if err != nil {
+		return err
+	}
+	return v.InteractiveEnroll(masterKey, nil, nil)
+}
+
+// InteractiveEnroll walks the user through enrolling all N keys to protect
+// the master key. Names are used for the keys in order, and any which are
+// missing or empty are prompted for. Likewise, kinds are used for the shares
+// in order, and any which are missing are FIDO2 shares.
+func (v *ShamirVault) InteractiveEnroll(masterKey []byte, names []string, kinds []ShareKind) error {
+	return v.interactiveEnroll(masterKey, names, kinds, interactiveSources(true))
+}
+
+func (v *ShamirVault) interactiveEnroll(masterKey []byte, names []string, kinds []ShareKind, src Sources) error {
+	shares, passwordKey, err := v.prepareShares(masterKey, src)
+	if err != nil {
+		return err
+	}
+
+	keys := int(v.N) - countOther(kinds)
+	Prompter.Notify("")
+	Prompter.Notify("You will now be walked through the process of adding keys to your vault.")
+	if keys > 0 {
+		Prompter.Notify("You will be asked to plug in each key you wish to add.")
+		Prompter.Notify("You may plug in multiple keys at once; you will be prompted to select one.")
+		Prompter.Notify("")
+		Prompter.Notify("Note that all keys must be present while creating a Shamir vault.")
+		Prompter.Notify("See README.md for more information on this technical requirement.")
+	}
+	Prompter.Notify("")
+
+	for index := byte(1); index <= v.N; index++ {
+		enrollment := Enrollment{Kind: ShareFIDO2}
+		if int(index) <= len(names) {
+			enrollment.Name = names[index-1]
+		}
+		if int(index) <= len(kinds) {
+			enrollment.Kind = kinds[index-1]
+		}
+
+		if enrollment.Kind == ShareFIDO2 {
+			// in the normal case, or when assumptions are permitted but cannot
+			// be made, wait for user input before attempting an assertion.
+			err := waitForKeys("Insert in the next key you want to use, then press ENTER.", keys)
 			if err != nil {
-				return fmt.Errorf("create aead: %w", err)
+				return err
 			}
-			encryptedKey, err = crypto.EncryptChaCha20(aead, encryptedKey)
+
+			enrollment.Authenticator, err = fidoutils.InteractiveGetDevice()
 			if err != nil {
-				return fmt.Errorf("encrypt vault master key: %w", err)
+				return fmt.Errorf("get device: %w", err)
 			}
 		}
 
-		name := utils.ReadNonEmptyLine("Enter a name for this key: ")
+		enrollment, err := interactiveEnrollment(enrollment)
+		if err != nil {
+			return err
+		}
 
-		v.Shares[i] = &VaultHeader{
-			Name:         name,
-			CredentialID: assertion.CredentialID,
-			EncryptedKey: encryptedKey,
+		err = v.enrollShare(context.Background(), index, shares[index], enrollment, passwordKey, src)
+		if err != nil {
+			return fmt.Errorf("enroll '%s': %w", enrollment.Name, err)
+		}
+		if Debug {
+			fmt.Printf("[DEBUG] credID: %x\n", v.Shares[index].CredentialID)
 		}
 	}
 
-	v.Metadata.Modified = time.Now().UTC()
+	v.authenticate(masterKey)
+	return nil
+}
+
+// InteractiveAddShare walks the user through unlocking the vault using K
+// enrolled keys, then enrolling a new share of the kind under the name,
+// which is prompted for if it is empty.
+func (v *ShamirVault) InteractiveAddShare(name string, kind ShareKind) error {
+	if len(v.Shares) == 0 {
+		return ErrNotInitialized
+	}
+	if len(v.Shares) >= 255 {
+		return ErrVaultFull
+	}
+
+	src := interactiveSources(false)
+	shares, err := v.interactiveDecryptShares(src)
+	if err != nil {
+		return err
+	}
+	Prompter.Notify("")
+
+	enrollment := Enrollment{Name: name, Kind: kind}
+	if kind == ShareFIDO2 {
+		Prompter.Notify("Insert the FIDO2 key you want to add.")
+		err = waitForKeys("Press ENTER when you have inserted the key.", 1)
+		if err != nil {
+			return err
+		}
+
+		enrollment.Authenticator, err = fidoutils.InteractiveGetDevice()
+		if err != nil {
+			return fmt.Errorf("get device: %w", err)
+		}
+	}
+
+	enrollment, err = interactiveEnrollment(enrollment)
+	if err != nil {
+		return err
+	}
+
+	index, err := v.AddShare(context.Background(), shares, enrollment, src)
+	if err != nil {
+		return fmt.Errorf("add share: %w", err)
+	}
+	if Debug {
+		fmt.Printf("[DEBUG] index: %d, credID: %x\n", index, v.Shares[index].CredentialID)
+	}
+	return nil
+}
+
+// InteractiveReshare walks the user through unlocking the vault using K enrolled
+// keys, then enrolling N keys to replace every share. If k or n are zero, the
+// current values are kept. Names and kinds are used as in InteractiveEnroll.
+func (v *ShamirVault) InteractiveReshare(k, n byte, names []string, kinds []ShareKind) error {
+	if k == 0 {
+		k = v.K
+	}
+	if n == 0 {
+		n = v.N
+	}
+	if k < 2 || n < k {
+		return ErrInvalidThreshold
+	}
+
+	src := interactiveSources(false)
+	shares, err := v.interactiveDecryptShares(src)
+	if err != nil {
+		return err
+	}
+
+	masterKey, err := v.Combine(shares)
+	if err != nil {
+		return err
+	}
+
+	next := v.successor(k, n)
+	err = next.interactiveEnroll(masterKey, names, kinds, src)
+	if err != nil {
+		return err
+	}
+	*v = *next
 	return nil
 }
 
+// InteractiveUpgradeKDF walks the user through unlocking the vault using
+// K enrolled keys, then replacing the password layer using the parameters.
+func (v *ShamirVault) InteractiveUpgradeKDF(params crypto.KDFParams) error {
+	if !v.Encrypted {
+		return ErrNotEncrypted
+	}
+
+	src := interactiveSources(false)
+	shares, err := v.interactiveDecryptShares(src)
+	if err != nil {
+		return err
+	}
+
+	masterKey, err := v.Combine(shares)
+	if err != nil {
+		return err
+	}
+	return v.UpgradeKDF(masterKey, params, src)
+}
+
+// InteractiveCombine walks the user through unlocking the vault using K
+// enrolled keys, or shares of other kinds.
 func (v *ShamirVault) InteractiveCombine() ([]byte, error) {
 	if Debug {
 		fmt.Println("[DEBUG] InteractiveCombine")
 	}
 
-	fmt.Println("You will now be walked through the process of combining shares.")
-	fmt.Println("You will be asked to plug in and authenticate using enrolled keys.")
-	fmt.Println("You may plug in multiple keys at once; you will be prompted to select one.")
-	fmt.Println()
-	fmt.Println("You must have at least", v.K, "keys out of the", v.N, "enrolled keys to unlock the vault.")
-	fmt.Println()
+	decryptMap, err := v.interactiveDecryptShares(interactiveSources(false))
+	if err != nil {
+		return nil, err
+	}
+	return v.Combine(decryptMap)
+}
 
-	credIDs := v.GetCredIDs()
+// interactiveDecryptShares walks the user through decrypting K shares using
+// enrolled keys. If the vault has shares of other kinds, the user chooses the
+// source of each share, until K are collected.
+func (v *ShamirVault) interactiveDecryptShares(src Sources) (map[byte][]byte, error) {
+	if len(v.Shares) == 0 {
+		return nil, ErrNotInitialized
+	}
 
-	decryptMap := map[byte][]byte{}
-	for len(decryptMap) < int(v.K) {
-		if !MakeAssumptions || fidoutils.GetConnectedDeviceCount() < int(v.K) {
-			utils.ReadLine("Insert in the next key you want to use, then press ENTER.")
+	var others []byte
+	for _, index := range slices.Sorted(maps.Keys(v.Shares)) {
+		if v.Shares[index].Kind != ShareFIDO2 {
+			others = append(others, index)
 		}
+	}
+	keys := len(v.Shares) - len(others)
 
-		assertion, err := fidoutils.InteractiveAssertion(credIDs)
-		if err != nil {
-			return nil, fmt.Errorf("assertion: %w", err)
-		}
-		if Debug {
-			fmt.Printf("[DEBUG] derived key: %x\n", assertion.HMACSecret)
-		}
-		credID := assertion.CredentialID
-		index, header, err := v.GetHeaderByCredID(credID)
-		if err != nil {
-			return nil, fmt.Errorf("get header by credID: %w", err)
+	Prompter.Notify("You will now be walked through the process of combining shares.")
+	if keys > 0 {
+		Prompter.Notify("You will be asked to plug in and authenticate using enrolled keys.")
+		Prompter.Notify("You may plug in multiple keys at once; you will be prompted to select one.")
+	}
+	Prompter.Notify("")
+	if len(others) == 0 {
+		Prompter.Notify(fmt.Sprint("You must have at least ", v.K, " keys out of the ", v.N, " enrolled keys to unlock the vault."))
+	} else {
+		Prompter.Notify(fmt.Sprint("You must have at least ", v.K, " of the ", v.N, " shares to unlock the vault."))
+		if keys > 0 {
+			Prompter.Notify("Besides keys, these shares can be used:")
+		} else {
+			Prompter.Notify("These shares can be used:")
 		}
-
-		if _, ok := decryptMap[index]; ok {
-			fmt.Println("You already used this key. Select another key to unlock the vault.")
-			continue
+		for _, index := range others {
+			Prompter.Notify(fmt.Sprintf("  %d: %s (%s)", index, v.Shares[index].Name, v.Shares[index].Kind))
 		}
+	}
+	Prompter.Notify("")
 
-		aead, err := chacha20poly1305.New(assertion.HMACSecret)
-		if err != nil {
-			return nil, fmt.Errorf("create aead: %w", err)
+	decryptMap := map[byte][]byte{}
+	for len(decryptMap) < int(v.K) {
+		var index byte
+		var share []byte
+		var err error
+		if len(others) == 0 {
+			err = waitForKeys("Insert in the next key you want to use, then press ENTER.", int(v.K))
+		} else {
+			question := "Insert the next key you want to use and press ENTER, or enter the number of another share: "
+			if keys == 0 {
+				question = "Enter the number of the next share you want to use: "
+			}
+			var selection string
+			selection, err = Prompter.AskText(question)
+			if err == nil && selection == "" && keys == 0 {
+				continue
+			}
+			if err == nil && selection != "" {
+				index, share, err = v.interactiveOtherShare(selection, src)
+				if errors.Is(err, ErrNoHeader) {
+					Prompter.Notify(fmt.Sprintf("There is no passphrase or paper share numbered '%s'. Try again.", selection))
+					continue
+				}
+				if errors.Is(err, ErrWrongPassphrase) || errors.Is(err, ErrInvalidPaperShare) {
+					Prompter.Notify(fmt.Sprintf("The share cannot be used: %s. Try again.", err))
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
 		}
-		decryptedKey, err := crypto.DecryptChaCha20(aead, header.EncryptedKey)
 		if err != nil {
-			return nil, fmt.Errorf("decrypt vault master key: %w", err)
+			return nil, err
 		}
 
-		decryptMap[index] = decryptedKey
-	}
-
-	masterKey, err := shamir.CombineTagged(decryptMap)
-	if err != nil {
-		return nil, fmt.Errorf("combine: %w", err)
-	}
+		if share == nil {
+			dev, err := fidoutils.InteractiveGetDevice()
+			if err != nil {
+				return nil, fmt.Errorf("get device: %w", err)
+			}
 
-	// fixme enter into loop for password? possibly delegate responsibility
-	// transparent decrypt master key
-	if v.Encrypted {
-		pass := utils.ReadNonEmptyLine("Vault is encrypted. Enter the vault encryption password: ")
-		key := crypto.HashPassword([]byte(pass), v.EncryptionSalt)
-		aead, err := chacha20poly1305.New(key)
-		if err != nil {
-			return nil, fmt.Errorf("create aead: %w", err)
+			index, share, err = v.DecryptShare(context.Background(), dev, src)
+			if errors.Is(err, ErrNotEnrolled) {
+				Prompter.Notify("No credentials found: this key is not enrolled in the vault. Try another.")
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
 		}
-		masterKey, err = crypto.DecryptChaCha20(aead, masterKey)
-		if err != nil {
-			return nil, fmt.Errorf("decrypt vault master key: %w", err)
+
+		if _, ok := decryptMap[index]; ok {
+			Prompter.Notify("You already used this share. Select another to unlock the vault.")
+			continue
 		}
+		decryptMap[index] = share
 	}
-
-	return masterKey, nil
+	return decryptMap, nil
 }
 
-// DeleteAllHeaders resets the list of headers.
+// DeleteAllHeaders resets the list of headers, and removes the
+// secrets, which cannot be decrypted without the master key.
 func (v *ShamirVault) DeleteAllHeaders() {
 	v.Shares = map[byte]*VaultHeader{}
+	v.MAC = nil
+	v.Secrets = nil
+	v.Contexts = nil
 	v.Metadata.Modified = time.Now().UTC()
 }
 
@@ -245,7 +670,7 @@ func (v *ShamirVault) MarshalJSON() ([]byte, error) {
 
 func (v *ShamirVault) GetHeaderByCredID(credID []byte) (byte, *VaultHeader, error) {
 	for key, header := range v.Shares {
-		if slices.Equal(header.CredentialID, credID) {
+		if header.Kind == ShareFIDO2 && slices.Equal(header.CredentialID, credID) {
 			return key, header, nil
 		}
 	}
@@ -253,9 +678,22 @@ func (v *ShamirVault) GetHeaderByCredID(credID []byte) (byte, *VaultHeader, erro
 }
 
 func (v *ShamirVault) GetCredIDs() [][]byte {
-	credIDs := make([][]byte, len(v.Shares))
-	for i, h := range v.Shares {
-		credIDs[i-1] = h.CredentialID
+	credIDs := make([][]byte, 0, len(v.Shares))
+	for _, index := range slices.Sorted(maps.Keys(v.Shares)) {
+		if v.Shares[index].Kind == ShareFIDO2 {
+			credIDs = append(credIDs, v.Shares[index].CredentialID)
+		}
 	}
 	return credIDs
 }
+
+// countOther counts the kinds which are not FIDO2 shares.
+func countOther(kinds []ShareKind) int {
+	var n int
+	for _, kind := range kinds {
+		if kind != ShareFIDO2 {
+			n++
+		}
+	}
+	return n
+}
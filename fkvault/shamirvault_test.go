@@ -0,0 +1,230 @@
+package fkvault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zytekaron/shamir-go"
+
+	"fidokit/fidoutils"
+)
+
+// initShamir creates a k of n vault with a FIDO2 share for each of the first n authenticators.
+func initShamir(t *testing.T, auths []fidoutils.Authenticator, masterKey []byte, k, n byte, encrypted bool) *ShamirVault {
+	t.Helper()
+	vault := createVault[*ShamirVault](t, Options{Type: TypeShamir, K: k, N: n, Encrypted: encrypted})
+
+	enrollments := make([]Enrollment, n)
+	for i := range enrollments {
+		enrollments[i] = Enrollment{Name: string(rune('a' + i)), Authenticator: auths[i]}
+	}
+	err := vault.Initialize(context.Background(), masterKey, enrollments, testSources("password"))
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	return vault
+}
+
+func TestShamirVault(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		ctx := context.Background()
+		auths := newAuths(4)
+		src := testSources("password")
+		masterKey := newMasterKey()
+
+		vault := initShamir(t, auths, masterKey, 2, 3, encrypted)
+		vault = roundTrip(t, vault)
+
+		for _, pair := range [][2]int{{0, 1}, {1, 2}, {2, 0}} {
+			got, err := vault.Unlock(ctx, []fidoutils.Authenticator{auths[pair[0]], auths[pair[1]]}, src)
+			if err != nil {
+				t.Fatalf("encrypted=%t: unlock with keys %v: %v", encrypted, pair, err)
+			}
+			if !bytes.Equal(got, masterKey) {
+				t.Errorf("encrypted=%t: unlock with keys %v: wrong master key", encrypted, pair)
+			}
+		}
+
+		_, err := vault.Unlock(ctx, []fidoutils.Authenticator{auths[0], auths[3]}, src)
+		if !errors.Is(err, ErrNotEnoughShares) {
+			t.Errorf("encrypted=%t: unlock with one enrolled key: got %v, want %v", encrypted, err, ErrNotEnoughShares)
+		}
+	}
+}
+
+func TestShamirVaultWrongKeyCount(t *testing.T) {
+	vault := createVault[*ShamirVault](t, Options{Type: TypeShamir, K: 2, N: 3})
+	auths := newAuths(2)
+	enrollments := []Enrollment{{Name: "a", Authenticator: auths[0]}, {Name: "b", Authenticator: auths[1]}}
+
+	err := vault.Initialize(context.Background(), newMasterKey(), enrollments, testSources(""))
+	if !errors.Is(err, ErrWrongKeyCount) {
+		t.Errorf("initialize with too few keys: got %v, want %v", err, ErrWrongKeyCount)
+	}
+}
+
+func TestShamirVaultSwappedShares(t *testing.T) {
+	ctx := context.Background()
+	auths := newAuths(3)
+	src := testSources("")
+
+	vault := initShamir(t, auths, newMasterKey(), 2, 3, false)
+	vault.Shares[1], vault.Shares[2] = vault.Shares[2], vault.Shares[1]
+
+	_, err := vault.Unlock(ctx, auths[:2], src)
+	if err == nil {
+		t.Errorf("unlock with swapped shares succeeded")
+	}
+}
+
+// decryptShares decrypts the shares held by the authenticators.
+func decryptShares(t *testing.T, vault *ShamirVault, auths []fidoutils.Authenticator) map[byte][]byte {
+	t.Helper()
+	shares := map[byte][]byte{}
+	for _, auth := range auths {
+		index, share, err := vault.DecryptShare(context.Background(), auth, testSources("password"))
+		if err != nil {
+			t.Fatalf("decrypt share: %v", err)
+		}
+		shares[index] = share
+	}
+	return shares
+}
+
+func TestEvaluateShare(t *testing.T) {
+	shares, err := shamir.SplitTagged(newMasterKey(), 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	known := map[byte][]byte{1: shares[1], 3: shares[3], 5: shares[5]}
+	for _, x := range []byte{2, 4} {
+		got := evaluateShare(known, x)
+		if !bytes.Equal(got, shares[x]) {
+			t.Errorf("share %d: got %x, want %x", x, got, shares[x])
+		}
+	}
+}
+
+func TestAddShare(t *testing.T) {
+	ctx := context.Background()
+	auths := newAuths(4)
+	src := testSources("password")
+	masterKey := newMasterKey()
+
+	vault := initShamir(t, auths, masterKey, 2, 3, true)
+	shares := decryptShares(t, vault, auths[1:3])
+
+	index, err := vault.AddShare(ctx, shares, Enrollment{Name: "d", Authenticator: auths[3]}, src)
+	if err != nil {
+		t.Fatalf("add share: %v", err)
+	}
+	if index != 4 || vault.N != 4 || vault.K != 2 {
+		t.Errorf("add share: got index %d, k=%d and n=%d, want index 4, k=2 and n=4", index, vault.K, vault.N)
+	}
+
+	vault = roundTrip(t, vault)
+	for _, other := range auths[:3] {
+		got, err := vault.Unlock(ctx, []fidoutils.Authenticator{auths[3], other}, src)
+		if err != nil {
+			t.Fatalf("unlock with the new key: %v", err)
+		}
+		if !bytes.Equal(got, masterKey) {
+			t.Errorf("unlock with the new key: wrong master key")
+		}
+	}
+}
+
+func TestAddShareNotEnoughShares(t *testing.T) {
+	auths := newAuths(4)
+	vault := initShamir(t, auths, newMasterKey(), 2, 3, false)
+	shares := decryptShares(t, vault, auths[:1])
+
+	_, err := vault.AddShare(context.Background(), shares, Enrollment{Name: "d", Authenticator: auths[3]}, testSources(""))
+	if !errors.Is(err, ErrNotEnoughShares) {
+		t.Errorf("add share using one share: got %v, want %v", err, ErrNotEnoughShares)
+	}
+	if len(vault.Shares) != 3 || vault.N != 3 {
+		t.Errorf("vault was changed by a failed add")
+	}
+}
+
+func TestReshare(t *testing.T) {
+	ctx := context.Background()
+	auths := newAuths(5)
+	src := testSources("")
+	masterKey := newMasterKey()
+
+	vault := initShamir(t, auths, masterKey, 2, 3, false)
+	previous := roundTrip(t, vault)
+	shares := decryptShares(t, vault, auths[:2])
+
+	next := []Enrollment{
+		{Name: "a", Authenticator: auths[0]},
+		{Name: "b", Authenticator: auths[1]},
+		{Name: "d", Authenticator: auths[3]},
+		{Name: "e", Authenticator: auths[4]},
+	}
+	err := vault.Reshare(ctx, shares, 3, next, src)
+	if err != nil {
+		t.Fatalf("reshare: %v", err)
+	}
+	if vault.K != 3 || vault.N != 4 || vault.Generation != 1 {
+		t.Errorf("reshare: got k=%d, n=%d and generation %d, want k=3, n=4 and generation 1", vault.K, vault.N, vault.Generation)
+	}
+
+	vault = roundTrip(t, vault)
+	got, err := vault.Unlock(ctx, []fidoutils.Authenticator{auths[0], auths[3], auths[4]}, src)
+	if err != nil {
+		t.Fatalf("unlock the new generation: %v", err)
+	}
+	if !bytes.Equal(got, masterKey) {
+		t.Errorf("unlock the new generation: wrong master key")
+	}
+
+	_, err = vault.Unlock(ctx, []fidoutils.Authenticator{auths[2], auths[3], auths[4]}, src)
+	if !errors.Is(err, ErrNotEnoughShares) {
+		t.Errorf("unlock with a removed key: got %v, want %v", err, ErrNotEnoughShares)
+	}
+
+	// shares of the previous generation do not combine with the new shares
+	mixed := decryptShares(t, vault, []fidoutils.Authenticator{auths[0], auths[4]})
+	for index, share := range decryptShares(t, previous, auths[2:3]) {
+		mixed[index] = share
+	}
+	_, err = vault.Combine(mixed)
+	if len(mixed) != 3 || err == nil || errors.Is(err, ErrNotEnoughShares) {
+		t.Errorf("combine %d shares from different generations: got %v", len(mixed), err)
+	}
+
+	// a second reshare continues counting generations
+	err = vault.Reshare(ctx, decryptShares(t, vault, auths[:1]), 2, next[:2], src)
+	if !errors.Is(err, ErrNotEnoughShares) {
+		t.Errorf("reshare using one share: got %v, want %v", err, ErrNotEnoughShares)
+	}
+	err = vault.Reshare(ctx, decryptShares(t, vault, []fidoutils.Authenticator{auths[0], auths[1], auths[3]}), 2, next[:2], src)
+	if err != nil {
+		t.Fatalf("second reshare: %v", err)
+	}
+	if vault.Generation != 2 {
+		t.Errorf("second reshare: got generation %d, want 2", vault.Generation)
+	}
+}
+
+func TestReshareInvalidThreshold(t *testing.T) {
+	auths := newAuths(3)
+	vault := initShamir(t, auths, newMasterKey(), 2, 3, false)
+	shares := decryptShares(t, vault, auths[:2])
+	before := roundTrip(t, vault)
+
+	next := []Enrollment{{Name: "a", Authenticator: auths[0]}, {Name: "b", Authenticator: auths[1]}}
+	err := vault.Reshare(context.Background(), shares, 3, next, testSources(""))
+	if !errors.Is(err, ErrInvalidThreshold) {
+		t.Errorf("reshare with k > n: got %v, want %v", err, ErrInvalidThreshold)
+	}
+	if vault.K != before.K || vault.N != before.N || vault.Generation != before.Generation {
+		t.Errorf("vault was changed by a failed reshare")
+	}
+}
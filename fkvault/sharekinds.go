@@ -0,0 +1,262 @@
+package fkvault
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"fidokit/crypto"
+	"fidokit/prompt"
+	"fidokit/utils"
+)
+
+// ShareKind is how a share of a Shamir vault is protected.
+type ShareKind string
+
+const (
+	// ShareFIDO2 shares are encrypted using the key derived from a FIDO2 credential.
+	ShareFIDO2 ShareKind = ""
+	// SharePassphrase shares are encrypted using a key derived from a passphrase using Argon2id.
+	SharePassphrase ShareKind = "passphrase"
+	// SharePaper shares are shown once when they are enrolled, to be recorded
+	// outside the vault, such as on paper. Only a digest is stored in the vault.
+	SharePaper ShareKind = "paper"
+)
+
+// ShareKinds lists every kind of share.
+var ShareKinds = []ShareKind{ShareFIDO2, SharePassphrase, SharePaper}
+
+// ErrUnknownShareKind is returned for a kind of share which is not supported.
+var ErrUnknownShareKind = errors.New("unknown share kind")
+
+// ErrShareKind is returned when a share is used as a kind which it is not.
+var ErrShareKind = errors.New("share is a different kind")
+
+// ErrInvalidEnrollment is returned when an enrollment lacks what its kind of share needs.
+var ErrInvalidEnrollment = errors.New("invalid enrollment")
+
+// ErrWrongPassphrase is returned when the passphrase of a passphrase share is incorrect.
+var ErrWrongPassphrase = errors.New("incorrect share passphrase")
+
+// ErrInvalidPaperShare is returned when a paper share is malformed or does not match the vault.
+var ErrInvalidPaperShare = errors.New("invalid paper share")
+
+func (k ShareKind) String() string {
+	if k == ShareFIDO2 {
+		return "fido2"
+	}
+	return string(k)
+}
+
+// ParseShareKind returns the kind of share with the name.
+func ParseShareKind(name string) (ShareKind, error) {
+	for _, k := range ShareKinds {
+		if k.String() == strings.ToLower(name) {
+			return k, nil
+		}
+	}
+	return ShareFIDO2, fmt.Errorf("%w: %s", ErrUnknownShareKind, name)
+}
+
+// sealPassphrase encrypts a secret for the header, identified by its key in the vault,
+// using a key derived from the passphrase with the vault's KDF parameters and a new salt.
+func (v *BaseVault) sealPassphrase(key string, h *VaultHeader, secret, passphrase, passwordKey []byte) error {
+	if len(passphrase) == 0 {
+		return fmt.Errorf("%w: a passphrase is required", ErrInvalidEnrollment)
+	}
+
+	params := v.kdfParams()
+	h.Salt = utils.RandomBytes(16)
+	h.KDF = &params
+	derivedKey, err := params.Key(passphrase, h.Salt)
+	if err != nil {
+		return err
+	}
+
+	h.EncryptedKey, err = v.sealKey(derivedKey, passwordKey, secret, v.associatedData(key, h))
+	if err != nil {
+		return fmt.Errorf("encrypt key: %w", err)
+	}
+	return nil
+}
+
+// openPassphrase reverses sealPassphrase.
+func (v *BaseVault) openPassphrase(key string, h *VaultHeader, passphrase, passwordKey []byte) ([]byte, error) {
+	if h.KDF == nil {
+		return nil, ErrDecrypt
+	}
+	derivedKey, err := h.KDF.Key(passphrase, h.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := v.openKey(derivedKey, passwordKey, h.EncryptedKey, v.associatedData(key, h))
+	if errors.Is(err, ErrDecrypt) {
+		return nil, ErrWrongPassphrase
+	}
+	return secret, err
+}
+
+// DecryptPassphraseShare recovers the passphrase share at the index using its passphrase.
+func (v *ShamirVault) DecryptPassphraseShare(index byte, passphrase []byte, src Sources) ([]byte, error) {
+	h := v.Shares[index]
+	if h == nil {
+		return nil, ErrNoHeader
+	}
+	if h.Kind != SharePassphrase {
+		return nil, fmt.Errorf("%w: share %d is %s", ErrShareKind, index, h.Kind)
+	}
+
+	passwordKey, err := v.passwordKey(src)
+	if err != nil {
+		return nil, err
+	}
+	return v.openPassphrase(strconv.Itoa(int(index)), h, passphrase, passwordKey)
+}
+
+// exportPaperShare records the digest of a paper share in the header, then exports the share.
+func (v *ShamirVault) exportPaperShare(index byte, h *VaultHeader, share []byte, export func(paper string) error) error {
+	if export == nil {
+		return fmt.Errorf("%w: paper shares must be exported", ErrInvalidEnrollment)
+	}
+
+	h.Digest = v.paperDigest(index, h, share)
+	return export(encodePaperShare(index, share))
+}
+
+// paperDigest computes the MAC of the binding of a paper share's header, keyed
+// using the share. Shares are random and as long as the master key, so the
+// digest does not make them any easier to guess.
+func (v *ShamirVault) paperDigest(index byte, h *VaultHeader, share []byte) []byte {
+	return crypto.MAC(share, v.associatedData(strconv.Itoa(int(index)), h))
+}
+
+// encodePaperShare encodes a share as its index followed by its hex encoding,
+// in groups of four digits to make it easier to copy by hand.
+func encodePaperShare(index byte, share []byte) string {
+	digits := hex.EncodeToString(share)
+	groups := make([]string, 0, len(digits)/4+1)
+	for len(digits) > 4 {
+		groups = append(groups, digits[:4])
+		digits = digits[4:]
+	}
+	groups = append(groups, digits)
+	return fmt.Sprintf("%d: %s", index, strings.Join(groups, " "))
+}
+
+// OpenPaperShare decodes a paper share, checking it against its digest in
+// the vault, and returns it along with its index. Whitespace is ignored.
+func (v *ShamirVault) OpenPaperShare(paper string) (byte, []byte, error) {
+	prefix, digits, ok := strings.Cut(paper, ":")
+	index, err := strconv.ParseUint(strings.TrimSpace(prefix), 10, 8)
+	if !ok || err != nil {
+		return 0, nil, fmt.Errorf("%w: it must begin with the share's number and a colon", ErrInvalidPaperShare)
+	}
+	share, err := hex.DecodeString(strings.Join(strings.Fields(digits), ""))
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %w", ErrInvalidPaperShare, err)
+	}
+
+	h := v.Shares[byte(index)]
+	if h == nil || h.Kind != SharePaper {
+		return 0, nil, fmt.Errorf("%w: share %d is not a paper share", ErrInvalidPaperShare, index)
+	}
+	if !crypto.VerifyMAC(share, v.associatedData(strconv.Itoa(int(index)), h), h.Digest) {
+		return 0, nil, fmt.Errorf("%w: it does not match share %d", ErrInvalidPaperShare, index)
+	}
+	return byte(index), share, nil
+}
+
+// interactiveEnrollment completes an enrollment, prompting for its name if it
+// is empty, and for the passphrase of a passphrase share. Paper shares are shown
+// to the user to record as they are enrolled. FIDO2 enrollments must already
+// have their authenticator.
+func interactiveEnrollment(enrollment Enrollment) (Enrollment, error) {
+	var err error
+	if enrollment.Name == "" {
+		noun := "key"
+		if enrollment.Kind != ShareFIDO2 {
+			noun = enrollment.Kind.String() + " share"
+		}
+		enrollment.Name, err = prompt.AskNonEmpty(Prompter, "Enter a name for this "+noun+": ")
+		if err != nil {
+			return Enrollment{}, err
+		}
+	}
+
+	switch enrollment.Kind {
+	case SharePassphrase:
+		enrollment.Passphrase, err = askNewSecret("passphrase", enrollment.Name)
+		if err != nil {
+			return Enrollment{}, err
+		}
+	case SharePaper:
+		name := enrollment.Name
+		enrollment.Export = func(paper string) error {
+			Prompter.Notify("")
+			Prompter.Notify(fmt.Sprintf("Write down paper share '%s' and keep it somewhere safe.", name))
+			Prompter.Notify("It is not stored in the vault, and will not be shown again.")
+			Prompter.Notify("")
+			Prompter.Notify("    " + paper)
+			Prompter.Notify("")
+			_, err := Prompter.AskText("Press ENTER once you have recorded the share.")
+			return err
+		}
+	}
+	return enrollment, nil
+}
+
+// askNewSecret asks for a new passphrase or password, by the noun, twice.
+func askNewSecret(noun, name string) ([]byte, error) {
+	for {
+		pass, err := prompt.AskNonEmptySecret(Prompter, fmt.Sprintf("Enter a new %s for '%s': ", noun, name))
+		if err != nil {
+			return nil, err
+		}
+		confirm, err := Prompter.AskSecret(fmt.Sprintf("Confirm the %s: ", noun))
+		if err != nil {
+			return nil, err
+		}
+		if pass == confirm {
+			return []byte(pass), nil
+		}
+		Prompter.Notify(fmt.Sprintf("The %ss do not match. Try again.", noun))
+	}
+}
+
+// interactiveOtherShare walks the user through entering the passphrase or
+// paper share with the number which they selected.
+func (v *ShamirVault) interactiveOtherShare(selection string, src Sources) (byte, []byte, error) {
+	number, err := strconv.ParseUint(selection, 10, 8)
+	h := v.Shares[byte(number)]
+	if err != nil || h == nil || h.Kind == ShareFIDO2 {
+		return 0, nil, fmt.Errorf("%w: %s", ErrNoHeader, selection)
+	}
+	index := byte(number)
+
+	switch h.Kind {
+	case SharePassphrase:
+		pass, err := prompt.AskNonEmptySecret(Prompter, fmt.Sprintf("Enter the passphrase for share '%s': ", h.Name))
+		if err != nil {
+			return 0, nil, err
+		}
+		share, err := v.DecryptPassphraseShare(index, []byte(pass), src)
+		return index, share, err
+	case SharePaper:
+		paper, err := prompt.AskNonEmptySecret(Prompter, fmt.Sprintf("Enter paper share '%s', including its number: ", h.Name))
+		if err != nil {
+			return 0, nil, err
+		}
+		paperIndex, share, err := v.OpenPaperShare(paper)
+		if err != nil {
+			return 0, nil, err
+		}
+		if paperIndex != index {
+			return 0, nil, fmt.Errorf("%w: it is share %d, not share %d", ErrInvalidPaperShare, paperIndex, index)
+		}
+		return index, share, nil
+	}
+	return 0, nil, fmt.Errorf("%w: %s", ErrUnknownShareKind, h.Kind)
+}
@@ -1,20 +1,17 @@
 package fkvault
 
 import (
-	"encoding/hex"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"maps"
 	"slices"
 	"strings"
 	"time"
 
-	"github.com/keys-pub/go-libfido2"
-	"golang.org/x/crypto/chacha20poly1305"
-
 	"fidokit/crypto"
 	"fidokit/fidoutils"
-	"fidokit/utils"
+	"fidokit/prompt"
 )
 
 type SimpleVault struct {
@@ -33,274 +30,300 @@ func NewSimple(name, description string) *SimpleVault {
 	}
 }
 
-// InteractiveCreateHeader creates a new header encrypting the master key.
-// If there are no existing headers, it generates a new key and adds it.
-// If there are existing headers, it prompts the user to unlock one of
-// them to recover the vault master key, then re-encrypts it using the
-// key the user wants to add and then adds it to the vault.
-func (v *SimpleVault) InteractiveCreateHeader(credentialID, derivedKey []byte, name string) error {
-	// fixme consider passing masterKey here and delegating responsibility to caller (else: global inputPath)
-	if Debug {
-		fmt.Println("[DEBUG] InteractiveVaultCreateHeader")
+// AddHeader enrolls the authenticator into the vault under the name by
+// creating a new credential on it, then encrypting the master key using
+// the key derived from the credential. The master key must be the one
+// already protected by the vault's other headers, if there are any.
+func (v *SimpleVault) AddHeader(ctx context.Context, masterKey []byte, auth fidoutils.Authenticator, name string, src Sources) error {
+	if _, ok := v.Headers[name]; ok {
+		return ErrHeaderExists
 	}
 
-	if len(v.Headers) == 0 {
-		// fixme prompt inputPath for this key
-		var masterKey []byte
-		masterKeyHex := utils.ReadNonEmptyLine("Enter a master key (hex), or leave blank to randomly generate one: ")
-		if len(masterKeyHex) > 0 {
-			var err error
-			masterKey, err = hex.DecodeString(masterKeyHex)
-			if err != nil {
-				log.Fatalln("decode master key:", err)
-			}
-		} else {
-			masterKey = utils.RandomBytes(32)
-			fmt.Println("Master Key:", hex.EncodeToString(masterKey))
-		}
+	err := v.Verify(masterKey)
+	if err != nil {
+		return err
+	}
 
-		aead, err := chacha20poly1305.New(derivedKey)
-		if err != nil {
-			return fmt.Errorf("create aead: %w", err)
-		}
-		encryptedKey, err := crypto.EncryptChaCha20(aead, masterKey)
-		if err != nil {
-			return fmt.Errorf("encrypt vault master key: %w", err)
-		}
+	passwordKey, err := v.passwordKey(src)
+	if err != nil {
+		return err
+	}
 
-		enableEncryption := utils.ReadNonEmptyLine("Do you want to encrypt the master key with a password? (y/N):")
-		switch strings.ToLower(enableEncryption) {
-		case "y", "yes", "1", "true":
-			v.Encrypted = true
-			v.EncryptionSalt = utils.RandomBytes(16)
-		}
+	var credID, derivedKey []byte
+	if v.Resident {
+		credID, derivedKey, err = v.enrollResident(ctx, auth, src, masterKey)
+	} else {
+		credID, derivedKey, err = v.enroll(ctx, auth, src)
+	}
+	if err != nil {
+		return fmt.Errorf("enroll: %w", err)
+	}
 
-		// transparent encrypt master key
-		if v.Encrypted {
-			pass := utils.ReadNonEmptyLine("Please enter a new vault encryption password: ")
-			key := crypto.HashPassword([]byte(pass), v.EncryptionSalt)
-			aead, err = chacha20poly1305.New(key)
-			if err != nil {
-				return fmt.Errorf("create aead: %w", err)
-			}
-			encryptedKey, err = crypto.EncryptChaCha20(aead, encryptedKey)
-			if err != nil {
-				return fmt.Errorf("encrypt vault master key: %w", err)
-			}
-		}
+	header := &VaultHeader{
+		Name:         name,
+		CredentialID: credID,
+		Bound:        true,
+	}
+	header.EncryptedKey, err = v.sealKey(derivedKey, passwordKey, masterKey, v.associatedData(name, header))
+	if err != nil {
+		return fmt.Errorf("encrypt vault master key: %w", err)
+	}
 
-		v.Headers[name] = &VaultHeader{
-			Name:         name,
-			CredentialID: credentialID,
-			EncryptedKey: encryptedKey,
-		}
-		v.Metadata.Modified = time.Now().UTC()
-		return nil
+	if v.Headers == nil {
+		v.Headers = map[string]*VaultHeader{}
 	}
+	v.Headers[name] = header
+	v.authenticate(masterKey)
+	v.Metadata.Modified = time.Now().UTC()
+	return nil
+}
 
-	// use another key to unlock the master key.
+// Unlock recovers the master key using the authenticator, which must
+// hold the credential for one of the headers. The master key of a
+// version 0 vault is returned along with ErrUnverified.
+func (v *SimpleVault) Unlock(ctx context.Context, auth fidoutils.Authenticator, src Sources) ([]byte, error) {
+	if len(v.Headers) == 0 {
+		return nil, ErrNotInitialized
+	}
 
-	fmt.Println("Please unlock one of the existing headers to recover the vault master key.")
-	fmt.Println("Existing keys:", v.HeaderCSVString())
+	credID, derivedKey, err := v.derive(ctx, auth, src, v.GetCredIDs())
+	if err != nil {
+		return nil, err
+	}
 
-	// in the normal case, or when assumptions are permitted but cannot
-	// be made, wait for user input before attempting an assertion.
-	if !MakeAssumptions || fidoutils.GetConnectedDeviceCount() == 0 {
-		utils.ReadLine("Press ENTER to continue once you have plugged in an existing key.")
+	// find the header for the assertion credential id
+	header, err := v.GetHeaderByCredID(credID)
+	if err != nil {
+		return nil, fmt.Errorf("get header by cred ID: %w", err)
 	}
 
-	assertion, err := fidoutils.InteractiveAssertion(v.GetCredIDs())
+	passwordKey, err := v.passwordKey(src)
 	if err != nil {
-		return fmt.Errorf("assertion: %w", err)
+		return nil, err
 	}
 
-	if Debug {
-		fmt.Printf("[DEBUG] derived key from existing header: %x\n", assertion.HMACSecret)
+	// decrypt the master key using the key derived from the FIDO2 assertion's HMAC secret
+	masterKey, err := v.openKey(derivedKey, passwordKey, header.EncryptedKey, v.associatedData(header.Name, header))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt vault master key: %w", err)
 	}
 
-	originalKeyHeader, err := v.GetHeaderByCredID(assertion.CredentialID)
+	err = v.Verify(masterKey)
+	if errors.Is(err, ErrUnverified) {
+		return masterKey, err
+	}
 	if err != nil {
-		return fmt.Errorf("get header by credID: %w", err)
+		return nil, err
 	}
-	originalEncryptedKey := originalKeyHeader.EncryptedKey
+	return masterKey, nil
+}
 
-	// decrypt the vault master key
-	aead, err := chacha20poly1305.New(assertion.HMACSecret)
+// UpgradeKDF replaces the password layer of every header using a new salt and
+// the parameters, such as to strengthen them. The FIDO2 keys are not needed,
+// but the master key is required to authenticate the vault afterward.
+func (v *SimpleVault) UpgradeKDF(masterKey []byte, params crypto.KDFParams, src Sources) error {
+	err := v.Verify(masterKey)
 	if err != nil {
-		return fmt.Errorf("create aead: %w", err)
+		return err
 	}
-	decryptedKey, err := crypto.DecryptChaCha20(aead, originalEncryptedKey)
+
+	err = v.rewrap(slices.Collect(maps.Values(v.Headers)), params, src)
 	if err != nil {
-		return fmt.Errorf("decrypt vault master key: %w", err)
+		return err
 	}
+	v.authenticate(masterKey)
+	return nil
+}
 
-	// fixme enter into loop for password? possibly delegate responsibility
-	// transparent decrypt master key
-	if v.Encrypted {
-		pass := utils.ReadNonEmptyLine("Vault is encrypted. Please enter the vault encryption password: ")
-		key := crypto.HashPassword([]byte(pass), v.EncryptionSalt)
-		aead, err := chacha20poly1305.New(key)
+// InteractiveUpgradeKDF walks the user through unlocking the vault using
+// an enrolled key, then replacing the password layer using the parameters.
+func (v *SimpleVault) InteractiveUpgradeKDF(params crypto.KDFParams) error {
+	if !v.Encrypted {
+		return ErrNotEncrypted
+	}
+
+	src := interactiveSources(false)
+	masterKey, err := v.interactiveUnlock(src)
+	if err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+	return v.UpgradeKDF(masterKey, params, src)
+}
+
+// InteractiveAdd walks the user through enrolling a new key under the name,
+// prompting for it if it is empty. If there are no existing headers, it
+// generates or imports a new master key. Otherwise, it prompts the user
+// to unlock one of them to recover the master key first.
+func (v *SimpleVault) InteractiveAdd(name string) error {
+	if len(v.Headers) == 0 {
+		masterKey, err := interactiveMasterKey()
 		if err != nil {
-			return fmt.Errorf("create aead: %w", err)
+			return err
 		}
-		decryptedKey, err = crypto.DecryptChaCha20(aead, decryptedKey)
+
+		err = v.interactiveEncryption()
 		if err != nil {
-			return fmt.Errorf("decrypt vault master key: %w", err)
+			return err
 		}
+		return v.InteractiveEnroll(masterKey, []string{name})
 	}
 
-	// encrypt the vault master key with the new key
-	aead, err = chacha20poly1305.New(derivedKey)
+	// use another key to unlock the master key.
+	Prompter.Notify("Please unlock one of the existing headers to recover the vault master key.")
+	Prompter.Notify("Existing keys: " + v.HeaderCSVString())
+
+	src := interactiveSources(false)
+	masterKey, err := v.interactiveUnlock(src)
 	if err != nil {
-		return fmt.Errorf("create aead: %w", err)
+		return fmt.Errorf("unlock: %w", err)
 	}
-	encryptedKey, err := crypto.EncryptChaCha20(aead, decryptedKey)
-	if err != nil {
-		return fmt.Errorf("encrypt vault master key: %w", err)
+	Prompter.Notify("")
+
+	return v.interactiveAddHeader(masterKey, name, src)
+}
+
+// InteractiveEnroll walks the user through enrolling a key for each of the
+// names into a vault without headers, protecting the master key. Empty names
+// are prompted for, and if no names are given, a single key is enrolled.
+func (v *SimpleVault) InteractiveEnroll(masterKey []byte, names []string) error {
+	if len(v.Headers) > 0 {
+		return ErrAlreadyInitialized
 	}
-	// add new header
-	v.Headers[name] = &VaultHeader{
-		Name:         name,
-		CredentialID: credentialID,
-		EncryptedKey: encryptedKey,
+	if len(names) == 0 {
+		names = []string{""}
+	}
+
+	src := interactiveSources(true)
+	for _, name := range names {
+		err := v.interactiveAddHeader(masterKey, name, src)
+		if err != nil {
+			return err
+		}
 	}
-	v.Metadata.Modified = time.Now().UTC()
 	return nil
 }
 
-func (v *SimpleVault) InteractiveAdd() error {
-	fmt.Println("Insert the FIDO2 key you want to add.")
-	if !MakeAssumptions || fidoutils.GetConnectedDeviceCount() == 0 {
-		utils.ReadLine("Press ENTER when you have inserted the key.")
+func (v *SimpleVault) interactiveAddHeader(masterKey []byte, name string, src Sources) error {
+	if name == "" {
+		var err error
+		name, err = prompt.AskNonEmpty(Prompter, "Enter a name for the new key: ")
+		for err == nil && v.Headers[name] != nil {
+			name, err = prompt.AskNonEmpty(Prompter, "A key with this name already exists. Enter another name: ")
+		}
+		if err != nil {
+			return err
+		}
 	}
-
-	dev, err := fidoutils.InteractiveGetDevice()
-	if err != nil {
-		return fmt.Errorf("get device: %w", err)
+	if v.Headers[name] != nil {
+		return ErrHeaderExists
 	}
 
-	pin, err := fidoutils.InteractiveGetPIN(dev)
+	Prompter.Notify(fmt.Sprintf("Insert the FIDO2 key you want to add as '%s'.", name))
+	err := waitForKeys("Press ENTER when you have inserted the key.", 1)
 	if err != nil {
-		return fmt.Errorf("get pin: %w", err)
+		return err
 	}
 
-	cred, err := fidoutils.InteractiveMakeCredentialFor(dev, pin)
+	dev, err := fidoutils.InteractiveGetDevice()
 	if err != nil {
-		return fmt.Errorf("create credential: %w", err)
-	}
-	if Debug {
-		fmt.Printf("[DEBUG] credID: %x\n", cred.CredentialID)
+		return fmt.Errorf("get device: %w", err)
 	}
 
-	assertion, err := fidoutils.InteractiveAssertionFor(dev, pin, [][]byte{cred.CredentialID})
+	err = v.AddHeader(context.Background(), masterKey, dev, name, src)
 	if err != nil {
-		return fmt.Errorf("assertion: %w", err)
+		return fmt.Errorf("add header: %w", err)
 	}
 
 	if Debug {
-		fmt.Printf("[DEBUG] derived key: %x\n", assertion.HMACSecret)
+		fmt.Printf("[DEBUG] credID: %x\n", v.Headers[name].CredentialID)
 	}
-
-	name := utils.ReadNonEmptyLine("Enter a name for this key: ")
-	err = v.InteractiveCreateHeader(cred.CredentialID, assertion.HMACSecret, name)
-	if err != nil {
-		return fmt.Errorf("create header: %w", err)
-	}
-
 	return nil
 }
 
-func (v *SimpleVault) InteractiveDelete() error {
-	name := ""
-	for name == "" {
-		name = utils.ReadNonEmptyLine("Enter key name to delete: ")
+// InteractiveDelete walks the user through deleting the header with the name,
+// prompting for it if it is empty. The user must unlock the vault first.
+func (v *SimpleVault) InteractiveDelete(name string) error {
+	if name == "" {
+		var err error
+		name, err = prompt.AskNonEmpty(Prompter, "Enter key name to delete: ")
+		if err != nil {
+			return err
+		}
+	}
+	if v.Headers[name] == nil {
+		return ErrNoHeader
 	}
 
-	err := v.DeleteHeader(name)
+	Prompter.Notify("Please unlock the vault to confirm the deletion.")
+	masterKey, err := v.InteractiveUnlock()
 	if err != nil {
-		if errors.Is(err, ErrNoHeader) {
-			fmt.Println("Header not found!")
-		}
-		log.Fatalln("delete header:", err)
+		return fmt.Errorf("unlock: %w", err)
+	}
+
+	err = v.DeleteHeader(masterKey, name)
+	if err != nil {
+		return fmt.Errorf("delete header: %w", err)
 	}
 
-	fmt.Println("Header deleted!")
+	Prompter.Notify("Header deleted!")
 	return nil
 }
 
+// InteractiveUnlock walks the user through unlocking the vault using an enrolled key.
 func (v *SimpleVault) InteractiveUnlock() ([]byte, error) {
+	return v.interactiveUnlock(interactiveSources(false))
+}
+
+func (v *SimpleVault) interactiveUnlock(src Sources) ([]byte, error) {
 	if len(v.Headers) == 0 {
 		return nil, ErrNotInitialized
 	}
 
-	credentialIDs := v.GetCredIDs()
-
-	var err error
-	var assertion *libfido2.Assertion
-	// fixme I don't like this loop
-	for assertion == nil {
-		if !MakeAssumptions || fidoutils.GetConnectedDeviceCount() == 0 {
-			utils.ReadLine("Insert an enrolled FIDO2 key, then press ENTER.")
+	for {
+		err := waitForKeys("Insert an enrolled FIDO2 key, then press ENTER.", 1)
+		if err != nil {
+			return nil, err
 		}
 
-		assertion, err = fidoutils.InteractiveAssertion(credentialIDs)
-		if errors.Is(err, libfido2.ErrNoCredentials) {
-			fmt.Println("No credentials found: this key is not enrolled in the vault. Try another.")
-			continue
-		} else if err != nil {
-			return nil, fmt.Errorf("assertion: %w", err)
-		}
-	}
-
-	if Debug {
-		fmt.Printf("[DEBUG] derived key: %x\n", assertion.HMACSecret)
-	}
-
-	// find the header for the assertion credential id
-	header, err := v.GetHeaderByCredID(assertion.CredentialID)
-	if err != nil {
-		return nil, fmt.Errorf("get header by cred ID: %w", err)
-	}
-	encryptedKey := header.EncryptedKey
-
-	// decrypt the master key using the key derived from the FIDO2 assertion's HMAC secret
-	aead, _ := chacha20poly1305.New(assertion.HMACSecret)
-	masterKey, err := crypto.DecryptChaCha20(aead, encryptedKey)
-	if err != nil {
-		return nil, fmt.Errorf("decrypt: %w", err)
-	}
-
-	// fixme enter into loop for password? possibly delegate responsibility
-	// transparent decrypt master key
-	if v.Encrypted {
-		pass := utils.ReadNonEmptyLine("Vault is encrypted. Enter the vault encryption password: ")
-		key := crypto.HashPassword([]byte(pass), v.EncryptionSalt)
-		aead, err := chacha20poly1305.New(key)
+		dev, err := fidoutils.InteractiveGetDevice()
 		if err != nil {
-			return nil, fmt.Errorf("create aead: %w", err)
+			return nil, fmt.Errorf("get device: %w", err)
 		}
-		masterKey, err = crypto.DecryptChaCha20(aead, masterKey)
-		if err != nil {
-			return nil, fmt.Errorf("decrypt vault master key: %w", err)
+
+		masterKey, err := v.Unlock(context.Background(), dev, src)
+		if errors.Is(err, ErrNotEnrolled) {
+			Prompter.Notify("No credentials found: this key is not enrolled in the vault. Try another.")
+			continue
 		}
+		return masterKey, err
 	}
-
-	return masterKey, nil
 }
 
-func (v *SimpleVault) DeleteHeader(name string) error {
+// DeleteHeader removes the header with the name. The master key is
+// required to authenticate the vault after the header is removed.
+func (v *SimpleVault) DeleteHeader(masterKey []byte, name string) error {
 	if _, ok := v.Headers[name]; !ok {
 		return ErrNoHeader
 	}
 
+	err := v.Verify(masterKey)
+	if err != nil {
+		return err
+	}
+
 	delete(v.Headers, name)
+	v.authenticate(masterKey)
 	v.Metadata.Modified = time.Now().UTC()
 	return nil
 }
 
-// DeleteAllHeaders resets the list of headers.
+// DeleteAllHeaders resets the list of headers, and removes the
+// secrets, which cannot be decrypted without the master key.
 func (v *SimpleVault) DeleteAllHeaders() {
 	v.Headers = nil
+	v.MAC = nil
+	v.Secrets = nil
+	v.Contexts = nil
 	v.Metadata.Modified = time.Now().UTC()
 }
 
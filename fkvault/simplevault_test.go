@@ -0,0 +1,102 @@
+package fkvault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSimpleVault(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		ctx := context.Background()
+		auths := newAuths(3)
+		src := testSources("password")
+		masterKey := newMasterKey()
+
+		vault := createVault[*SimpleVault](t, Options{Type: TypeSimple, Name: "test", Encrypted: encrypted})
+		for i, name := range []string{"first", "second"} {
+			err := vault.AddHeader(ctx, masterKey, auths[i], name, src)
+			if err != nil {
+				t.Fatalf("encrypted=%t: add '%s': %v", encrypted, name, err)
+			}
+		}
+
+		err := vault.AddHeader(ctx, masterKey, auths[2], "first", src)
+		if !errors.Is(err, ErrHeaderExists) {
+			t.Errorf("encrypted=%t: add duplicate name: got %v, want %v", encrypted, err, ErrHeaderExists)
+		}
+		err = vault.AddHeader(ctx, newMasterKey(), auths[2], "third", src)
+		if !errors.Is(err, ErrModified) {
+			t.Errorf("encrypted=%t: add with another master key: got %v, want %v", encrypted, err, ErrModified)
+		}
+
+		vault = roundTrip(t, vault)
+		for i, auth := range auths[:2] {
+			got, err := vault.Unlock(ctx, auth, src)
+			if err != nil {
+				t.Fatalf("encrypted=%t: unlock with key %d: %v", encrypted, i, err)
+			}
+			if !bytes.Equal(got, masterKey) {
+				t.Errorf("encrypted=%t: unlock with key %d: wrong master key", encrypted, i)
+			}
+		}
+
+		_, err = vault.Unlock(ctx, auths[2], src)
+		if !errors.Is(err, ErrNotEnrolled) {
+			t.Errorf("encrypted=%t: unlock with unenrolled key: got %v, want %v", encrypted, err, ErrNotEnrolled)
+		}
+		if encrypted {
+			_, err = vault.Unlock(ctx, auths[0], testSources("wrong"))
+			if !errors.Is(err, ErrWrongPassword) {
+				t.Errorf("unlock with wrong password: got %v, want %v", err, ErrWrongPassword)
+			}
+		}
+	}
+}
+
+func TestSimpleVaultDeleteHeader(t *testing.T) {
+	ctx := context.Background()
+	auths := newAuths(2)
+	src := testSources("")
+	masterKey := newMasterKey()
+
+	vault := createVault[*SimpleVault](t, Options{Type: TypeSimple})
+	for i, name := range []string{"first", "second"} {
+		err := vault.AddHeader(ctx, masterKey, auths[i], name, src)
+		if err != nil {
+			t.Fatalf("add '%s': %v", name, err)
+		}
+	}
+
+	err := vault.DeleteHeader(masterKey, "first")
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	_, err = vault.Unlock(ctx, auths[0], src)
+	if !errors.Is(err, ErrNotEnrolled) {
+		t.Errorf("unlock with deleted key: got %v, want %v", err, ErrNotEnrolled)
+	}
+	_, err = vault.Unlock(ctx, auths[1], src)
+	if err != nil {
+		t.Errorf("unlock with remaining key: %v", err)
+	}
+}
+
+func TestSimpleVaultModified(t *testing.T) {
+	ctx := context.Background()
+	auths := newAuths(1)
+	src := testSources("")
+
+	vault := createVault[*SimpleVault](t, Options{Type: TypeSimple, Name: "test"})
+	err := vault.AddHeader(ctx, newMasterKey(), auths[0], "first", src)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	vault.Name = "renamed"
+	_, err = vault.Unlock(ctx, auths[0], src)
+	if !errors.Is(err, ErrModified) {
+		t.Errorf("unlock after renaming: got %v, want %v", err, ErrModified)
+	}
+}
@@ -1,16 +1,22 @@
 module fidokit
 
-go 1.24
+go 1.24.0
 
 require (
+	filippo.io/age v1.3.1
 	github.com/keys-pub/go-libfido2 v1.5.4-0.20250104233141-2534349bd685
 	github.com/spf13/pflag v1.0.6
+	github.com/tyler-smith/go-bip39 v1.1.0
+	github.com/zytekaron/galois-go v0.0.0-20250713062030-9f53eaf3f61b
 	github.com/zytekaron/shamir-go v0.0.0-20250713062224-423425cbd1c0
-	golang.org/x/crypto v0.40.0
+	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0
+	golang.org/x/term v0.37.0
+	gopkg.in/yaml.v3 v3.0.1
+	rsc.io/qr v0.2.0
 )
 
 require (
+	filippo.io/hpke v0.4.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/zytekaron/galois-go v0.0.0-20250713062030-9f53eaf3f61b // indirect
-	golang.org/x/sys v0.34.0 // indirect
 )
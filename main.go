@@ -4,39 +4,56 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"runtime"
 	"slices"
 	"strconv"
 
+	"fidokit/codec"
 	"fidokit/fidoutils"
 	"github.com/spf13/pflag"
 
 	"fidokit/fkvault"
+	"fidokit/prompt"
 	"fidokit/utils"
 )
 
 const debug = false
 
-var vaultPath, inputPath, outputPath string
-var unlockMode, debugMode, disableBiometrics, noAssumptions, skipChecks bool
+// exit codes used by commands.
+const (
+	exitOK      = 0 // the command succeeded
+	exitError   = 1 // the command failed
+	exitUsage   = 2 // the command was used incorrectly
+	exitInvalid = 3 // the vault failed integrity verification
+)
 
-func init() {
-	pflag.StringVarP(&vaultPath, "vault", "v", "vault.json", "The relative path to your vault, default simple.json")
-	pflag.StringVarP(&inputPath, "input", "i", "stdin", "The file path to read the input from during initialization, default 'stdin'")
-	pflag.StringVarP(&outputPath, "output", "o", "stdout", "The file path to write the output to during unlocking, default 'stdout'")
-	pflag.BoolVarP(&unlockMode, "unlock", "U", false, "Enable unlock mode for scripting contexts")
-	pflag.BoolVarP(&debugMode, "debug", "D", false, "Enable debug mode")
-	pflag.BoolVar(&disableBiometrics, "disable-biometrics", false, "Disable biometric authentication; always use PIN")
-	pflag.BoolVar(&noAssumptions, "no-assumptions", false, "Disable assumptions; always prompt the user to press ENTER before attempting to select a key. Useful if you need more time or are in a special situation regarding what keys are plugged in.")
-	pflag.BoolVar(&skipChecks, "skip-checks", false, "Skip vault integrity verification (for recovery attempts)")
-	pflag.Parse()
+var vaultPath, inputPath, outputPath, answersPath string
+var unlockMode, debugMode, disableBiometrics, noAssumptions, skipChecks bool
 
-	if unlockMode && outputPath == "stdout" {
-		log.Fatalln("Unlock mode must be used with -o/--output")
-	}
+// backupCount is the number of previous versions of the vault kept when saving.
+var backupCount int
+
+// prompter is used for all interactive input.
+var prompter prompt.Prompter = prompt.Stdio
+
+// globalFlags registers the flags which are shared by all commands.
+func globalFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&vaultPath, "vault", "v", "vault.json", "The relative path to your vault")
+	fs.BoolVarP(&debugMode, "debug", "D", false, "Enable debug mode")
+	fs.BoolVar(&disableBiometrics, "disable-biometrics", false, "Disable biometric authentication; always use PIN")
+	fs.BoolVar(&noAssumptions, "no-assumptions", false, "Disable assumptions; always prompt the user to press ENTER before attempting to select a key. Useful if you need more time or are in a special situation regarding what keys are plugged in.")
+	fs.BoolVar(&skipChecks, "skip-checks", false, "Skip vault integrity verification (for recovery attempts)")
+	fs.IntVar(&backupCount, "backups", 3, "The number of previous versions of the vault to keep as backups when saving")
+	fs.StringVar(&answersPath, "answers", "", "Answer all prompts from a JSON or YAML answers file instead of the terminal")
+}
 
+// setup applies the global flags once they have been parsed. Prompts and
+// messages are written to out, which should be stderr for commands whose
+// output on stdout may be consumed by other programs.
+func setup(out *os.File, usesKeys bool) {
 	// global variables work, passing config is annoying :)
 	fidoutils.Debug = debugMode
 	fkvault.Debug = debugMode
@@ -44,49 +61,97 @@ func init() {
 	fkvault.MakeAssumptions = !noAssumptions
 	fidoutils.DisableBiometrics = disableBiometrics
 
+	if out != os.Stdout {
+		prompter = prompt.NewTerminal(os.Stdin, out)
+	}
+	if answersPath != "" {
+		scripted, err := prompt.LoadScripted(answersPath, out)
+		if err != nil {
+			log.Fatalln("load answers:", err)
+		}
+		prompter = scripted
+	}
+	fidoutils.Prompter = prompter
+	fkvault.Prompter = prompter
+
 	// check for the plugdev group on linux and warn if the running user doesn't have it.
-	if runtime.GOOS == "linux" {
+	if usesKeys && runtime.GOOS == "linux" {
 		plugdevOk, err := utils.CheckPlugdev()
 		if err != nil {
 			log.Fatalln("checking plugdev group:", err)
 		}
 		if !plugdevOk {
-			fmt.Println("Detected Linux, and current user is not in `plugdev` group.")
-			fmt.Println("Security keys may not work unless this script runs as root,")
-			fmt.Println("or if the effective user is a member of the `plugdev` group.")
-			fmt.Println("If this message is unexpected, you may need to add a udev rule.")
-			fmt.Println("Read more: https://developers.yubico.com/libfido2")
+			fmt.Fprintln(out, "Detected Linux, and current user is not in `plugdev` group.")
+			fmt.Fprintln(out, "Security keys may not work unless this script runs as root,")
+			fmt.Fprintln(out, "or if the effective user is a member of the `plugdev` group.")
+			fmt.Fprintln(out, "If this message is unexpected, you may need to add a udev rule.")
+			fmt.Fprintln(out, "Read more: https://developers.yubico.com/libfido2")
 		}
 	}
 }
 
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// shellFlags registers the flags for the interactive shell, which is
+// also used when fidokit is run without a command for compatibility.
+func shellFlags(fs *pflag.FlagSet) {
+	inputFlags(fs)
+	fs.StringVarP(&outputPath, "output", "o", "stdout", "The file path to write the output to during unlocking")
+	fs.BoolVarP(&unlockMode, "unlock", "U", false, "Enable unlock mode for scripting contexts")
+	keyFormatFlag(fs)
+}
+
+// runShell runs the interactive menu for the vault, creating it first if it does not exist.
+func runShell(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+	if unlockMode && outputPath == "stdout" {
+		return usageErrorf("unlock mode must be used with -o/--output")
+	}
+	if keyFormat != "" {
+		format, err := codec.ParseFormat(keyFormat)
+		if err != nil {
+			return usageErrorf("%s", err)
+		}
+		fkvault.KeyFormat = format
+	}
+	err := setupInput()
+	if err != nil {
+		return err
+	}
+
 	if len(vaultPath) == 0 {
-		vaultPath = utils.ReadNonEmptyLine("Enter vault file path: ")
+		vaultPath = mustAskNonEmpty("Enter vault file path: ")
 	}
 
-	_, err := os.Open(vaultPath)
+	_, err = os.Stat(vaultPath)
 	if os.IsNotExist(err) {
 		if unlockMode {
-			log.Fatalln("vault file not found. specify one using -v/--vault.")
+			return errors.New("vault file not found. specify one using -v/--vault")
 		}
 
 		fmt.Println("Vault file does not exist. Creating new vault.")
-		for {
-			typ := utils.ReadLine("Enter vault type (simple, shamir): ")
-			switch typ {
-			case "simple":
-				vault := doCreateSimpleVault()
-				interactiveSimpleVault(vault)
-				return
-			case "shamir":
-				vault := doCreateShamirVault()
-				interactiveShamirVault(vault)
-				return
-			}
+		typ, err := prompter.Choose("Enter vault type", []string{"simple", "shamir", "policy"})
+		if err != nil {
+			return fmt.Errorf("read input: %w", err)
 		}
+		switch typ {
+		case 0:
+			vault := doCreateSimpleVault()
+			interactiveSimpleVault(vault)
+		case 1:
+			vault := doCreateShamirVault()
+			interactiveShamirVault(vault)
+		case 2:
+			vault := doCreatePolicyVault()
+			interactivePolicyVault(vault)
+		}
+		return nil
 	} else if err != nil {
-		log.Fatalln("open vault:", err)
+		return fmt.Errorf("open vault: %w", err)
 	}
 
 	anyVault := mustLoadVault(vaultPath)
@@ -98,6 +163,8 @@ func main() {
 			interactiveSimpleVaultUnlockMode(vault)
 		case *fkvault.ShamirVault:
 			interactiveShamirVaultUnlockMode(vault)
+		case *fkvault.PolicyVault:
+			interactivePolicyVaultUnlockMode(vault)
 		}
 	} else {
 		switch vault := anyVault.(type) {
@@ -105,54 +172,150 @@ func main() {
 			interactiveSimpleVault(vault)
 		case *fkvault.ShamirVault:
 			interactiveShamirVault(vault)
+		case *fkvault.PolicyVault:
+			interactivePolicyVault(vault)
 		}
 	}
+	return nil
 }
 
 func doCreateSimpleVault() *fkvault.SimpleVault {
-	//vaultPath = utils.ReadLine("Enter vault file path: ")
-	name := utils.ReadLine("Enter vault name: ")
-	desc := utils.ReadLine("Enter vault description: ")
-
-	return fkvault.NewSimple(name, desc)
+	//vaultPath = mustAsk("Enter vault file path: ")
+	name := mustAsk("Enter vault name: ")
+	desc := mustAsk("Enter vault description: ")
+
+	vault, err := fkvault.Create(fkvault.Options{
+		Type:        fkvault.TypeSimple,
+		Name:        name,
+		Description: desc,
+	})
+	if err != nil {
+		log.Fatalln("create vault:", err)
+	}
+	return vault.(*fkvault.SimpleVault)
 }
 
 func doCreateShamirVault() *fkvault.ShamirVault {
-	//vaultPath = utils.ReadLine("Enter vault file path: ")
-	name := utils.ReadLine("Enter vault name: ")
-	desc := utils.ReadLine("Enter vault description: ")
+	//vaultPath = mustAsk("Enter vault file path: ")
+	name := mustAsk("Enter vault name: ")
+	desc := mustAsk("Enter vault description: ")
 
-	nv := utils.ReadNonEmptyLine("Enter value for n (total shares): ")
+	nv := mustAskNonEmpty("Enter value for n (total shares): ")
 	n, err := strconv.Atoi(nv)
 	if err != nil {
 		log.Fatalln("parse n:", err)
 	}
 
-	kv := utils.ReadNonEmptyLine("Enter value for k (min required): ")
+	kv := mustAskNonEmpty("Enter value for k (min required): ")
 	k, err := strconv.Atoi(kv)
 	if err != nil {
 		log.Fatalln("parse k:", err)
 	}
+	if k < 0 || k > 255 || n < 0 || n > 255 {
+		log.Fatalln("create vault:", fkvault.ErrInvalidThreshold)
+	}
 
-	return fkvault.NewShamir(name, desc, byte(k), byte(n))
+	vault, err := fkvault.Create(fkvault.Options{
+		Type:        fkvault.TypeShamir,
+		Name:        name,
+		Description: desc,
+		K:           byte(k),
+		N:           byte(n),
+	})
+	if err != nil {
+		log.Fatalln("create vault:", err)
+	}
+	return vault.(*fkvault.ShamirVault)
 }
 
+func doCreatePolicyVault() *fkvault.PolicyVault {
+	name := mustAsk("Enter vault name: ")
+	desc := mustAsk("Enter vault description: ")
+
+	var policy *fkvault.PolicyNode
+	for policy == nil {
+		var err error
+		policy, err = fkvault.ParsePolicy(mustAskNonEmpty("Enter the policy, such as and(key:admin, 2of(key:op1, key:op2, key:op3)): "))
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	vault, err := fkvault.Create(fkvault.Options{
+		Type:        fkvault.TypePolicy,
+		Name:        name,
+		Description: desc,
+		Policy:      policy,
+	})
+	if err != nil {
+		log.Fatalln("create vault:", err)
+	}
+	return vault.(*fkvault.PolicyVault)
+}
+
+// mustAsk asks for a line of text, exiting if no more input is available.
+func mustAsk(question string) string {
+	input, err := prompter.AskText(question)
+	if err != nil {
+		log.Fatalln("read input:", err)
+	}
+	return input
+}
+
+// mustAskNonEmpty asks for a non-empty line of text, exiting if no more input is available.
+func mustAskNonEmpty(question string) string {
+	input, err := prompt.AskNonEmpty(prompter, question)
+	if err != nil {
+		log.Fatalln("read input:", err)
+	}
+	return input
+}
+
+// askCommand asks for the next command in an interactive menu,
+// exiting without saving if no more input is available.
+func askCommand() string {
+	input, err := prompter.AskText("Enter command (? for help): ")
+	if errors.Is(err, io.EOF) {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatalln("read input:", err)
+	}
+	return input
+}
+
+// verifyVault checks the integrity of the vault, unless --skip-checks is set.
+// If the vault is invalid, it prints recovery advice and exits the program.
 func verifyVault(anyVault any) {
 	if skipChecks {
 		return
 	}
 
-	var err error
+	err := checkVault(anyVault)
+	if err == nil {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "vault integrity:", err)
+	fmt.Println()
+	printCorruptionHelp()
+	os.Exit(exitInvalid)
+}
+
+// checkVault checks the integrity of the vault.
+func checkVault(anyVault any) error {
 	switch vault := anyVault.(type) {
 	case *fkvault.SimpleVault:
-		err = verifySimpleVault(vault)
+		return verifySimpleVault(vault)
 	case *fkvault.ShamirVault:
-		err = verifyShamirVault(vault)
-	}
-	if err == nil {
-		return
+		return verifyShamirVault(vault)
+	case *fkvault.PolicyVault:
+		return verifyPolicyVault(vault)
 	}
+	return fmt.Errorf("unknown vault type: %T", anyVault)
+}
 
+// printCorruptionHelp prints advice for recovering a vault which failed integrity verification.
+func printCorruptionHelp() {
 	fmt.Println("The vault file appears to be corrupted.")
 	fmt.Println()
 	fmt.Println("This usually happens if the vault file was modified manually.")
@@ -161,7 +324,7 @@ func verifyVault(anyVault any) {
 	fmt.Println("verification process which needs to be resolved.")
 	fmt.Println()
 	fmt.Println("You should first back up the current version of the vault file,")
-	fmt.Println("then try running the program using --skip-verify. This may work if")
+	fmt.Println("then try running the program using --skip-checks. This may work if")
 	fmt.Println("the vault corruption is not severe, for example if some keys in a")
 	fmt.Println("Shamir vault are erroneously deleted, but K or more are still there.")
 	fmt.Println()
@@ -184,8 +347,6 @@ func verifyVault(anyVault any) {
 	fmt.Println("https://github.com/zytekaron/fidokit")
 	fmt.Println("https://zyte.dev/contact")
 	fmt.Println()
-
-	log.Fatalln(err)
 }
 
 func verifySimpleVault(v *fkvault.SimpleVault) error {
@@ -200,8 +361,18 @@ func verifySimpleVault(v *fkvault.SimpleVault) error {
 		if len(header.EncryptedKey) == 0 {
 			return fmt.Errorf("EncryptedKey is missing or empty for '%s' (invalid)", name)
 		}
+		if header.Bound && v.Version < 2 {
+			return fmt.Errorf("header '%s' is bound in a vault older than version 2 (suspicious)", name)
+		}
+		if header.Kind != fkvault.ShareFIDO2 || header.Salt != nil || header.KDF != nil || header.Digest != nil {
+			return fmt.Errorf("header '%s' has share fields in a simple vault (invalid)", name)
+		}
 	}
 
+	err := verifyMAC(v.BaseVault, len(v.Headers))
+	if err != nil {
+		return err
+	}
 	return verifyBaseVault(v.BaseVault)
 }
 
@@ -215,6 +386,10 @@ func verifyShamirVault(v *fkvault.ShamirVault) error {
 		return errors.New("n is out of bounds (k <= n <= 255) (invalid)")
 	}
 
+	if v.Generation != 0 && v.Version < 1 {
+		return errors.New("generation is set in a version 0 vault (suspicious)")
+	}
+
 	// 0 = uninitialized; n = initialized
 	if len(v.Shares) != 0 && len(v.Shares) != int(v.N) {
 		return errors.New("invalid number of shares compared to n (invalid)")
@@ -225,17 +400,143 @@ func verifyShamirVault(v *fkvault.ShamirVault) error {
 			return errors.New("invalid number of shares compared to n (invalid)")
 		}
 
+		if share.Bound && v.Version < 2 {
+			return fmt.Errorf("share '%d' is bound in a vault older than version 2 (suspicious)", index)
+		}
+		err := verifyShare(v.Version, fmt.Sprint(index), share)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := verifyMAC(v.BaseVault, len(v.Shares))
+	if err != nil {
+		return err
+	}
+	return verifyBaseVault(v.BaseVault)
+}
+
+// verifyShare checks that a Shamir vault share, or the header of a policy vault leaf,
+// has the fields needed by its kind, and no others. The share is identified by its key.
+func verifyShare(version int, key string, share *fkvault.VaultHeader) error {
+	if share.Kind != fkvault.ShareFIDO2 && version < 5 {
+		return fmt.Errorf("share '%s' is a %s share in a vault older than version 5 (suspicious)", key, share.Kind)
+	}
+	if share.Kind != fkvault.ShareFIDO2 && !share.Bound {
+		return fmt.Errorf("%s share '%s' is not bound (invalid)", share.Kind, key)
+	}
+
+	switch share.Kind {
+	case fkvault.ShareFIDO2:
 		if len(share.CredentialID) == 0 {
-			return fmt.Errorf("CredentialID is missing or empty for '%d' (invalid)", index)
+			return fmt.Errorf("CredentialID is missing or empty for '%s' (invalid)", key)
 		}
 		if len(share.EncryptedKey) == 0 {
-			return fmt.Errorf("EncryptedKey is missing or empty for '%d' (invalid)", index)
+			return fmt.Errorf("EncryptedKey is missing or empty for '%s' (invalid)", key)
+		}
+		if share.Salt != nil || share.KDF != nil || share.Digest != nil {
+			return fmt.Errorf("FIDO2 share '%s' has fields of another kind of share (suspicious)", key)
+		}
+	case fkvault.SharePassphrase:
+		if len(share.EncryptedKey) == 0 {
+			return fmt.Errorf("EncryptedKey is missing or empty for '%s' (invalid)", key)
+		}
+		if len(share.Salt) != 16 {
+			return fmt.Errorf("Salt is missing or the wrong length for '%s' (invalid)", key)
+		}
+		if share.KDF == nil {
+			return fmt.Errorf("KDF is missing for '%s' (invalid)", key)
+		}
+		err := share.KDF.Validate()
+		if err != nil {
+			return fmt.Errorf("KDF is not valid for '%s': %w (invalid)", key, err)
+		}
+		if share.CredentialID != nil || share.Digest != nil {
+			return fmt.Errorf("passphrase share '%s' has fields of another kind of share (suspicious)", key)
+		}
+	case fkvault.SharePaper:
+		if len(share.Digest) != 32 {
+			return fmt.Errorf("Digest is missing or the wrong length for '%s' (invalid)", key)
+		}
+		if share.CredentialID != nil || share.EncryptedKey != nil || share.Salt != nil || share.KDF != nil {
+			return fmt.Errorf("paper share '%s' has fields of another kind of share (suspicious)", key)
+		}
+	default:
+		return fmt.Errorf("share '%s' has unknown kind '%s' (invalid)", key, share.Kind)
+	}
+	return nil
+}
+
+func verifyPolicyVault(v *fkvault.PolicyVault) error {
+	if v.Policy == nil {
+		return errors.New("policy is missing (invalid)")
+	}
+	err := v.Policy.Validate()
+	if err != nil {
+		return fmt.Errorf("%w (invalid)", err)
+	}
+	if v.Encrypted {
+		return errors.New("policy vault is encrypted (invalid)")
+	}
+
+	if v.Version < 5 {
+		return errors.New("policy vault is older than version 5 (suspicious)")
+	}
+
+	// none = uninitialized; all = initialized
+	leaves := v.Policy.Leaves()
+	var headers int
+	for _, leaf := range leaves {
+		h := leaf.Header
+		if h == nil {
+			continue
+		}
+		headers++
+
+		if h.Name != leaf.Name {
+			return fmt.Errorf("leaf '%s' and header name '%s' do not match (suspicious)", leaf.Name, h.Name)
+		}
+		if !h.Bound {
+			return fmt.Errorf("leaf '%s' is not bound (invalid)", leaf.Name)
 		}
+		if leaf.Type == fkvault.NodeKey && h.Kind != fkvault.ShareFIDO2 || leaf.Type == fkvault.NodePassword && h.Kind != fkvault.SharePassphrase {
+			return fmt.Errorf("%s leaf '%s' has a %s header (invalid)", leaf.Type, leaf.Name, h.Kind)
+		}
+		err := verifyShare(v.Version, leaf.Name, h)
+		if err != nil {
+			return err
+		}
+	}
+	if headers != 0 && headers != len(leaves) {
+		return errors.New("only some leaves of the policy have headers (invalid)")
 	}
 
+	err = verifyMAC(v.BaseVault, headers)
+	if err != nil {
+		return err
+	}
 	return verifyBaseVault(v.BaseVault)
 }
 
+// verifyMAC checks that the vault MAC is present when it is expected. The MAC
+// itself can only be verified once the vault has been unlocked.
+func verifyMAC(v *fkvault.BaseVault, headers int) error {
+	if v.Version == 0 {
+		if v.MAC != nil {
+			return errors.New("MAC is present in a version 0 vault (suspicious)")
+		}
+		return nil
+	}
+
+	if headers == 0 && v.MAC != nil {
+		return errors.New("MAC is present in a vault without headers (suspicious)")
+	}
+	if headers > 0 && len(v.MAC) != 32 {
+		return errors.New("MAC is missing or the wrong length (invalid)")
+	}
+	return nil
+}
+
 func verifyBaseVault(v *fkvault.BaseVault) error {
 	if v.Version < 0 {
 		return errors.New("version is negative (invalid)")
@@ -257,13 +558,41 @@ func verifyBaseVault(v *fkvault.BaseVault) error {
 	if v.RPID == "" {
 		return errors.New("RPID is empty (invalid)")
 	}
+	err := fidoutils.ValidateRPID(v.RPID)
+	if err != nil {
+		return fmt.Errorf("RPID is not valid: %w (suspicious)", err)
+	}
 
 	if v.Encrypted && len(v.EncryptionSalt) != 16 {
 		return errors.New("EncryptionSalt is not correct while Encrypted is true (invalid)")
 	}
-	if v.Encrypted && v.EncryptionSalt != nil {
+	if !v.Encrypted && v.EncryptionSalt != nil {
 		return errors.New("EncryptionSalt is present while Encrypted is false (suspicious)")
 	}
+	if v.Resident && (v.Type != fkvault.TypeSimple || v.Encrypted) {
+		return errors.New("Resident is set on an encrypted or non-simple vault (invalid)")
+	}
+	if v.Version < 1 && v.KDF != nil {
+		return errors.New("KDF is present in a version 0 vault (suspicious)")
+	}
+	if v.Version < 6 && (v.RPName != "" || v.User != "" || v.Resident) {
+		return errors.New("RPName, User or Resident is set in a vault older than version 6 (suspicious)")
+	}
+	if v.Version < 3 && v.Secrets != nil {
+		return errors.New("Secrets are present in a vault older than version 3 (suspicious)")
+	}
+	if v.Version < 4 && v.Contexts != nil {
+		return errors.New("Contexts are present in a vault older than version 4 (suspicious)")
+	}
+	if !v.Encrypted && v.KDF != nil {
+		return errors.New("KDF is present while Encrypted is false (suspicious)")
+	}
+	if v.KDF != nil {
+		err := v.KDF.Validate()
+		if err != nil {
+			return fmt.Errorf("KDF is not valid: %w (invalid)", err)
+		}
+	}
 
 	// disabled: non-critical
 	//if v.Metadata.Created.After(v.Metadata.Modified) {
@@ -301,18 +630,16 @@ func mustSaveVault(path string, vault any) {
 	}
 }
 
+// saveVault atomically replaces the vault file, keeping the configured number of backups.
 func saveVault(path string, vault any) error {
-	file, err := os.Create(path)
+	data, err := json.MarshalIndent(vault, "", "    ")
 	if err != nil {
-		return fmt.Errorf("create file: %w", err)
+		return fmt.Errorf("encode vault: %w", err)
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "    ")
-	err = encoder.Encode(vault)
+	err = utils.WriteFileAtomic(path, append(data, '\n'), backupCount)
 	if err != nil {
-		return fmt.Errorf("encode/write vault: %w", err)
+		return fmt.Errorf("write vault: %w", err)
 	}
 	return nil
 }
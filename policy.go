@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"fidokit/fidoutils"
+	"fidokit/fkvault"
+)
+
+func interactivePolicyVaultUnlockMode(vault *fkvault.PolicyVault) {
+	masterKey, err := vault.InteractiveUnlock()
+	if err != nil {
+		log.Fatalln("unlock:", err)
+	}
+
+	err = upgradeVault(vault, masterKey, true)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = writeMasterKey(masterKey, outputPath)
+	if err != nil {
+		log.Fatalln("write master key to output file:", err)
+	}
+}
+
+func interactivePolicyVault(vault *fkvault.PolicyVault) {
+	printVaultInfo(vault, debug)
+
+	if !vault.Initialized() {
+		fmt.Println("This vault is not initialized. Use `init` to begin.")
+		fmt.Println()
+	}
+
+	for {
+		input := askCommand()
+		if len(input) == 0 {
+			continue
+		}
+		fmt.Println()
+
+		switch input {
+		case "?", "??", "h", "help", "help-all":
+			fmt.Println("Commands:")
+			fmt.Println("  l, list:   list the policy and its keys")
+			fmt.Println("  p, plan:   list the ways to unlock the vault using the connected keys")
+			fmt.Println("  u, unlock: unlock the master key (cached)")
+			fmt.Println("* r, reset:  reset vault *")
+			fmt.Println("  s, save:   save vault to disk")
+			fmt.Println("  q, quit:   exit without saving")
+			fmt.Println("  x, done:   exit and save vault")
+			fmt.Println("")
+			fmt.Println("* changes are in memory only, you must save")
+			fmt.Println("  them to disk manually using `save` or `done`")
+			fmt.Println("")
+			if input == "??" || input == "help-all" {
+				fmt.Println("Developer:")
+				fmt.Println("  D, devs:   list connected FIDO2 devices")
+				fmt.Println("  I, info:   view advanced vault information")
+				fmt.Println("  P, print:  print vault json to stdout")
+				fmt.Println("  L, listv:  list the policy verbosely (key entries)")
+				fmt.Println("")
+			}
+
+		case "I", "info":
+			printVaultInfo(vault, true)
+
+		case "D", "devs":
+			fidoutils.PrintConnectedDevices()
+
+		case "i", "init":
+			err := vault.InteractiveInitialize()
+			if err != nil {
+				log.Fatalln("initialize:", err)
+			}
+			fmt.Println("Initialized!")
+
+		case "l", "list":
+			fmt.Println("Policy:")
+			printPolicy(vault.Policy, "  ", false)
+
+		case "L", "listv", "listverbose":
+			fmt.Println("Policy:")
+			printPolicy(vault.Policy, "  ", true)
+
+		case "p", "plan":
+			err := printPlans(vault)
+			if err != nil {
+				fmt.Println("plan:", err)
+			}
+
+		case "u", "unlock":
+			masterKey, err := vault.InteractiveUnlock()
+			if err != nil {
+				log.Fatalln("unlock:", err)
+			}
+
+			err = upgradeVault(vault, masterKey, false)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			if outputPath != "" && outputPath != "1" && outputPath != "stdout" {
+				err := writeMasterKey(masterKey, outputPath)
+				if err != nil {
+					log.Fatalln("write master key to output file:", err)
+				}
+				fmt.Println("Master key written to output file.")
+			} else {
+				err := printMasterKey(masterKey, true)
+				if err != nil {
+					log.Fatalln("print master key:", err)
+				}
+			}
+
+		case "s", "save", "w", "write":
+			mustSaveVault(vaultPath, vault)
+			fmt.Println("Saved!")
+
+		case "r", "reset":
+			vault.DeleteAllHeaders()
+			fmt.Println("Vault reset!")
+
+		case "P", "print", "dump":
+			data, err := json.MarshalIndent(vault, "", "    ")
+			if err != nil {
+				log.Fatalln("marshal vault:", err)
+			}
+			fmt.Println(string(data))
+
+		case "q", "quit", "cancel":
+			os.Exit(0)
+
+		case "wq", "x", "done", "exit":
+			mustSaveVault(vaultPath, vault)
+			fmt.Println("Exiting and saving changes.")
+			os.Exit(0)
+		}
+
+		fmt.Println()
+	}
+}
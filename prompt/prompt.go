@@ -0,0 +1,85 @@
+package prompt
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrInvalidAnswer is returned when an answer cannot be used for a question,
+// for example if it is not one of the options given to Choose.
+var ErrInvalidAnswer = errors.New("invalid answer")
+
+// Prompter asks the user questions and displays messages to them.
+// Implementations return an error (such as io.EOF) when no more
+// answers can be obtained, rather than blocking or retrying forever.
+type Prompter interface {
+	// AskText asks for a line of text, which may be empty.
+	AskText(prompt string) (string, error)
+	// AskSecret asks for a line of text which should not be displayed, such as a PIN.
+	AskSecret(prompt string) (string, error)
+	// Confirm asks a yes/no question, returning def if no answer is given.
+	Confirm(prompt string, def bool) (bool, error)
+	// Choose asks for one of the options, returning the index of the chosen option.
+	Choose(prompt string, options []string) (int, error)
+	// Notify displays a message.
+	Notify(message string)
+}
+
+// Stdio is the Prompter for the process's terminal. All terminal
+// prompting should share it, since it buffers input from stdin.
+var Stdio = NewTerminal(os.Stdin, os.Stdout)
+
+// AskNonEmpty repeatedly asks for a line of text until a non-empty one is given.
+func AskNonEmpty(p Prompter, prompt string) (string, error) {
+	for {
+		input, err := p.AskText(prompt)
+		if err != nil || len(input) > 0 {
+			return input, err
+		}
+	}
+}
+
+// AskNonEmptySecret repeatedly asks for a secret until a non-empty one is given.
+func AskNonEmptySecret(p Prompter, prompt string) (string, error) {
+	for {
+		input, err := p.AskSecret(prompt)
+		if err != nil || len(input) > 0 {
+			return input, err
+		}
+	}
+}
+
+// parseConfirm parses a yes/no answer, returning def for an empty one.
+func parseConfirm(answer string, def bool) (bool, error) {
+	switch answer {
+	case "":
+		return def, nil
+	case "y", "Y", "yes", "Yes", "YES", "1", "true":
+		return true, nil
+	case "n", "N", "no", "No", "NO", "0", "false":
+		return false, nil
+	}
+	return false, ErrInvalidAnswer
+}
+
+// parseChoice finds the option chosen by an answer, which is
+// either the option itself or its position in the list from 1.
+func parseChoice(answer string, options []string) (int, error) {
+	for i, option := range options {
+		if answer == option {
+			return i, nil
+		}
+	}
+
+	var n int
+	for _, c := range answer {
+		if c < '0' || c > '9' || n > len(options) {
+			return 0, ErrInvalidAnswer
+		}
+		n = n*10 + int(c-'0')
+	}
+	if n < 1 || n > len(options) {
+		return 0, ErrInvalidAnswer
+	}
+	return n - 1, nil
+}
@@ -0,0 +1,97 @@
+package prompt
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Exchange is a single question and answer, or notification, seen by a Recorder.
+type Exchange struct {
+	// Kind is the kind of question, or "" for a notification.
+	Kind Kind
+	// Prompt is the prompt of the question, or the notification message.
+	Prompt string
+	// Answer is the answer given, formatted as it would be in an Answer.
+	Answer string
+	// Err is the error returned instead of an answer, if any.
+	Err error
+}
+
+// Recorder is a Prompter which records every exchange made
+// through another Prompter, for inspection in tests.
+type Recorder struct {
+	prompter  Prompter
+	exchanges []Exchange
+	mu        sync.Mutex
+}
+
+// NewRecorder creates a Recorder which passes questions through to the prompter.
+func NewRecorder(prompter Prompter) *Recorder {
+	return &Recorder{prompter: prompter}
+}
+
+// Exchanges returns all exchanges recorded so far.
+func (r *Recorder) Exchanges() []Exchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Exchange(nil), r.exchanges...)
+}
+
+// Answers returns the answers recorded so far, which can be saved
+// as an answers file to replay the session using Scripted.
+func (r *Recorder) Answers() []Answer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var answers []Answer
+	for _, e := range r.exchanges {
+		if e.Kind == "" || e.Err != nil {
+			continue
+		}
+		answers = append(answers, Answer{Kind: e.Kind, Prompt: e.Prompt, Value: e.Answer})
+	}
+	return answers
+}
+
+func (r *Recorder) AskText(prompt string) (string, error) {
+	answer, err := r.prompter.AskText(prompt)
+	r.record(KindText, prompt, answer, err)
+	return answer, err
+}
+
+func (r *Recorder) AskSecret(prompt string) (string, error) {
+	answer, err := r.prompter.AskSecret(prompt)
+	r.record(KindSecret, prompt, answer, err)
+	return answer, err
+}
+
+func (r *Recorder) Confirm(prompt string, def bool) (bool, error) {
+	ok, err := r.prompter.Confirm(prompt, def)
+	answer := "no"
+	if ok {
+		answer = "yes"
+	}
+	r.record(KindConfirm, prompt, answer, err)
+	return ok, err
+}
+
+func (r *Recorder) Choose(prompt string, options []string) (int, error) {
+	i, err := r.prompter.Choose(prompt, options)
+	answer := ""
+	if err == nil {
+		answer = strconv.Itoa(i + 1)
+	}
+	r.record(KindChoose, prompt, answer, err)
+	return i, err
+}
+
+func (r *Recorder) Notify(message string) {
+	r.prompter.Notify(message)
+	r.record("", message, "", nil)
+}
+
+func (r *Recorder) record(kind Kind, prompt, answer string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exchanges = append(r.exchanges, Exchange{Kind: kind, Prompt: prompt, Answer: answer, Err: err})
+}
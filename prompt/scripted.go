@@ -0,0 +1,179 @@
+package prompt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNoAnswers is returned by Scripted when all answers have been used.
+var ErrNoAnswers = errors.New("no scripted answers remaining")
+
+// ErrUnexpectedPrompt is returned by Scripted when the next answer
+// was recorded for a different prompt than the one being asked.
+var ErrUnexpectedPrompt = errors.New("unexpected prompt")
+
+// Kind is the kind of question an answer is given for.
+type Kind string
+
+const (
+	KindText    Kind = "text"
+	KindSecret  Kind = "secret"
+	KindConfirm Kind = "confirm"
+	KindChoose  Kind = "choose"
+)
+
+// Answer is a single scripted answer. Answers files contain a JSON or YAML
+// array of answers, which are used in order as questions are asked.
+//
+//	[
+//	    {"prompt": "vault name", "value": "team vault"},
+//	    {"kind": "confirm", "value": "no"},
+//	    {"kind": "secret", "prompt": "PIN", "value": "123456"}
+//	]
+//
+// or, in a file named with the extension .yaml or .yml:
+//
+//	# answers.yaml
+//	- prompt: vault name
+//	  value: team vault
+//	- kind: confirm
+//	  value: "no"
+//	- kind: secret
+//	  prompt: PIN
+//	  value: "123456"
+type Answer struct {
+	// Kind, if set, must match the kind of question asked.
+	Kind Kind `json:"kind,omitempty" yaml:"kind,omitempty"`
+	// Prompt, if set, must be contained in the prompt of the question asked.
+	Prompt string `json:"prompt,omitempty" yaml:"prompt,omitempty"`
+	// Value is the answer. For Confirm it is yes/no, and for Choose
+	// it is either the text of the option or its position from 1.
+	Value string `json:"value" yaml:"value"`
+}
+
+// Scripted is a Prompter which answers questions from a fixed list of answers,
+// to replay an interactive session deterministically. If the questions asked
+// do not match the kind or prompt of the answers, it fails instead of guessing.
+type Scripted struct {
+	// Out receives notifications and a transcript of the questions asked.
+	// Secret answers are not written. It may be nil to discard output.
+	Out io.Writer
+
+	answers []Answer
+	mu      sync.Mutex
+}
+
+// NewScripted creates a Scripted prompter which uses the answers in order.
+func NewScripted(answers []Answer, out io.Writer) *Scripted {
+	return &Scripted{
+		Out:     out,
+		answers: answers,
+	}
+}
+
+// LoadScripted creates a Scripted prompter from an answers file, which is
+// parsed as YAML if its extension is .yaml or .yml, or as JSON otherwise.
+func LoadScripted(path string, out io.Writer) (*Scripted, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read answers file: %w", err)
+	}
+
+	var answers []Answer
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &answers)
+	default:
+		err = json.Unmarshal(data, &answers)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse answers file: %w", err)
+	}
+	return NewScripted(answers, out), nil
+}
+
+// Remaining returns the number of answers which have not been used.
+func (s *Scripted) Remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.answers)
+}
+
+func (s *Scripted) AskText(prompt string) (string, error) {
+	return s.next(KindText, prompt)
+}
+
+func (s *Scripted) AskSecret(prompt string) (string, error) {
+	return s.next(KindSecret, prompt)
+}
+
+func (s *Scripted) Confirm(prompt string, def bool) (bool, error) {
+	answer, err := s.next(KindConfirm, prompt)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := parseConfirm(strings.ToLower(answer), def)
+	if err != nil {
+		return false, fmt.Errorf("%w for '%s': '%s'", err, prompt, answer)
+	}
+	return ok, nil
+}
+
+func (s *Scripted) Choose(prompt string, options []string) (int, error) {
+	answer, err := s.next(KindChoose, prompt)
+	if err != nil {
+		return 0, err
+	}
+
+	i, err := parseChoice(answer, options)
+	if err != nil {
+		return 0, fmt.Errorf("%w for '%s': '%s'", err, prompt, answer)
+	}
+	return i, nil
+}
+
+func (s *Scripted) Notify(message string) {
+	if s.Out != nil {
+		fmt.Fprintln(s.Out, message)
+	}
+}
+
+// next takes the next answer, checking that it was intended for the question.
+func (s *Scripted) next(kind Kind, prompt string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.answers) == 0 {
+		return "", fmt.Errorf("%w for '%s'", ErrNoAnswers, prompt)
+	}
+	answer := s.answers[0]
+
+	if answer.Kind != "" && answer.Kind != kind {
+		return "", fmt.Errorf("%w: expected %s question, got %s question '%s'", ErrUnexpectedPrompt, answer.Kind, kind, prompt)
+	}
+	if answer.Prompt != "" && !strings.Contains(prompt, answer.Prompt) {
+		return "", fmt.Errorf("%w: expected '%s', got '%s'", ErrUnexpectedPrompt, answer.Prompt, prompt)
+	}
+	s.answers = s.answers[1:]
+
+	if s.Out != nil {
+		value := answer.Value
+		if kind == KindSecret {
+			value = "********"
+		}
+		if !strings.HasSuffix(prompt, " ") {
+			prompt += " "
+		}
+		fmt.Fprintf(s.Out, "%s%s\n", prompt, value)
+	}
+	return answer.Value, nil
+}
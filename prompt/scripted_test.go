@@ -0,0 +1,69 @@
+package prompt
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadScripted(t *testing.T) {
+	want := []Answer{
+		{Prompt: "vault name", Value: "team vault"},
+		{Kind: KindConfirm, Value: "no"},
+		{Kind: KindSecret, Prompt: "PIN", Value: "123456"},
+	}
+	files := map[string]string{
+		"answers.json": `[
+			{"prompt": "vault name", "value": "team vault"},
+			{"kind": "confirm", "value": "no"},
+			{"kind": "secret", "prompt": "PIN", "value": "123456"}
+		]`,
+		"answers.yaml": `
+- prompt: vault name
+  value: team vault
+- kind: confirm
+  value: "no"
+- kind: secret
+  prompt: PIN
+  value: 123456
+`,
+	}
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scripted, err := LoadScripted(path, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !slices.Equal(scripted.answers, want) {
+			t.Errorf("%s: got %+v, want %+v", name, scripted.answers, want)
+		}
+	}
+}
+
+func TestScriptedUnexpectedPrompt(t *testing.T) {
+	scripted := NewScripted([]Answer{{Kind: KindSecret, Prompt: "PIN", Value: "1234"}}, nil)
+
+	_, err := scripted.AskText("Enter PIN: ")
+	if err == nil {
+		t.Errorf("answered a text question with a secret answer")
+	}
+	_, err = scripted.AskSecret("Enter password: ")
+	if err == nil {
+		t.Errorf("answered a question with a different prompt")
+	}
+	pin, err := scripted.AskSecret("Enter PIN: ")
+	if err != nil || pin != "1234" {
+		t.Errorf("got %q, %v, want %q", pin, err, "1234")
+	}
+	if scripted.Remaining() != 0 {
+		t.Errorf("%d answers remaining, want 0", scripted.Remaining())
+	}
+}
@@ -0,0 +1,101 @@
+package prompt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Terminal is a Prompter which reads answers line by line from a file,
+// usually stdin. Secrets are not echoed when the file is a terminal.
+type Terminal struct {
+	in     *os.File
+	reader *bufio.Reader
+	out    io.Writer
+}
+
+// NewTerminal creates a Terminal which reads from in and writes to out.
+func NewTerminal(in *os.File, out io.Writer) *Terminal {
+	return &Terminal{
+		in:     in,
+		reader: bufio.NewReader(in),
+		out:    out,
+	}
+}
+
+func (t *Terminal) AskText(prompt string) (string, error) {
+	if len(prompt) > 0 {
+		fmt.Fprint(t.out, prompt)
+	}
+	return t.readLine()
+}
+
+func (t *Terminal) AskSecret(prompt string) (string, error) {
+	fd := int(t.in.Fd())
+	if !term.IsTerminal(fd) {
+		return t.AskText(prompt)
+	}
+
+	if len(prompt) > 0 {
+		fmt.Fprint(t.out, prompt)
+	}
+	input, err := term.ReadPassword(fd)
+	fmt.Fprintln(t.out)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(input)), nil
+}
+
+func (t *Terminal) Confirm(prompt string, def bool) (bool, error) {
+	suffix := " (y/N): "
+	if def {
+		suffix = " (Y/n): "
+	}
+
+	for {
+		input, err := t.AskText(prompt + suffix)
+		if err != nil {
+			return false, err
+		}
+
+		ok, err := parseConfirm(strings.ToLower(input), def)
+		if err == nil {
+			return ok, nil
+		}
+	}
+}
+
+func (t *Terminal) Choose(prompt string, options []string) (int, error) {
+	prompt = fmt.Sprintf("%s (%s): ", prompt, strings.Join(options, ", "))
+
+	for {
+		input, err := t.AskText(prompt)
+		if err != nil {
+			return 0, err
+		}
+
+		i, err := parseChoice(input, options)
+		if err == nil {
+			return i, nil
+		}
+	}
+}
+
+func (t *Terminal) Notify(message string) {
+	fmt.Fprintln(t.out, message)
+}
+
+// readLine reads the next line, returning io.EOF only if no input remains.
+func (t *Terminal) readLine() (string, error) {
+	input, err := t.reader.ReadString('\n')
+	if errors.Is(err, io.EOF) && len(input) > 0 {
+		err = nil
+	}
+	return strings.TrimSpace(input), err
+}
@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"os"
+	"slices"
+	"strconv"
 
 	"fidokit/fidoutils"
 	"fidokit/fkvault"
-	"fidokit/utils"
 )
 
 func interactiveShamirVaultUnlockMode(vault *fkvault.ShamirVault) {
@@ -17,48 +19,27 @@ func interactiveShamirVaultUnlockMode(vault *fkvault.ShamirVault) {
 		log.Fatalln("unlock:", err)
 	}
 
-	err = os.WriteFile(outputPath, masterKey, 0600)
+	err = upgradeVault(vault, masterKey, true)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = writeMasterKey(masterKey, outputPath)
 	if err != nil {
 		log.Fatalln("write master key to output file:", err)
 	}
 }
 
 func interactiveShamirVault(vault *fkvault.ShamirVault) {
-	isReady := func() string {
-		if len(vault.Shares) == int(vault.N) {
-			return "YES"
-		}
-		return "NO"
-	}
-
-	fmt.Println("Vault Info:")
-	fmt.Println("  Type:   ", vault.Type)
-	fmt.Println("  Name:   ", vault.Name)
-	fmt.Println("  Desc:   ", vault.Description)
-	fmt.Println("  K/N:    ", vault.K, "/", vault.N)
-	fmt.Println("  Ready:  ", isReady())
-	fmt.Println("  Created:", vault.Metadata.Created)
-	fmt.Println("  Updated:", vault.Metadata.Modified)
-	fmt.Println()
+	printVaultInfo(vault, debug)
 
 	if len(vault.Shares) == 0 {
 		fmt.Println("This vault is not initialized. Use `init` to begin.")
 		fmt.Println()
 	}
 
-	if debug {
-		fmt.Println("Advanced Vault Info:")
-		fmt.Println("  ID:  ", vault.ID)
-		fmt.Println("  Type:", vault.Type)
-		fmt.Println("  Ver: ", vault.Version)
-		fmt.Println("  RPID:", vault.RPID)
-		fmt.Println("  CDH: ", vault.ClientDataHashText)
-		fmt.Println("  Salt:", vault.AssertionSaltText)
-		fmt.Println()
-	}
-
 	for {
-		input := utils.ReadLine("Enter command (? for help): ")
+		input := askCommand()
 		if len(input) == 0 {
 			continue
 		}
@@ -69,7 +50,8 @@ func interactiveShamirVault(vault *fkvault.ShamirVault) {
 			fmt.Println("Commands:")
 			fmt.Println("  l, list:   list headers (key entries)")
 			fmt.Println("  u, unlock: unlock the master key (cached)")
-			//fmt.Println("* a, add:    create a new header *")
+			fmt.Println("* a, add:    add a new key using k existing keys *")
+			fmt.Println("* reshare:   replace all shares, optionally changing k and n *")
 			//fmt.Println("* d, delete: delete a header *")
 			fmt.Println("* r, reset:  reset vault *")
 			fmt.Println("  s, save:   save vault to disk")
@@ -89,23 +71,7 @@ func interactiveShamirVault(vault *fkvault.ShamirVault) {
 			}
 
 		case "I", "info":
-			fmt.Println("Vault Info:")
-			fmt.Println("  Type:   ", vault.Type)
-			fmt.Println("  Name:   ", vault.Name)
-			fmt.Println("  Desc:   ", vault.Description)
-			fmt.Println("  K/N:    ", vault.K, "/", vault.N)
-			fmt.Println("  Ready:  ", isReady())
-			fmt.Println("  Created:", vault.Metadata.Created)
-			fmt.Println("  Updated:", vault.Metadata.Modified)
-			fmt.Println()
-			fmt.Println("Advanced Vault Info:")
-			fmt.Println("  ID:  ", vault.ID)
-			fmt.Println("  Type:", vault.Type)
-			fmt.Println("  Ver: ", vault.Version)
-			fmt.Println("  RPID:", vault.RPID)
-			fmt.Println("  CDH: ", vault.ClientDataHashText)
-			fmt.Println("  Salt:", vault.AssertionSaltText)
-			fmt.Println()
+			printVaultInfo(vault, true)
 
 		case "D", "devs":
 			fidoutils.PrintConnectedDevices()
@@ -119,15 +85,31 @@ func interactiveShamirVault(vault *fkvault.ShamirVault) {
 
 		case "l", "list":
 			fmt.Println("Headers:")
-			for i, h := range vault.Shares {
-				fmt.Printf("%d: %s\n", i, h.Name)
+			for _, i := range slices.Sorted(maps.Keys(vault.Shares)) {
+				printHeader(fmt.Sprint(i), vault.Shares[i], false)
 			}
 
 		case "L", "listv", "listverbose":
 			fmt.Println("Shares:")
-			for i, h := range vault.Shares {
-				fmt.Printf("%d: %s\n\tcredential_id=%x\n\tencrypted_key=%x\n", i, h.Name, h.CredentialID, h.EncryptedKey)
+			for _, i := range slices.Sorted(maps.Keys(vault.Shares)) {
+				printHeader(fmt.Sprint(i), vault.Shares[i], true)
+			}
+
+		case "a", "add":
+			err := vault.InteractiveAddShare("", fkvault.ShareFIDO2)
+			if err != nil {
+				log.Fatalln("add:", err)
+			}
+			fmt.Println("Key added! N is now", vault.N)
+
+		case "reshare":
+			n := askThreshold(fmt.Sprintf("Enter new value for n (total shares), or leave blank to keep %d: ", vault.N))
+			k := askThreshold(fmt.Sprintf("Enter new value for k (min required), or leave blank to keep %d: ", vault.K))
+			err := vault.InteractiveReshare(k, n, nil, nil)
+			if err != nil {
+				log.Fatalln("reshare:", err)
 			}
+			fmt.Println("Reshared! Shares from earlier copies of the vault can no longer be combined with the new shares.")
 
 		case "u", "unlock":
 			masterKey, err := vault.InteractiveCombine()
@@ -135,14 +117,22 @@ func interactiveShamirVault(vault *fkvault.ShamirVault) {
 				log.Fatalln("combine:", err)
 			}
 
+			err = upgradeVault(vault, masterKey, false)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
 			if outputPath != "" && outputPath != "1" && outputPath != "stdout" {
-				err := os.WriteFile(outputPath, masterKey, 0600)
+				err := writeMasterKey(masterKey, outputPath)
 				if err != nil {
 					log.Fatalln("write master key to output file:", err)
 				}
 				fmt.Println("Master key written to output file.")
 			} else {
-				fmt.Printf("Master Key (hex): %x\n", masterKey)
+				err := printMasterKey(masterKey, true)
+				if err != nil {
+					log.Fatalln("print master key:", err)
+				}
 			}
 
 		case "s", "save", "w", "write":
@@ -173,3 +163,17 @@ func interactiveShamirVault(vault *fkvault.ShamirVault) {
 	}
 
 }
+
+// askThreshold asks for a new value for k or n, returning 0 if it is left blank.
+func askThreshold(question string) byte {
+	input := mustAsk(question)
+	if input == "" {
+		return 0
+	}
+
+	value, err := strconv.ParseUint(input, 10, 8)
+	if err != nil {
+		log.Fatalln("parse value:", err)
+	}
+	return byte(value)
+}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 
 	"fidokit/fidoutils"
 	"fidokit/fkvault"
-	"fidokit/utils"
 )
 
 func interactiveSimpleVaultUnlockMode(vault *fkvault.SimpleVault) {
@@ -17,35 +17,22 @@ func interactiveSimpleVaultUnlockMode(vault *fkvault.SimpleVault) {
 		log.Fatalln("unlock:", err)
 	}
 
-	err = os.WriteFile(outputPath, masterKey, 0600)
+	err = upgradeVault(vault, masterKey, true)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = writeMasterKey(masterKey, outputPath)
 	if err != nil {
 		log.Fatalln("write master key to output file:", err)
 	}
 }
 
 func interactiveSimpleVault(vault *fkvault.SimpleVault) {
-	fmt.Println("Vault Info:")
-	fmt.Println("  Type:   ", vault.Type)
-	fmt.Println("  Name:   ", vault.Name)
-	fmt.Println("  Desc:   ", vault.Description)
-	fmt.Println("  Keys:   ", len(vault.Headers))
-	fmt.Println("  Created:", vault.Metadata.Created)
-	fmt.Println("  Updated:", vault.Metadata.Modified)
-	fmt.Println()
-
-	if debug {
-		fmt.Println("Advanced Vault Info:")
-		fmt.Println("  ID:  ", vault.ID)
-		fmt.Println("  Type:", vault.Type)
-		fmt.Println("  Ver: ", vault.Version)
-		fmt.Println("  RPID:", vault.RPID)
-		fmt.Println("  CDH: ", vault.ClientDataHashText)
-		fmt.Println("  Salt:", vault.AssertionSaltText)
-		fmt.Println()
-	}
+	printVaultInfo(vault, debug)
 
 	for {
-		input := utils.ReadLine("Enter command (? for help): ")
+		input := askCommand()
 		if len(input) == 0 {
 			continue
 		}
@@ -76,22 +63,7 @@ func interactiveSimpleVault(vault *fkvault.SimpleVault) {
 			}
 
 		case "I", "info":
-			fmt.Println("Vault Info:")
-			fmt.Println("  Type:   ", vault.Type)
-			fmt.Println("  Name:   ", vault.Name)
-			fmt.Println("  Desc:   ", vault.Description)
-			fmt.Println("  Keys:   ", len(vault.Headers))
-			fmt.Println("  Created:", vault.Metadata.Created)
-			fmt.Println("  Updated:", vault.Metadata.Modified)
-			fmt.Println()
-			fmt.Println("Advanced Vault Info:")
-			fmt.Println("  ID:  ", vault.ID)
-			fmt.Println("  Type:", vault.Type)
-			fmt.Println("  Ver: ", vault.Version)
-			fmt.Println("  RPID:", vault.RPID)
-			fmt.Println("  CDH: ", vault.ClientDataHashText)
-			fmt.Println("  Salt:", vault.AssertionSaltText)
-			fmt.Println()
+			printVaultInfo(vault, true)
 
 		case "D", "devs":
 			fidoutils.PrintConnectedDevices()
@@ -109,7 +81,7 @@ func interactiveSimpleVault(vault *fkvault.SimpleVault) {
 			}
 
 		case "a", "add":
-			err := vault.InteractiveAdd()
+			err := vault.InteractiveAdd("")
 			if err != nil {
 				log.Fatalln("add:", err)
 			}
@@ -120,19 +92,29 @@ func interactiveSimpleVault(vault *fkvault.SimpleVault) {
 				log.Fatalln("unlock:", err)
 			}
 
+			err = upgradeVault(vault, masterKey, false)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
 			if outputPath != "" && outputPath != "1" && outputPath != "stdout" {
-				err := os.WriteFile(outputPath, masterKey, 0600)
+				err := writeMasterKey(masterKey, outputPath)
 				if err != nil {
 					log.Fatalln("write master key to output file:", err)
 				}
 				fmt.Println("Master key written to output file.")
 			} else {
-				fmt.Printf("Master Key (hex): %x\n", masterKey)
+				err := printMasterKey(masterKey, true)
+				if err != nil {
+					log.Fatalln("print master key:", err)
+				}
 			}
 
 		case "d", "delete":
-			err := vault.InteractiveDelete()
-			if err != nil {
+			err := vault.InteractiveDelete("")
+			if errors.Is(err, fkvault.ErrNoHeader) {
+				fmt.Println("Header not found!")
+			} else if err != nil {
 				log.Fatalln("delete:", err)
 			}
 
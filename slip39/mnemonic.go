@@ -0,0 +1,174 @@
+package slip39
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Share is a single SLIP-39 share, encoded as one mnemonic.
+type Share struct {
+	// Identifier is a random 15-bit value shared by every share of a secret.
+	Identifier uint16
+	// Extendable indicates whether more shares can be created for the secret later,
+	// which removes the identifier from the encryption salt.
+	Extendable bool
+	// IterationExponent sets the number of PBKDF2 iterations used to encrypt the secret to 10000 << e.
+	IterationExponent uint8
+	// GroupIndex is the index of the share's group, and GroupThreshold of the
+	// GroupCount groups are needed to recover the secret.
+	GroupIndex, GroupThreshold, GroupCount uint8
+	// MemberIndex is the index of the share in its group, and MemberThreshold
+	// shares of the group are needed to recover the group's share.
+	MemberIndex, MemberThreshold uint8
+	// Value is the share of the group's share.
+	Value []byte
+}
+
+const (
+	radixBits      = 10
+	idExpWords     = 2 // identifier, extendable flag and iteration exponent
+	groupWords     = 2 // group and member parameters
+	checksumWords  = 3
+	metadataWords  = idExpWords + groupWords + checksumWords
+	minMnemonicLen = metadataWords + (minSecretSize*8+radixBits-1)/radixBits
+)
+
+// customization returns the checksum customization string for the share.
+func customization(extendable bool) string {
+	if extendable {
+		return "shamir_extendable"
+	}
+	return "shamir"
+}
+
+var rs1024Generator = [10]uint32{
+	0xE0E040, 0x1C1C080, 0x3838100, 0x7070200, 0xE0E0009,
+	0x1C0C2412, 0x38086C24, 0x3090FC48, 0x21B1F890, 0x3F3F120,
+}
+
+// rs1024Polymod computes the Reed-Solomon checksum used by SLIP-39 over GF(1024).
+func rs1024Polymod(values []int) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 20
+		chk = (chk&0xFFFFF)<<10 ^ uint32(v)
+		for i := range rs1024Generator {
+			if b>>i&1 != 0 {
+				chk ^= rs1024Generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func customizationValues(extendable bool, data []int) []int {
+	values := make([]int, 0, len(customization(extendable))+len(data)+checksumWords)
+	for _, c := range []byte(customization(extendable)) {
+		values = append(values, int(c))
+	}
+	return append(values, data...)
+}
+
+func rs1024Checksum(extendable bool, data []int) []int {
+	values := append(customizationValues(extendable, data), 0, 0, 0)
+	polymod := rs1024Polymod(values) ^ 1
+	checksum := make([]int, checksumWords)
+	for i := range checksum {
+		checksum[i] = int(polymod>>(radixBits*(checksumWords-1-i))) & (1<<radixBits - 1)
+	}
+	return checksum
+}
+
+func rs1024Verify(extendable bool, data []int) bool {
+	return rs1024Polymod(customizationValues(extendable, data)) == 1
+}
+
+// Mnemonic encodes the share as a mnemonic of words separated by spaces.
+func (s Share) Mnemonic() string {
+	// the value is left-padded with zero bits to a multiple of the word size
+	valueWords := (len(s.Value)*8 + radixBits - 1) / radixBits
+	n := new(big.Int).SetBytes(s.Value)
+	value := make([]int, valueWords)
+	for i := valueWords - 1; i >= 0; i-- {
+		value[i] = int(new(big.Int).And(n, big.NewInt(1<<radixBits-1)).Int64())
+		n.Rsh(n, radixBits)
+	}
+
+	ext := 0
+	if s.Extendable {
+		ext = 1
+	}
+	idExp := int(s.Identifier)<<5 | ext<<4 | int(s.IterationExponent)
+	group := int(s.GroupIndex)<<16 | int(s.GroupThreshold-1)<<12 | int(s.GroupCount-1)<<8 |
+		int(s.MemberIndex)<<4 | int(s.MemberThreshold-1)
+
+	data := []int{idExp >> 10, idExp & 1023, group >> 10, group & 1023}
+	data = append(data, value...)
+	data = append(data, rs1024Checksum(s.Extendable, data)...)
+
+	words := make([]string, len(data))
+	for i, v := range data {
+		words[i] = wordlist[v]
+	}
+	return strings.Join(words, " ")
+}
+
+// ParseShare decodes a mnemonic, checking its checksum. Words may be abbreviated
+// to their first four letters, and case and extra whitespace are ignored.
+func ParseShare(mnemonic string) (Share, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) < minMnemonicLen {
+		return Share{}, fmt.Errorf("%w: a share has at least %d words, but got %d", ErrInvalidMnemonic, minMnemonicLen, len(words))
+	}
+
+	data := make([]int, len(words))
+	for i, word := range words {
+		// a misspelling after the first four letters is still a mistake
+		index, ok := wordIndex[word]
+		if !ok || len(word) > 4 && wordlist[index] != word {
+			return Share{}, fmt.Errorf("%w: unknown word '%s'", ErrInvalidMnemonic, word)
+		}
+		data[i] = index
+	}
+
+	paddingBits := radixBits * (len(data) - metadataWords) % 16
+	if paddingBits > 8 {
+		return Share{}, fmt.Errorf("%w: invalid number of words", ErrInvalidMnemonic)
+	}
+
+	idExp := data[0]<<10 | data[1]
+	s := Share{
+		Identifier:        uint16(idExp >> 5),
+		Extendable:        idExp>>4&1 == 1,
+		IterationExponent: uint8(idExp & 15),
+	}
+	if !rs1024Verify(s.Extendable, data) {
+		return Share{}, fmt.Errorf("%w: invalid checksum", ErrInvalidMnemonic)
+	}
+
+	group := data[2]<<10 | data[3]
+	s.GroupIndex = uint8(group >> 16)
+	s.GroupThreshold = uint8(group>>12&15) + 1
+	s.GroupCount = uint8(group>>8&15) + 1
+	s.MemberIndex = uint8(group >> 4 & 15)
+	s.MemberThreshold = uint8(group&15) + 1
+	if s.GroupCount < s.GroupThreshold {
+		return Share{}, fmt.Errorf("%w: group threshold exceeds the number of groups", ErrInvalidMnemonic)
+	}
+
+	n := new(big.Int)
+	for _, v := range data[idExpWords+groupWords : len(data)-checksumWords] {
+		n.Lsh(n, radixBits)
+		n.Or(n, big.NewInt(int64(v)))
+	}
+	valueBits := radixBits*(len(data)-metadataWords) - paddingBits
+	if n.BitLen() > valueBits {
+		return Share{}, fmt.Errorf("%w: invalid padding", ErrInvalidMnemonic)
+	}
+	s.Value = n.FillBytes(make([]byte, valueBits/8))
+	if len(s.Value) < minSecretSize {
+		return Share{}, fmt.Errorf("%w: share value is too short", ErrInvalidMnemonic)
+	}
+	return s, nil
+}
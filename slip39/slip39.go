@@ -0,0 +1,340 @@
+// Package slip39 implements SLIP-39, which splits a secret into groups of
+// mnemonic shares with checksums, so that they can be written on paper and
+// recovered using any implementation of the standard, such as hardware wallets.
+//
+// See https://github.com/satoshilabs/slips/blob/master/slip-0039.md.
+package slip39
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/zytekaron/galois-go"
+)
+
+// ErrInvalidMnemonic is returned when a mnemonic is not a valid share.
+var ErrInvalidMnemonic = errors.New("invalid slip-39 mnemonic")
+
+// ErrInvalidParameters is returned when shares cannot be created with the parameters.
+var ErrInvalidParameters = errors.New("invalid slip-39 parameters")
+
+// ErrMismatchedShares is returned when combining shares which belong to different secrets.
+var ErrMismatchedShares = errors.New("shares do not belong to the same secret")
+
+// ErrNotEnoughShares is returned when too few shares are given to recover the secret.
+var ErrNotEnoughShares = errors.New("not enough shares to recover the secret")
+
+// ErrDigest is returned when shares combine to the wrong secret, which means that one is incorrect.
+var ErrDigest = errors.New("share digest does not match, so a share is incorrect")
+
+const (
+	minSecretSize = 16
+	maxShares     = 16
+	digestSize    = 4
+	secretIndex   = 255
+	digestIndex   = 254
+
+	baseIterations = 10000
+	rounds         = 4
+)
+
+// field is the field used by SLIP-39, defined by the AES polynomial.
+var field = galois.NewDefault256()
+
+// Group is the number of shares in a group, and how many are needed to recover it.
+type Group struct {
+	Threshold, Count uint8
+}
+
+// Split encrypts the secret using the passphrase, then splits it into shares
+// for each group, of which groupThreshold groups are needed to recover it. The
+// secret must be at least 16 bytes, and an even number of bytes. The passphrase
+// must be printable ASCII, and may be empty. The iteration exponent sets the
+// number of PBKDF2 iterations to 10000 << iterationExponent.
+//
+// Shares are not extendable, for compatibility with older implementations.
+func Split(secret []byte, passphrase string, iterationExponent uint8, groupThreshold uint8, groups []Group) ([][]Share, error) {
+	if len(secret) < minSecretSize || len(secret)%2 != 0 {
+		return nil, fmt.Errorf("%w: the secret must be an even number of bytes, and at least %d", ErrInvalidParameters, minSecretSize)
+	}
+	if iterationExponent > 15 {
+		return nil, fmt.Errorf("%w: the iteration exponent must be at most 15", ErrInvalidParameters)
+	}
+	if len(groups) < 1 || len(groups) > maxShares {
+		return nil, fmt.Errorf("%w: there must be between 1 and %d groups", ErrInvalidParameters, maxShares)
+	}
+	if groupThreshold < 1 || int(groupThreshold) > len(groups) {
+		return nil, fmt.Errorf("%w: the group threshold must be between 1 and the number of groups", ErrInvalidParameters)
+	}
+	for _, g := range groups {
+		if g.Threshold < 1 || g.Threshold > g.Count || g.Count > maxShares {
+			return nil, fmt.Errorf("%w: group thresholds must be at least 1, and at most the group's count of at most %d", ErrInvalidParameters, maxShares)
+		}
+		if g.Threshold == 1 && g.Count > 1 {
+			return nil, fmt.Errorf("%w: a group with a threshold of 1 must have 1 share", ErrInvalidParameters)
+		}
+	}
+	err := CheckPassphrase(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	var id [2]byte
+	_, err = rand.Read(id[:])
+	if err != nil {
+		return nil, err
+	}
+	identifier := binary.BigEndian.Uint16(id[:]) >> 1
+
+	encrypted, err := encrypt(secret, passphrase, iterationExponent, identifier, false)
+	if err != nil {
+		return nil, err
+	}
+	groupShares, err := splitSecret(groupThreshold, uint8(len(groups)), encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([][]Share, len(groups))
+	for i, g := range groups {
+		memberShares, err := splitSecret(g.Threshold, g.Count, groupShares[i])
+		if err != nil {
+			return nil, err
+		}
+		for j, value := range memberShares {
+			shares[i] = append(shares[i], Share{
+				Identifier:        identifier,
+				IterationExponent: iterationExponent,
+				GroupIndex:        uint8(i),
+				GroupThreshold:    groupThreshold,
+				GroupCount:        uint8(len(groups)),
+				MemberIndex:       uint8(j),
+				MemberThreshold:   g.Threshold,
+				Value:             value,
+			})
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers the secret from the shares using the passphrase. Shares may be
+// given in any order, and any beyond the thresholds are ignored. A wrong passphrase
+// cannot be detected, and recovers a different secret.
+func Combine(shares []Share, passphrase string) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, ErrNotEnoughShares
+	}
+	err := CheckPassphrase(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	first := shares[0]
+	groups := map[uint8]map[uint8]Share{}
+	for _, s := range shares {
+		if s.Identifier != first.Identifier || s.Extendable != first.Extendable || s.IterationExponent != first.IterationExponent ||
+			s.GroupThreshold != first.GroupThreshold || s.GroupCount != first.GroupCount || len(s.Value) != len(first.Value) {
+			return nil, ErrMismatchedShares
+		}
+		if s.GroupIndex >= s.GroupCount {
+			return nil, fmt.Errorf("%w: group index %d exceeds the number of groups", ErrInvalidMnemonic, s.GroupIndex+1)
+		}
+		members := groups[s.GroupIndex]
+		if members == nil {
+			members = map[uint8]Share{}
+			groups[s.GroupIndex] = members
+		}
+		for _, m := range members {
+			if m.MemberThreshold != s.MemberThreshold {
+				return nil, fmt.Errorf("%w: member thresholds differ in group %d", ErrMismatchedShares, s.GroupIndex+1)
+			}
+		}
+		if m, ok := members[s.MemberIndex]; ok && !bytes.Equal(m.Value, s.Value) {
+			return nil, fmt.Errorf("%w: share %d of group %d was given twice with different values", ErrMismatchedShares, s.MemberIndex+1, s.GroupIndex+1)
+		}
+		members[s.MemberIndex] = s
+	}
+
+	// recover the share of each group which has enough members
+	groupShares := map[uint8][]byte{}
+	for _, index := range slices.Sorted(maps.Keys(groups)) {
+		members := groups[index]
+		var threshold uint8
+		for _, m := range members {
+			threshold = m.MemberThreshold
+		}
+		if len(members) < int(threshold) {
+			continue
+		}
+
+		values := map[uint8][]byte{}
+		for _, memberIndex := range slices.Sorted(maps.Keys(members))[:threshold] {
+			values[memberIndex] = members[memberIndex].Value
+		}
+		groupShares[index], err = recoverSecret(threshold, values)
+		if err != nil {
+			return nil, fmt.Errorf("group %d: %w", index+1, err)
+		}
+		if len(groupShares) == int(first.GroupThreshold) {
+			break
+		}
+	}
+	if len(groupShares) < int(first.GroupThreshold) {
+		return nil, fmt.Errorf("%w: %d of %d groups are complete", ErrNotEnoughShares, len(groupShares), first.GroupThreshold)
+	}
+
+	encrypted, err := recoverSecret(first.GroupThreshold, groupShares)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(encrypted, passphrase, first.IterationExponent, first.Identifier, first.Extendable)
+}
+
+// ParseShares parses every mnemonic, reporting which one is invalid.
+func ParseShares(mnemonics []string) ([]Share, error) {
+	shares := make([]Share, len(mnemonics))
+	for i, m := range mnemonics {
+		var err error
+		shares[i], err = ParseShare(m)
+		if err != nil {
+			return nil, fmt.Errorf("share %d: %w", i+1, err)
+		}
+	}
+	return shares, nil
+}
+
+// CheckPassphrase checks that the passphrase is printable ASCII, as SLIP-39 requires.
+func CheckPassphrase(passphrase string) error {
+	for _, c := range []byte(passphrase) {
+		if c < 32 || c > 126 {
+			return fmt.Errorf("%w: the passphrase must be printable ASCII", ErrInvalidParameters)
+		}
+	}
+	return nil
+}
+
+// splitSecret splits the secret into count shares, of which threshold are needed to recover it.
+// Besides the secret at x=255, the polynomial passes through a digest of the secret at x=254,
+// so that combining incorrect shares can be detected.
+func splitSecret(threshold, count uint8, secret []byte) ([][]byte, error) {
+	shares := make([][]byte, count)
+	if threshold == 1 {
+		for i := range shares {
+			shares[i] = slices.Clone(secret)
+		}
+		return shares, nil
+	}
+
+	base := map[uint8][]byte{}
+	for i := range threshold - 2 {
+		shares[i] = make([]byte, len(secret))
+		_, err := rand.Read(shares[i])
+		if err != nil {
+			return nil, err
+		}
+		base[i] = shares[i]
+	}
+	randomPart := make([]byte, len(secret)-digestSize)
+	_, err := rand.Read(randomPart)
+	if err != nil {
+		return nil, err
+	}
+	base[digestIndex] = append(digest(randomPart, secret), randomPart...)
+	base[secretIndex] = secret
+
+	for i := threshold - 2; i < count; i++ {
+		shares[i] = interpolate(base, i)
+	}
+	return shares, nil
+}
+
+// recoverSecret recovers the secret from exactly threshold shares, checking its digest.
+func recoverSecret(threshold uint8, shares map[uint8][]byte) ([]byte, error) {
+	if threshold == 1 {
+		for _, s := range shares {
+			return s, nil
+		}
+	}
+
+	secret := interpolate(shares, secretIndex)
+	digestShare := interpolate(shares, digestIndex)
+	if !hmac.Equal(digestShare[:digestSize], digest(digestShare[digestSize:], secret)) {
+		return nil, ErrDigest
+	}
+	return secret, nil
+}
+
+func digest(randomPart, secret []byte) []byte {
+	h := hmac.New(sha256.New, randomPart)
+	h.Write(secret)
+	return h.Sum(nil)[:digestSize]
+}
+
+// interpolate evaluates the polynomial through the shares at x, byte by byte.
+func interpolate(shares map[uint8][]byte, x uint8) []byte {
+	var size int
+	for _, s := range shares {
+		size = len(s)
+	}
+
+	samples := make([]galois.Point, 0, len(shares))
+	result := make([]byte, size)
+	for i := range result {
+		samples = samples[:0]
+		for index, s := range shares {
+			samples = append(samples, galois.Point{X: index, Y: s[i]})
+		}
+		result[i] = field.Interpolate(samples, x)
+	}
+	return result
+}
+
+// salt returns the salt used to encrypt the secret, which binds it to the identifier
+// unless the shares are extendable.
+func salt(identifier uint16, extendable bool) []byte {
+	if extendable {
+		return nil
+	}
+	return binary.BigEndian.AppendUint16([]byte("shamir"), identifier)
+}
+
+// feistel runs the four round Feistel network which encrypts the secret,
+// with the rounds in reverse when decrypting.
+func feistel(data []byte, passphrase string, iterationExponent uint8, salt []byte, decrypt bool) ([]byte, error) {
+	half := len(data) / 2
+	l, r := slices.Clone(data[:half]), slices.Clone(data[half:])
+	iterations := (baseIterations << iterationExponent) / rounds
+
+	for round := range rounds {
+		i := round
+		if decrypt {
+			i = rounds - 1 - round
+		}
+		password := append([]byte{byte(i)}, passphrase...)
+		f, err := pbkdf2.Key(sha256.New, string(password), append(slices.Clone(salt), r...), iterations, half)
+		if err != nil {
+			return nil, err
+		}
+		for j := range l {
+			l[j] ^= f[j]
+		}
+		l, r = r, l
+	}
+	return append(r, l...), nil
+}
+
+func encrypt(secret []byte, passphrase string, iterationExponent uint8, identifier uint16, extendable bool) ([]byte, error) {
+	return feistel(secret, passphrase, iterationExponent, salt(identifier, extendable), false)
+}
+
+func decrypt(encrypted []byte, passphrase string, iterationExponent uint8, identifier uint16, extendable bool) ([]byte, error) {
+	return feistel(encrypted, passphrase, iterationExponent, salt(identifier, extendable), true)
+}
@@ -0,0 +1,161 @@
+package slip39
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// vectors are taken from the SLIP-39 reference test vectors, which all use the passphrase TREZOR.
+var vectors = []struct {
+	name      string
+	mnemonics []string
+	secret    string
+	err       error
+}{
+	{
+		name:      "valid mnemonic without sharing (128 bits)",
+		mnemonics: []string{"duckling enlarge academic academic agency result length solution fridge kidney coal piece deal husband erode duke ajar critical decision keyboard"},
+		secret:    "bb54aac4b89dc868ba37d9cc21b2cece",
+	},
+	{
+		name:      "mnemonic with invalid checksum (128 bits)",
+		mnemonics: []string{"duckling enlarge academic academic agency result length solution fridge kidney coal piece deal husband erode duke ajar critical decision kidney"},
+		err:       ErrInvalidMnemonic,
+	},
+	{
+		name:      "mnemonic with invalid padding (128 bits)",
+		mnemonics: []string{"duckling enlarge academic academic email result length solution fridge kidney coal piece deal husband erode duke ajar music cargo fitness"},
+		err:       ErrInvalidMnemonic,
+	},
+	{
+		name: "basic sharing 2-of-3 (128 bits)",
+		mnemonics: []string{
+			"shadow pistol academic always adequate wildlife fancy gross oasis cylinder mustang wrist rescue view short owner flip making coding armed",
+			"shadow pistol academic acid actress prayer class unknown daughter sweater depict flip twice unkind craft early superior advocate guest smoking",
+		},
+		secret: "b43ceb7e57a0ea8766221624d01b0864",
+	},
+	{
+		name:      "basic sharing 2-of-3 with one share (128 bits)",
+		mnemonics: []string{"shadow pistol academic always adequate wildlife fancy gross oasis cylinder mustang wrist rescue view short owner flip making coding armed"},
+		err:       ErrNotEnoughShares,
+	},
+	{
+		name: "valid mnemonics which can detect some errors in modular arithmetic (128 bits)",
+		mnemonics: []string{
+			"herald flea academic cage avoid space trend estate dryer hairy evoke eyebrow improve airline artwork garlic premium duration prevent oven",
+			"herald flea academic client blue skunk class goat luxury deny presence impulse graduate clay join blanket bulge survive dish necklace",
+			"herald flea academic acne advance fused brother frozen broken game ranked ajar already believe check install theory angry exercise adult",
+		},
+		secret: "ad6f2ad8b59bbbaa01369b9006208d9a",
+	},
+	{
+		name:      "valid mnemonic without sharing (256 bits)",
+		mnemonics: []string{"theory painting academic academic armed sweater year military elder discuss acne wildlife boring employer fused large satoshi bundle carbon diagnose anatomy hamster leaves tracks paces beyond phantom capital marvel lips brave detect luck"},
+		secret:    "989baf9dcaad5b10ca33dfd8cc75e42477025dce88ae83e75a230086a0e00e92",
+	},
+	{
+		name: "basic sharing 2-of-3 (256 bits)",
+		mnemonics: []string{
+			"humidity disease academic always aluminum jewelry energy woman receiver strategy amuse duckling lying evidence network walnut tactics forget hairy rebound impulse brother survive clothes stadium mailman rival ocean reward venture always armed unwrap",
+			"humidity disease academic agency actress jacket gross physics cylinder solution fake mortgage benefit public busy prepare sharp friar change work slow purchase ruler again tricycle involve viral wireless mixture anatomy desert cargo upgrade",
+		},
+		secret: "c938b319067687e990e05e0da0ecce1278f75ff58d9853f19dcaeed5de104aae",
+	},
+	{
+		name:      "valid extendable mnemonic without sharing (128 bits)",
+		mnemonics: []string{"testify swimming academic academic column loyalty smear include exotic bedroom exotic wrist lobe cover grief golden smart junior estimate learn"},
+		secret:    "1679b4516e0ee5954351d288a838f45e",
+	},
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		shares, err := ParseShares(v.mnemonics)
+		if err == nil {
+			for i, s := range shares {
+				if s.Mnemonic() != v.mnemonics[i] {
+					t.Errorf("%s: share %d does not encode to the same mnemonic", v.name, i+1)
+				}
+			}
+			var secret []byte
+			secret, err = Combine(shares, "TREZOR")
+			if v.err == nil && hex.EncodeToString(secret) != v.secret {
+				t.Errorf("%s: got secret %x, want %s", v.name, secret, v.secret)
+			}
+		}
+		if v.err == nil && err != nil {
+			t.Errorf("%s: %v", v.name, err)
+		} else if !errors.Is(err, v.err) {
+			t.Errorf("%s: got %v, want %v", v.name, err, v.err)
+		}
+	}
+}
+
+func TestMismatchedShares(t *testing.T) {
+	shares, err := ParseShares([]string{vectors[3].mnemonics[0], vectors[7].mnemonics[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Combine(shares, "TREZOR")
+	if !errors.Is(err, ErrMismatchedShares) {
+		t.Errorf("combine shares of different secrets: got %v, want %v", err, ErrMismatchedShares)
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x5a}, 32)
+	groups := []Group{{1, 1}, {2, 3}, {3, 5}}
+	shares, err := Split(secret, "passphrase", 0, 2, groups)
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	for i, g := range groups {
+		if len(shares[i]) != int(g.Count) {
+			t.Fatalf("group %d: got %d shares, want %d", i+1, len(shares[i]), g.Count)
+		}
+	}
+
+	// the mnemonics are parsed again, as they would be when recovered from paper
+	var mnemonics []string
+	for _, s := range []Share{shares[2][4], shares[0][0], shares[2][1], shares[2][3]} {
+		mnemonics = append(mnemonics, s.Mnemonic())
+	}
+	parsed, err := ParseShares(mnemonics)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	got, err := Combine(parsed, "passphrase")
+	if err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Errorf("combine: got %x, want %x", got, secret)
+	}
+
+	_, err = Combine([]Share{shares[1][0], shares[1][2], shares[2][0]}, "passphrase")
+	if !errors.Is(err, ErrNotEnoughShares) {
+		t.Errorf("combine one complete group: got %v, want %v", err, ErrNotEnoughShares)
+	}
+	wrong, err := Combine(parsed, "another")
+	if err != nil || bytes.Equal(wrong, secret) {
+		t.Errorf("combine with another passphrase: got %x, %v", wrong, err)
+	}
+}
+
+func TestCheckPassphrase(t *testing.T) {
+	for _, passphrase := range []string{"", "TREZOR", "a b~c"} {
+		err := CheckPassphrase(passphrase)
+		if err != nil {
+			t.Errorf("passphrase %q: %v", passphrase, err)
+		}
+	}
+	for _, passphrase := range []string{"pässword", "tab\there", "line\n"} {
+		err := CheckPassphrase(passphrase)
+		if !errors.Is(err, ErrInvalidParameters) {
+			t.Errorf("passphrase %q: got %v, want %v", passphrase, err, ErrInvalidParameters)
+		}
+	}
+}
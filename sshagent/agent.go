@@ -0,0 +1,94 @@
+// Package sshagent serves SSH keys derived from a vault's master key
+// using the SSH agent protocol.
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"fidokit/crypto"
+)
+
+// ErrReadOnly is returned when a client tries to add or remove keys.
+var ErrReadOnly = errors.New("the fidokit agent only serves keys derived from the vault")
+
+// ErrInvalidLabel is returned for an empty key label.
+var ErrInvalidLabel = errors.New("key label must not be empty")
+
+// DeriveKey derives the Ed25519 key for the label from the master key.
+// The same master key and label always produce the same key.
+func DeriveKey(masterKey []byte, label string) (ed25519.PrivateKey, error) {
+	if label == "" {
+		return nil, ErrInvalidLabel
+	}
+	return ed25519.NewKeyFromSeed(crypto.DeriveKey(masterKey, "ssh-ed25519:"+label)), nil
+}
+
+// PublicKey returns the public key for the label in the authorized_keys format,
+// with the comment appended.
+func PublicKey(masterKey []byte, label, comment string) (string, error) {
+	key, err := DeriveKey(masterKey, label)
+	if err != nil {
+		return "", err
+	}
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return "", err
+	}
+	line := string(ssh.MarshalAuthorizedKey(pub))
+	return line[:len(line)-1] + " " + comment, nil
+}
+
+// Comment returns the comment identifying the key for the label in the vault.
+func Comment(vaultName, label string) string {
+	return fmt.Sprintf("fidokit:%s/%s", vaultName, label)
+}
+
+// readOnly is a keyring which cannot be changed by clients.
+type readOnly struct {
+	agent.Agent
+}
+
+func (readOnly) Add(agent.AddedKey) error   { return ErrReadOnly }
+func (readOnly) Remove(ssh.PublicKey) error { return ErrReadOnly }
+func (readOnly) RemoveAll() error           { return ErrReadOnly }
+
+// New returns an agent which serves the keys derived for each label. Clients may
+// lock and unlock the agent, but cannot add or remove keys.
+func New(masterKey []byte, vaultName string, labels []string) (agent.Agent, error) {
+	keyring := agent.NewKeyring()
+	for _, label := range labels {
+		key, err := DeriveKey(masterKey, label)
+		if err != nil {
+			return nil, err
+		}
+		err = keyring.Add(agent.AddedKey{PrivateKey: key, Comment: Comment(vaultName, label)})
+		if err != nil {
+			return nil, fmt.Errorf("add key '%s': %w", label, err)
+		}
+	}
+	return readOnly{keyring}, nil
+}
+
+// Serve serves the agent to each connection accepted by the listener
+// until it is closed.
+func Serve(ln net.Listener, a agent.Agent) error {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			_ = agent.ServeAgent(a, conn)
+		}()
+	}
+}
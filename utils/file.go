@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// WriteFileAtomic replaces the file at path with data, such that a crash or
+// error at any point leaves either the old or the new file in place, never a
+// partially written one. The data is written to a temporary file in the same
+// directory, synced, then renamed over the original.
+//
+// If backups is greater than zero, the previous file is kept as path.bak.1,
+// and older generations are rotated up to path.bak.<backups>.
+func WriteFileAtomic(path string, data []byte, backups int) error {
+	dir := filepath.Dir(path)
+
+	// keep the permissions of the existing file, and default to private files
+	perm := fs.FileMode(0600)
+	info, err := os.Stat(path)
+	exists := err == nil
+	if exists {
+		perm = info.Mode().Perm()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("stat file: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	err = writeAndSync(tmp, data, perm)
+	if err != nil {
+		return err
+	}
+
+	if exists && backups > 0 {
+		err = rotateBackups(path, backups)
+		if err != nil {
+			return fmt.Errorf("rotate backups: %w", err)
+		}
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("rename temp file: %w", err)
+	}
+
+	err = syncDir(dir)
+	if err != nil {
+		return fmt.Errorf("sync directory: %w", err)
+	}
+	return nil
+}
+
+// BackupPath returns the path of the nth most recent backup of path, from 1.
+func BackupPath(path string, n int) string {
+	return fmt.Sprintf("%s.bak.%d", path, n)
+}
+
+func writeAndSync(file *os.File, data []byte, perm fs.FileMode) error {
+	_, err := file.Write(data)
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	return nil
+}
+
+// rotateBackups shifts existing backups of path up by one generation,
+// dropping the oldest, then makes the current file the newest backup.
+func rotateBackups(path string, backups int) error {
+	err := os.Remove(BackupPath(path, backups))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for n := backups - 1; n >= 1; n-- {
+		err = os.Rename(BackupPath(path, n), BackupPath(path, n+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	// a hard link keeps the current file in place until the rename replaces it
+	err = os.Link(path, BackupPath(path, 1))
+	if err != nil {
+		return copyFile(path, BackupPath(path, 1))
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir flushes the directory entry changes made by a rename to disk.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// directories cannot be opened for syncing on windows
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// AtomicFile is a file which replaces the file at its path only once it is
+// committed, like WriteFileAtomic, for data too large to be held in memory.
+type AtomicFile struct {
+	*os.File
+	path      string
+	committed bool
+}
+
+// CreateAtomic creates a temporary file in the same directory as path, which
+// replaces it when committed. New files are only readable by their owner.
+func CreateAtomic(path string) (*AtomicFile, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	return &AtomicFile{File: tmp, path: path}, nil
+}
+
+// Commit syncs and closes the file, then renames it over its path.
+func (f *AtomicFile) Commit() error {
+	err := f.Sync()
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("write temp file: %w", err)
+	}
+
+	err = os.Rename(f.Name(), f.path)
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("rename temp file: %w", err)
+	}
+	f.committed = true
+	err = syncDir(filepath.Dir(f.path))
+	if err != nil {
+		return fmt.Errorf("sync directory: %w", err)
+	}
+	return nil
+}
+
+// Abort closes and removes the file, leaving its path unchanged.
+// It does nothing if the file was already committed.
+func (f *AtomicFile) Abort() {
+	if f.committed {
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAtomicFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out")
+
+	f, err := CreateAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("committed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(path)
+	if err == nil {
+		t.Errorf("file exists before it was committed")
+	}
+	err = f.Commit()
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// another file created at the temp path must survive the deferred Abort
+	err = os.WriteFile(f.Name(), []byte("other"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Abort()
+	_, err = os.Stat(f.Name())
+	if err != nil {
+		t.Errorf("abort after commit removed the temp path: %v", err)
+	}
+	os.Remove(f.Name())
+
+	g, err := CreateAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.WriteString("aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Abort()
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "committed" {
+		t.Errorf("got %q, %v, want %q", data, err, "committed")
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("got %d files, want only the committed file", len(entries))
+	}
+}
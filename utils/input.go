@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// maxInputSize limits how much is read from an input source.
+const maxInputSize = 1 << 20
+
+// ErrInputTerminal is returned when reading secret input from stdin while it is a terminal,
+// which would echo the input.
+var ErrInputTerminal = errors.New("stdin is a terminal; pipe the input instead")
+
+// ReadInput reads secret input from the source, which is "-" or "stdin" for
+// standard input (which must not be a terminal), "fd:N" for the inherited file
+// descriptor N, "env:NAME" for the environment variable NAME (which is then
+// unset), or a file path, optionally prefixed with "file:".
+func ReadInput(source string) ([]byte, error) {
+	switch {
+	case source == "-" || source == "stdin":
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, ErrInputTerminal
+		}
+		return readLimited(os.Stdin)
+	case strings.HasPrefix(source, "fd:"):
+		fd, err := strconv.ParseUint(strings.TrimPrefix(source, "fd:"), 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file descriptor: %s", source)
+		}
+		f := os.NewFile(uintptr(fd), source)
+		if f == nil {
+			return nil, fmt.Errorf("invalid file descriptor: %s", source)
+		}
+		defer f.Close()
+		return readLimited(f)
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		// avoid passing the secret on to child processes
+		err := os.Unsetenv(name)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(value), nil
+	default:
+		f, err := os.Open(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readLimited(f)
+	}
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxInputSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxInputSize {
+		return nil, fmt.Errorf("input is larger than %d bytes", maxInputSize)
+	}
+	return data, nil
+}
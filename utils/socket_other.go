@@ -0,0 +1,11 @@
+//go:build !unix
+
+package utils
+
+import "net"
+
+// ListenPrivate listens on a new unix socket at path. Sockets are protected by
+// the permissions of their directory on this platform.
+func ListenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
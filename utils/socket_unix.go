@@ -0,0 +1,18 @@
+//go:build unix
+
+package utils
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenPrivate listens on a new unix socket at path which only the current
+// user can connect to. The umask is set while the socket is created, so the
+// socket is never accessible to other users, even briefly.
+func ListenPrivate(path string) (net.Listener, error) {
+	mask := unix.Umask(0o177)
+	defer unix.Umask(mask)
+	return net.Listen("unix", path)
+}